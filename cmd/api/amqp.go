@@ -1,69 +1,586 @@
 package main
 
-import amqp "github.com/rabbitmq/amqp091-go"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
 
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	stripeEventsExchange   = "stripe_events"
+	stripeProcessingQueue  = "stripe_processing.v2"
+	legacyProcessingQueue  = "stripe_processing"
+	retryExchange          = "stripe_processing.retry"
+	deadLetterExchange     = "stripe_processing.dlx"
+	deadLetterQueue        = "stripe_processing.dlq"
+	attemptHeader          = "x-attempt"
+	maxProcessingAttempts  = 5
+	retryBaseDelay         = 5 * time.Second
+	retryBackoffMultiplier = 3
+)
+
+var errRabbitMQClosed = errors.New("rabbitmq client closed")
+
+// rabbitMQClient owns the broker connection. A supervisor goroutine watches
+// it and, when the broker goes away, reconnects with backoff and declares the
+// topology again. Callers never hold on to the connection itself; they ask
+// for a fresh channel, which blocks until the broker is reachable.
 type rabbitMQClient struct {
 	ampqpUrl string
-	conn     *amqp.Connection
-	channel  *amqp.Channel
+	logger   *slog.Logger
+
+	mu     sync.RWMutex
+	conn   *amqp.Connection
+	ready  chan struct{} // closed while connected
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func newRabbitMQClient() (*rabbitMQClient, error) {
+func newRabbitMQClient(logger *slog.Logger) (*rabbitMQClient, error) {
 	rabbitMQUrl, err := getRequiredStringEnv("AMQP_URL")
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := amqp.Dial(*rabbitMQUrl)
+	conn, err := dialRabbitMQ(*rabbitMQUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &rabbitMQClient{
+		ampqpUrl: *rabbitMQUrl,
+		logger:   logger,
+		conn:     conn,
+		ready:    make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	close(r.ready)
+
+	go r.supervise(conn)
+
+	return r, nil
+}
+
+// dialRabbitMQ connects to the broker and declares the topology.
+func dialRabbitMQ(url string) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(url)
 	if err != nil {
 		return nil, err
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer ch.Close()
+
+	if err := declareTopology(ch); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	err = ch.ExchangeDeclare(
-		"stripe_events", // name
-		"fanout",        // type
-		true,            // durable
-		false,           // auto-deleted
-		false,           // internal
-		false,           // no-wait
-		nil,             // args
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := migrateLegacyQueue(ctx, conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to migrate %s: %w", legacyProcessingQueue, err)
+	}
+
+	return conn, nil
+}
+
+// supervise waits for the current connection to close and replaces it,
+// retrying with exponential backoff until it succeeds or the client is
+// closed.
+func (r *rabbitMQClient) supervise(conn *amqp.Connection) {
+	defer close(r.done)
+
+	const (
+		minBackoff = time.Second
+		maxBackoff = 30 * time.Second
 	)
-	if err != nil {
+
+	for {
+		closeErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		r.ready = make(chan struct{})
+		r.mu.Unlock()
+
+		if ok {
+			r.logger.Warn("rabbitmq connection lost, reconnecting", "err", closeErr)
+		} else {
+			r.logger.Warn("rabbitmq connection closed, reconnecting")
+		}
+
+		backoff := minBackoff
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			newConn, err := dialRabbitMQ(r.ampqpUrl)
+			if err == nil {
+				conn = newConn
+				break
+			}
+
+			r.logger.Error("rabbitmq reconnect failed", "err", err, "retry_in", backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			conn.Close()
+			return
+		}
+		r.conn = conn
+		close(r.ready)
+		r.mu.Unlock()
+
+		r.logger.Info("rabbitmq connection restored")
+	}
+}
+
+// Channel opens a new channel on the current connection, waiting for the
+// supervisor to reconnect if the broker is unavailable.
+func (r *rabbitMQClient) Channel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		r.mu.RLock()
+		closed, ready, conn := r.closed, r.ready, r.conn
+		r.mu.RUnlock()
+
+		if closed {
+			return nil, errRabbitMQClosed
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		ch, err := conn.Channel()
+		if err == nil {
+			return ch, nil
+		}
+
+		// The connection dropped between the ready check and the call; wait
+		// for the supervisor to notice and try again.
+		if errors.Is(err, amqp.ErrClosed) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
 		return nil, err
 	}
+}
+
+// state reports the connection state for health checks.
+func (r *rabbitMQClient) state() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return "closed"
+	}
+
+	select {
+	case <-r.ready:
+	default:
+		return "reconnecting"
+	}
+
+	// The connection may have dropped before the supervisor noticed.
+	if r.conn.IsClosed() {
+		return "reconnecting"
+	}
+	return "connected"
+}
+
+// Close stops the supervisor and closes the connection.
+func (r *rabbitMQClient) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	conn := r.conn
+	r.mu.Unlock()
+
+	r.cancel()
+	err := conn.Close()
+	<-r.done
+
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// declareTopology declares the payment_events exchange for the events this
+// service emits, plus the stripe_events exchange and the processing queue
+// together with the retry and dead-letter topology behind it:
+//
+//	stripe_events (fanout) -> stripe_processing.v2
+//	failed attempt n       -> stripe_processing.retry (direct) -> stripe_processing.retry.n
+//	                          (TTL expires)                    -> stripe_processing.v2
+//	rejected / exhausted   -> stripe_processing.dlx (fanout)   -> stripe_processing.dlq
+//
+// stripe_processing.v2 replaces stripe_processing, which was declared
+// without a dead-letter exchange; see migrateLegacyQueue.
+func declareTopology(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		stripeEventsExchange, // name
+		"fanout",             // type
+		true,                 // durable
+		false,                // auto-deleted
+		false,                // internal
+		false,                // no-wait
+		nil,                  // args
+	)
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(paymentEventsExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(deadLetterExchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = ch.QueueBind(deadLetterQueue, "", deadLetterExchange, false, nil)
+	if err != nil {
+		return err
+	}
 
 	q, err := ch.QueueDeclare(
-		"stripe_processing",
+		stripeProcessingQueue,
 		true,
 		false,
 		false,
 		false,
-		nil,
+		amqp.Table{
+			"x-dead-letter-exchange": deadLetterExchange,
+		},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = ch.QueueBind(
 		q.Name,
 		"",
-		"stripe_events",
+		stripeEventsExchange,
 		false,
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &rabbitMQClient{
-		ampqpUrl: *rabbitMQUrl,
-		conn:     conn,
-		channel:  ch,
+	err = ch.ExchangeDeclare(retryExchange, "direct", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt < maxProcessingAttempts; attempt++ {
+		name := retryQueueName(attempt)
+
+		// Expired messages go back to stripe_processing through the default
+		// exchange, so other queues bound to stripe_events don't see them again.
+		_, err = ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             retryDelay(attempt).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": stripeProcessingQueue,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = ch.QueueBind(name, name, retryExchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func retryQueueName(attempt int) string {
+	return fmt.Sprintf("%s.%d", retryExchange, attempt)
+}
+
+// retryDelay returns how long a message waits after its nth failed attempt.
+func retryDelay(attempt int) time.Duration {
+	return retryBaseDelay * time.Duration(math.Pow(retryBackoffMultiplier, float64(attempt-1)))
+}
+
+// deliveryAttempt returns the 1-based attempt number of a delivery, as
+// carried in the x-attempt header.
+func deliveryAttempt(msg amqp.Delivery) int {
+	switch v := msg.Headers[attemptHeader].(type) {
+	case int32:
+		return int(v) + 1
+	case int64:
+		return int(v) + 1
+	case int:
+		return v + 1
+	default:
+		return 1
+	}
+}
+
+// confirmChannel is a channel in confirm mode. Its publishes are mandatory
+// and only succeed once the broker has routed and confirmed the message.
+type confirmChannel struct {
+	*amqp.Channel
+	returns <-chan amqp.Return
+}
+
+func newConfirmChannel(ch *amqp.Channel) (*confirmChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	return &confirmChannel{
+		Channel: ch,
+		returns: ch.NotifyReturn(make(chan amqp.Return, 1)),
 	}, nil
+}
+
+// publish publishes msg and waits for the broker to confirm it. The broker
+// returns an unroutable mandatory message before confirming it, so a return
+// is waiting by the time the confirmation arrives. Publishes must not run
+// concurrently on the same channel.
+func (c *confirmChannel) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	// Discard a return left over from a publish that timed out.
+	select {
+	case <-c.returns:
+	default:
+	}
+
+	confirmation, err := c.PublishWithDeferredConfirmWithContext(ctx, exchange, key, true, false, msg)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	switch {
+	case err != nil:
+		return err
+	case !acked:
+		return fmt.Errorf("broker did not confirm message %s", msg.MessageId)
+	}
+
+	select {
+	case ret := <-c.returns:
+		return fmt.Errorf("message %s could not be routed to %q: %s", msg.MessageId, key, ret.ReplyText)
+	default:
+		return nil
+	}
+}
+
+// scheduleRetry republishes a failed delivery onto the delay queue for its
+// attempt, recording the attempt in the message headers. It returns once the
+// broker has confirmed the retry, so the delivery can then be acked.
+func scheduleRetry(ctx context.Context, ch *confirmChannel, msg amqp.Delivery, attempt int) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[attemptHeader] = int32(attempt)
+
+	return ch.publish(ctx, retryExchange, retryQueueName(attempt), amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageId,
+		Type:         msg.Type,
+		Timestamp:    msg.Timestamp,
+		Body:         msg.Body,
+	})
+}
+
+// requeueDeadLetters moves up to limit messages from the dead-letter queue
+// back onto stripe_processing with a fresh attempt count. A limit of zero
+// drains the messages the queue holds when it starts; messages that fail
+// again and are dead-lettered meanwhile are left for a later run. Each
+// message is only removed from the DLQ once the broker has confirmed the
+// republish.
+func (r *rabbitMQClient) requeueDeadLetters(ctx context.Context, limit int) (int, error) {
+	ch, err := r.Channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(deadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit == 0 || limit > q.Messages {
+		limit = q.Messages
+	}
+
+	cc, err := newConfirmChannel(ch)
+	if err != nil {
+		return 0, err
+	}
+
+	return moveMessages(ctx, cc, deadLetterQueue, stripeProcessingQueue, limit, func(headers amqp.Table) amqp.Table {
+		fresh := amqp.Table{}
+		for key, value := range headers {
+			if key == attemptHeader || key == "x-death" || key == "x-first-death-exchange" ||
+				key == "x-first-death-queue" || key == "x-first-death-reason" {
+				continue
+			}
+			fresh[key] = value
+		}
+		return fresh
+	})
+}
+
+// moveMessages moves up to limit messages from one queue to another through
+// the default exchange, rewriting their headers with headers. Each message
+// is only removed from its queue once the broker has confirmed the
+// republish.
+func moveMessages(ctx context.Context, ch *confirmChannel, from, to string, limit int, headers func(amqp.Table) amqp.Table) (int, error) {
+	moved := 0
+	for moved < limit {
+		msg, ok, err := ch.Get(from, false)
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			break
+		}
+
+		err = ch.publish(ctx, "", to, amqp.Publishing{
+			Headers:      headers(msg.Headers),
+			ContentType:  msg.ContentType,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    msg.MessageId,
+			Type:         msg.Type,
+			Timestamp:    msg.Timestamp,
+			Body:         msg.Body,
+		})
+		if err != nil {
+			msg.Nack(false, true)
+			return moved, err
+		}
+
+		if err := msg.Ack(false); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, nil
+}
+
+// migrateLegacyQueue moves a broker off the processing queue declared before
+// dead-lettering was added. Queue arguments cannot be changed on an existing
+// queue, so dead-lettering came with a new queue: events stop being routed
+// to the old one, the messages it still holds are moved over and it is
+// deleted once it is empty and no instance still running the old version
+// consumes it. Until then it is retried on every connect. Events delivered
+// to both queues during a rolling upgrade are processed once, as handled
+// events are skipped.
+func migrateLegacyQueue(ctx context.Context, conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(legacyProcessingQueue, true, false, false, false, nil)
+	if err != nil {
+		// A failed passive declare closes the channel; nothing to migrate.
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return nil
+		}
+		return err
+	}
+
+	if err := ch.QueueUnbind(legacyProcessingQueue, "", stripeEventsExchange, nil); err != nil {
+		return err
+	}
+
+	cc, err := newConfirmChannel(ch)
+	if err != nil {
+		return err
+	}
+
+	_, err = moveMessages(ctx, cc, legacyProcessingQueue, stripeProcessingQueue, q.Messages, func(headers amqp.Table) amqp.Table {
+		return headers
+	})
+	if err != nil {
+		return err
+	}
+
+	// The delete is refused while the queue is still consumed or holds
+	// messages published since; the next connect tries again.
+	_, _ = ch.QueueDelete(legacyProcessingQueue, true, true, false)
+
+	return nil
+}
+
+// queueDepths returns the number of messages ready in each of the named
+// queues.
+func (r *rabbitMQClient) queueDepths(ctx context.Context, queues ...string) (map[string]int, error) {
+	ch, err := r.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	depths := make(map[string]int, len(queues))
+	for _, name := range queues {
+		q, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		depths[name] = q.Messages
+	}
 
+	return depths, nil
 }
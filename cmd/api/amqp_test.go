@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 5 * time.Second},
+		{attempt: 2, want: 15 * time.Second},
+		{attempt: 3, want: 45 * time.Second},
+		{attempt: maxProcessingAttempts - 1, want: 135 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryAttempt(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{name: "first delivery", headers: nil, want: 1},
+		{name: "int32 header", headers: amqp.Table{attemptHeader: int32(1)}, want: 2},
+		{name: "int64 header", headers: amqp.Table{attemptHeader: int64(3)}, want: 4},
+		{name: "int header", headers: amqp.Table{attemptHeader: 4}, want: 5},
+		{name: "unexpected header type", headers: amqp.Table{attemptHeader: "2"}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deliveryAttempt(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+				t.Errorf("deliveryAttempt() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+)
+
+// authorizationValidity is how long Stripe keeps an uncaptured card
+// authorization before releasing the hold.
+const authorizationValidity = 7 * 24 * time.Hour
+
+// authorizationBatchSize bounds the payments handled per check.
+const authorizationBatchSize = 100
+
+// authorizationExpiringEvent is published once per payment when its
+// authorization is about to expire without having been captured.
+type authorizationExpiringEvent struct {
+	Payment   *data.Payment `json:"payment"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// monitorAuthorizations periodically warns about manually captured payments
+// whose authorization is about to expire and, when configured, cancels them
+// so the hold is released on our terms.
+func (s *service) monitorAuthorizations() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.cancelStaleAuthorizations(ctx)
+			s.warnExpiringAuthorizations(ctx)
+		}
+	}
+}
+
+func (s *service) cancelStaleAuthorizations(ctx context.Context) {
+	if s.config.authorizationCancelAfter <= 0 {
+		return
+	}
+
+	stale, err := s.models.Payment.GetUncapturedAuthorizations(ctx, time.Now().Add(-s.config.authorizationCancelAfter), false, authorizationBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list stale authorizations", "err", err)
+		return
+	}
+
+	reason := "abandoned"
+
+	for _, payment := range stale {
+		// The key makes a retry after a partial failure safe.
+		_, err := s.cancelPayment(ctx, payment, &reason, "authorization-expiry:"+payment.ID)
+		if err != nil {
+			s.logger.Error("failed to cancel stale authorization", "payment_id", payment.ID, "err", err)
+			continue
+		}
+
+		s.logger.Info("stale authorization canceled", "payment_id", payment.ID, "amount", payment.Amount)
+	}
+}
+
+func (s *service) warnExpiringAuthorizations(ctx context.Context) {
+	expiring, err := s.models.Payment.GetUncapturedAuthorizations(ctx, time.Now().Add(-s.config.authorizationWarnAfter), true, authorizationBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list expiring authorizations", "err", err)
+		return
+	}
+
+	warned := 0
+
+	for _, payment := range expiring {
+		authorizedAt := payment.CreatedAt
+		if payment.ConfirmedAt != nil {
+			authorizedAt = *payment.ConfirmedAt
+		}
+
+		err := s.models.Transact(ctx, func(tx data.Models) error {
+			if err := tx.Payment.MarkAuthorizationExpiryWarned(ctx, payment.ID); err != nil {
+				return err
+			}
+			return enqueueServiceEvent(ctx, tx, "payment.authorization_expiring", authorizationExpiringEvent{
+				Payment:   payment,
+				ExpiresAt: authorizedAt.Add(authorizationValidity),
+			})
+		})
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Another instance warned first.
+		case err != nil:
+			s.logger.Error("failed to warn about expiring authorization", "payment_id", payment.ID, "err", err)
+		default:
+			warned++
+			s.logger.Warn("authorization about to expire", "payment_id", payment.ID, "expires_at", authorizedAt.Add(authorizationValidity))
+		}
+	}
+
+	if warned > 0 {
+		s.outboxRelay.notify()
+	}
+}
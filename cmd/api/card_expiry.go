@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+)
+
+// cardExpiryBatchSize bounds the cards notified per threshold and check.
+const cardExpiryBatchSize = 500
+
+// paymentMethodExpiringEvent asks the notification service to tell a user
+// that a saved card is about to expire, or that their default card already
+// has.
+type paymentMethodExpiringEvent struct {
+	PaymentMethod *data.PaymentMethod `json:"payment_method"`
+	UserID        *int64              `json:"user_id"`
+	Email         *string             `json:"email"`
+	ExpiresAt     time.Time           `json:"expires_at"`
+	// ThresholdDays is the notice period that triggered the event, 0 for an
+	// expired card.
+	ThresholdDays int  `json:"threshold_days"`
+	Expired       bool `json:"expired"`
+}
+
+// monitorCardExpiry periodically publishes payment_method.expiring events.
+func (s *service) monitorCardExpiry() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.notifyExpiringCards(ctx, time.Now())
+		}
+	}
+}
+
+// notifyExpiringCards publishes one event per card and threshold. Each card
+// is notified for the smallest threshold it falls within, so a card first
+// seen 5 days before expiry with thresholds of 30 and 7 days gets a single
+// 7-day notice. Default cards that already expired are notified once too.
+func (s *service) notifyExpiringCards(ctx context.Context, now time.Time) {
+	thresholds := slices.Clone(s.config.cardExpiryNoticeDays)
+	slices.Sort(thresholds)
+
+	notified := 0
+
+	notified += s.notifyCards(ctx, time.Time{}, now, true, 0)
+
+	after := now
+	for _, days := range thresholds {
+		if days <= 0 {
+			continue
+		}
+
+		before := now.AddDate(0, 0, days)
+		notified += s.notifyCards(ctx, after, before, false, days)
+		after = before
+	}
+
+	if notified > 0 {
+		s.outboxRelay.notify()
+		s.logger.Info("card expiry notifications queued", "count", notified)
+	}
+}
+
+func (s *service) notifyCards(ctx context.Context, after, before time.Time, defaultOnly bool, thresholdDays int) int {
+	cards, err := s.models.PaymentMethod.GetExpiringCards(ctx, after, before, defaultOnly, thresholdDays, cardExpiryBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list expiring cards", "threshold_days", thresholdDays, "err", err)
+		return 0
+	}
+
+	notified := 0
+
+	for _, card := range cards {
+		pm := card.PaymentMethod
+
+		var inserted bool
+
+		err := s.models.Transact(ctx, func(tx data.Models) error {
+			var err error
+			inserted, err = tx.PaymentMethod.MarkExpiryNotified(ctx, pm.ID, thresholdDays, *pm.CardExpMonth, *pm.CardExpYear)
+			if err != nil || !inserted {
+				return err
+			}
+
+			return enqueueServiceEvent(ctx, tx, "payment_method.expiring", paymentMethodExpiringEvent{
+				PaymentMethod: pm,
+				UserID:        card.UserID,
+				Email:         card.Email,
+				ExpiresAt:     card.ExpiresAt,
+				ThresholdDays: thresholdDays,
+				Expired:       thresholdDays == 0,
+			})
+		})
+		switch {
+		case err != nil:
+			s.logger.Error("failed to queue card expiry notification", "payment_method_id", pm.ID, "threshold_days", thresholdDays, "err", err)
+		case inserted:
+			notified++
+		}
+	}
+
+	return notified
+}
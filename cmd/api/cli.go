@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+// runCommand executes an operator subcommand such as `requeue-dlq`. It
+// reports whether args named a subcommand, in which case the service is not
+// started.
+func runCommand(logger *slog.Logger, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "requeue-dlq":
+		return true, requeueDLQCommand(logger, args[1:])
+	case "reconcile":
+		return true, reconcileCommand(logger, args[1:])
+	case "replay-webhooks":
+		return true, replayWebhooksCommand(logger, args[1:])
+	default:
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func requeueDLQCommand(logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("requeue-dlq", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "maximum number of messages to requeue (0 drains the queue)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "time allowed for the whole operation")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rabbitmq, err := newRabbitMQClient(logger)
+	if err != nil {
+		return fmt.Errorf("could not reach rabbitmq: %w", err)
+	}
+	defer rabbitmq.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	requeued, err := rabbitmq.requeueDeadLetters(ctx, *limit)
+	logger.Info("requeued dead-lettered messages", "queue", deadLetterQueue, "count", requeued)
+
+	return err
+}
+
+func reconcileCommand(logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	from := fs.String("from", "", "start of the range, as 2006-01-02 or RFC 3339 (default 24h ago)")
+	to := fs.String("to", "", "end of the range, exclusive (default now)")
+	heal := fs.Bool("heal", false, "apply the provider's state to the findings")
+	timeout := fs.Duration("timeout", 30*time.Minute, "time allowed for the whole operation")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rangeTo, err := parseTimeFlag(*to, time.Now())
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	rangeFrom, err := parseTimeFlag(*from, rangeTo.Add(-24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	if !rangeFrom.Before(rangeTo) {
+		return errors.New("-from must be before -to")
+	}
+
+	paymentProvider, err := newPaymentProvider()
+	if err != nil {
+		return fmt.Errorf("cannot load payment provider: %w", err)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("failed to open postgres db: %w", err)
+	}
+	defer db.Close()
+
+	models := data.NewModels(db)
+
+	// Events queued by healing are relayed by the running service.
+	s := &service{
+		logger:          logger,
+		models:          &models,
+		paymentProvider: paymentProvider,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	_, err = s.reconcile(ctx, rangeFrom, rangeTo, *heal)
+	return err
+}
+
+func replayWebhooksCommand(logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("replay-webhooks", flag.ContinueOnError)
+	eventID := fs.String("event", "", "provider ID of a single event to replay")
+	failed := fs.Bool("failed", false, "replay the events whose processing failed")
+	eventType := fs.String("type", "", "replay the events of this type (requires -from and -to)")
+	from := fs.String("from", "", "start of the window, as 2006-01-02 or RFC 3339")
+	to := fs.String("to", "", "end of the window, exclusive")
+	limit := fs.Int("limit", defaultReplayLimit, "maximum number of events to replay")
+	dryRun := fs.Bool("dry-run", false, "report what replaying would do without publishing")
+	timeout := fs.Duration("timeout", 10*time.Minute, "time allowed for the whole operation")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := data.WebhookEventFilter{
+		StripeEventID: *eventID,
+		EventType:     *eventType,
+		FailedOnly:    *failed,
+		Limit:         *limit,
+	}
+
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   **time.Time
+	}{
+		{"from", *from, &filter.From},
+		{"to", *to, &filter.To},
+	} {
+		if f.value == "" {
+			continue
+		}
+		t, err := parseTimeFlag(f.value, time.Time{})
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %w", f.name, err)
+		}
+		*f.dst = &t
+	}
+
+	if filter.StripeEventID != "" {
+		filter.Limit = 1
+	} else {
+		v := validator.New()
+		if validateWebhookReplay(v, filter); !v.Valid() {
+			return errors.New(validationDetails(v.Errors))
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("failed to open postgres db: %w", err)
+	}
+	defer db.Close()
+
+	models := data.NewModels(db)
+
+	// Replayed events are relayed by the running service.
+	s := &service{
+		logger: logger,
+		models: &models,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	replays, err := s.replayWebhookEvents(ctx, filter, *dryRun)
+	for _, r := range replays {
+		attrs := []any{"stripe_event_id", r.StripeEventID, "type", r.EventType, "processed", r.Processed, "replayed", r.Replayed}
+		if r.ErrorMessage != nil {
+			attrs = append(attrs, "error_message", *r.ErrorMessage)
+		}
+		if *dryRun {
+			attrs = append(attrs, "handled", *r.Handled, "events", r.Events)
+			if r.HandlerError != nil {
+				attrs = append(attrs, "handler_error", *r.HandlerError)
+			}
+		}
+		logger.Info("webhook event", attrs...)
+	}
+
+	if err == nil && len(replays) == 0 && filter.StripeEventID != "" {
+		return fmt.Errorf("event %s not found", filter.StripeEventID)
+	}
+
+	return err
+}
+
+// parseTimeFlag parses a date or RFC 3339 timestamp, returning fallback for
+// an empty value.
+func parseTimeFlag(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
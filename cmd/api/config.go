@@ -1,15 +1,54 @@
 package main
 
 import (
+	"time"
+
 	_ "github.com/lib/pq"
 )
 
 type serviceConfig struct {
 	servicePort int
 	gRPCPort    int
+	metricsPort int
+
+	// idempotencyKeyTTL is how long a stored Idempotency-Key response is
+	// replayed before the key can be used again.
+	idempotencyKeyTTL time.Duration
+
+	// authorizationWarnAfter and authorizationCancelAfter are measured from
+	// when a manually captured payment was authorized. Zero disables
+	// automatic cancellation.
+	authorizationWarnAfter   time.Duration
+	authorizationCancelAfter time.Duration
+
+	// cardExpiryNoticeDays are the days before a saved card expires at which
+	// its owner is notified, e.g. 30 and 7.
+	cardExpiryNoticeDays []int
+
+	// disputeDeadlineNotice is how long before a dispute's evidence is due
+	// a reminder is published.
+	disputeDeadlineNotice time.Duration
+
+	// reconciliationHour is the UTC hour of the daily reconciliation, -1 to
+	// disable it. Each run covers objects created in the lookback.
+	reconciliationHour     int
+	reconciliationLookback time.Duration
+	reconciliationAutoHeal bool
+
+	// Webhook events still unprocessed after webhookStuckAfter are queued
+	// again, waiting webhookSweepBackoff doubled for each sweep so far,
+	// and marked failed after webhookSweepMaxAttempts sweeps.
+	webhookSweepInterval    time.Duration
+	webhookStuckAfter       time.Duration
+	webhookSweepBackoff     time.Duration
+	webhookSweepMaxAttempts int
+
+	// outboxRetention is how long sent outbox messages are kept.
+	outboxRetention time.Duration
 
 	jwtConfig         *jwtConfig
 	rateLimiterConfig *rateLimiterConfig
+	shutdown          *shutdownConfig
 }
 
 type rateLimiterConfig struct {
@@ -18,6 +57,37 @@ type rateLimiterConfig struct {
 	burst   int
 }
 
+// shutdownConfig bounds the phases of a graceful shutdown. drainDelay is how
+// long readiness fails before the servers stop accepting requests, so load
+// balancers stop routing to us first.
+type shutdownConfig struct {
+	drainDelay        time.Duration
+	httpTimeout       time.Duration
+	grpcTimeout       time.Duration
+	workersTimeout    time.Duration
+	outboxTimeout     time.Duration
+	backgroundTimeout time.Duration
+	amqpTimeout       time.Duration
+	databaseTimeout   time.Duration
+}
+
+func newShutdownConfig() *shutdownConfig {
+	seconds := func(key string, fallback int) time.Duration {
+		return time.Duration(getOptionalIntEnv(key, fallback)) * time.Second
+	}
+
+	return &shutdownConfig{
+		drainDelay:        seconds("SHUTDOWN_DRAIN_SECONDS", 5),
+		httpTimeout:       seconds("SHUTDOWN_HTTP_TIMEOUT_SECONDS", 10),
+		grpcTimeout:       seconds("SHUTDOWN_GRPC_TIMEOUT_SECONDS", 10),
+		workersTimeout:    seconds("SHUTDOWN_WORKERS_TIMEOUT_SECONDS", 35),
+		outboxTimeout:     seconds("SHUTDOWN_OUTBOX_TIMEOUT_SECONDS", 35),
+		backgroundTimeout: seconds("SHUTDOWN_BACKGROUND_TIMEOUT_SECONDS", 15),
+		amqpTimeout:       seconds("SHUTDOWN_AMQP_TIMEOUT_SECONDS", 5),
+		databaseTimeout:   seconds("SHUTDOWN_DATABASE_TIMEOUT_SECONDS", 5),
+	}
+}
+
 func newJWTConfig() (*jwtConfig, error) {
 	secret, err := getRequiredStringEnv("JWT_SECRET")
 	if err != nil {
@@ -40,7 +110,28 @@ func newRateLimiterConfig() *rateLimiterConfig {
 func newServiceConfig() (*serviceConfig, error) {
 
 	servicePort := getOptionalIntEnv("SERVICE_PORT", 8080)
-	grpcPort := getOptionalIntEnv("SERVICE_GRPC_PORT", 8080)
+	grpcPort := getOptionalIntEnv("SERVICE_GRPC_PORT", 50001)
+	metricsPort := getOptionalIntEnv("METRICS_PORT", 9090)
+
+	idempotencyKeyTTL := time.Duration(getOptionalIntEnv("IDEMPOTENCY_KEY_TTL_HOURS", 24)) * time.Hour
+
+	authorizationWarnAfter := time.Duration(getOptionalIntEnv("AUTHORIZATION_WARN_AFTER_HOURS", 144)) * time.Hour
+	authorizationCancelAfter := time.Duration(getOptionalIntEnv("AUTHORIZATION_CANCEL_AFTER_HOURS", 0)) * time.Hour
+
+	cardExpiryNoticeDays := getOptionalIntListEnv("CARD_EXPIRY_NOTICE_DAYS", []int{30, 7})
+
+	disputeDeadlineNotice := time.Duration(getOptionalIntEnv("DISPUTE_DEADLINE_NOTICE_HOURS", 72)) * time.Hour
+
+	reconciliationHour := getOptionalIntEnv("RECONCILIATION_HOUR", 3)
+	reconciliationLookback := time.Duration(getOptionalIntEnv("RECONCILIATION_LOOKBACK_HOURS", 48)) * time.Hour
+	reconciliationAutoHeal := getOptionalBoolEnv("RECONCILIATION_AUTO_HEAL", false)
+
+	webhookSweepInterval := time.Duration(getOptionalIntEnv("WEBHOOK_SWEEP_INTERVAL_SECONDS", 60)) * time.Second
+	webhookStuckAfter := time.Duration(getOptionalIntEnv("WEBHOOK_STUCK_AFTER_MINUTES", 15)) * time.Minute
+	webhookSweepBackoff := time.Duration(getOptionalIntEnv("WEBHOOK_SWEEP_BACKOFF_MINUTES", 1)) * time.Minute
+	webhookSweepMaxAttempts := getOptionalIntEnv("WEBHOOK_SWEEP_MAX_ATTEMPTS", 10)
+
+	outboxRetention := time.Duration(getOptionalIntEnv("OUTBOX_RETENTION_HOURS", 168)) * time.Hour
 
 	rateLimiterConfig := newRateLimiterConfig()
 
@@ -50,10 +141,25 @@ func newServiceConfig() (*serviceConfig, error) {
 	}
 
 	serviceConfig := &serviceConfig{
-		servicePort:       servicePort,
-		gRPCPort:          grpcPort,
-		rateLimiterConfig: rateLimiterConfig,
-		jwtConfig:         jwtConfig,
+		servicePort:              servicePort,
+		gRPCPort:                 grpcPort,
+		metricsPort:              metricsPort,
+		idempotencyKeyTTL:        idempotencyKeyTTL,
+		authorizationWarnAfter:   authorizationWarnAfter,
+		authorizationCancelAfter: authorizationCancelAfter,
+		cardExpiryNoticeDays:     cardExpiryNoticeDays,
+		disputeDeadlineNotice:    disputeDeadlineNotice,
+		reconciliationHour:       reconciliationHour,
+		reconciliationLookback:   reconciliationLookback,
+		reconciliationAutoHeal:   reconciliationAutoHeal,
+		webhookSweepInterval:     webhookSweepInterval,
+		webhookStuckAfter:        webhookStuckAfter,
+		webhookSweepBackoff:      webhookSweepBackoff,
+		webhookSweepMaxAttempts:  webhookSweepMaxAttempts,
+		outboxRetention:          outboxRetention,
+		rateLimiterConfig:        rateLimiterConfig,
+		shutdown:                 newShutdownConfig(),
+		jwtConfig:                jwtConfig,
 	}
 
 	return serviceConfig, nil
@@ -0,0 +1,37 @@
+package main
+
+import "context"
+
+type contextKey string
+
+const userIDContextKey = contextKey("userID")
+
+// contextSetUserID returns a copy of ctx carrying the authenticated user's ID.
+func contextSetUserID(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+// contextGetUserID returns the user ID set by the gRPC authentication
+// interceptor. It is only called where authentication has run, so a missing
+// value is a bug.
+func contextGetUserID(ctx context.Context) int64 {
+	userID, ok := ctx.Value(userIDContextKey).(int64)
+	if !ok {
+		panic("missing user ID value in context")
+	}
+
+	return userID
+}
+
+const requestIDContextKey = contextKey("requestID")
+
+// contextSetRequestID returns a copy of ctx carrying the request ID.
+func contextSetRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// contextRequestID returns the request ID carried by ctx, if any.
+func contextRequestID(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDContextKey).(string)
+	return requestID, ok
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+// Each user has at most one provider customer. It is created explicitly
+// through the API or lazily on the user's first payment, and kept in sync
+// with changes made at the provider through customer webhooks.
+
+type customerInput struct {
+	Email       *string           `json:"email"`
+	Name        *string           `json:"name"`
+	Phone       *string           `json:"phone"`
+	Description *string           `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+func (s *service) showCustomerHandler(c *gin.Context) {
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), c.GetInt64("userID"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"customer": customer})
+}
+
+func (s *service) createCustomerHandler(c *gin.Context) {
+	var input customerInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	v := validator.New()
+	if validateCustomerInput(v, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	customer, err := s.createCustomer(c.Request.Context(), c.GetInt64("userID"), &input, providerIdempotencyKey(c))
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateCustomer) {
+			s.customerExistsResponse(c)
+			return
+		}
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"customer": customer})
+}
+
+func (s *service) updateCustomerHandler(c *gin.Context) {
+	var input customerInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	v := validator.New()
+	if validateCustomerInput(v, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	userID := c.GetInt64("userID")
+
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), userID)
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	updated, err := s.paymentProvider.UpdateCustomer(c.Request.Context(), customer.StripeCustomerID, input.params(userID, providerIdempotencyKey(c)))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	customer = customerFromProvider(updated)
+	customer.UserID = &userID
+	if err := s.models.Customer.Upsert(c.Request.Context(), customer); err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"customer": customer})
+}
+
+func (s *service) deleteCustomerHandler(c *gin.Context) {
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), c.GetInt64("userID"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	// A customer already deleted at the provider is still removed here.
+	err = s.paymentProvider.DeleteCustomer(c.Request.Context(), customer.StripeCustomerID)
+	if err != nil && !errors.Is(err, provider.ErrNotFound) {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	err = s.models.Customer.Delete(c.Request.Context(), customer.StripeCustomerID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	s.logger.InfoContext(c.Request.Context(), "customer deleted", "customer_id", customer.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "customer successfully deleted"})
+}
+
+// customerForUser returns the user's customer, creating one at the provider
+// when the user has none yet.
+func (s *service) customerForUser(ctx context.Context, userID int64) (*data.Customer, error) {
+	customer, err := s.models.Customer.GetForUser(ctx, userID)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return customer, err
+	}
+
+	customer, err = s.createCustomer(ctx, userID, &customerInput{}, "")
+	if errors.Is(err, data.ErrDuplicateCustomer) {
+		// A concurrent request created it first.
+		return s.models.Customer.GetForUser(ctx, userID)
+	}
+
+	return customer, err
+}
+
+// createCustomer creates a customer for userID at the provider and stores it.
+// ErrDuplicateCustomer is returned when the user already has one; the
+// customer just created at the provider is deleted again in that case.
+func (s *service) createCustomer(ctx context.Context, userID int64, input *customerInput, idempotencyKey string) (*data.Customer, error) {
+	if _, err := s.models.Customer.GetForUser(ctx, userID); !errors.Is(err, data.ErrRecordNotFound) {
+		if err == nil {
+			return nil, data.ErrDuplicateCustomer
+		}
+		return nil, err
+	}
+
+	created, err := s.paymentProvider.CreateCustomer(ctx, input.params(userID, idempotencyKey))
+	if err != nil {
+		return nil, err
+	}
+
+	customer := customerFromProvider(created)
+	customer.UserID = &userID
+
+	err = s.models.Customer.Insert(ctx, customer)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateCustomer) {
+			if err := s.paymentProvider.DeleteCustomer(ctx, created.ID); err != nil {
+				s.logger.ErrorContext(ctx, "failed to delete duplicate customer", "provider_customer_id", created.ID, "err", err)
+			}
+		}
+		return nil, err
+	}
+
+	s.logger.InfoContext(ctx, "customer created", "customer_id", customer.ID, "provider_customer_id", created.ID)
+
+	return customer, nil
+}
+
+// params maps the input onto provider params. user_id is always set in the
+// metadata so customers can be traced back to users at the provider.
+func (input *customerInput) params(userID int64, idempotencyKey string) *provider.CustomerParams {
+	metadata := make(map[string]string, len(input.Metadata)+1)
+	for key, value := range input.Metadata {
+		metadata[key] = value
+	}
+	metadata["user_id"] = strconv.FormatInt(userID, 10)
+
+	return &provider.CustomerParams{
+		Email:          input.Email,
+		Name:           input.Name,
+		Phone:          input.Phone,
+		Description:    input.Description,
+		Metadata:       metadata,
+		IdempotencyKey: idempotencyKey,
+	}
+}
+
+func validateCustomerInput(v *validator.Validator, input *customerInput) {
+	if input.Email != nil {
+		v.Check(validator.Matches(*input.Email, validator.EmailRX), "email", "must be a valid email address")
+	}
+
+	if input.Name != nil {
+		v.Check(utf8.RuneCountInString(*input.Name) <= 255, "name", "must not be more than 255 characters")
+	}
+
+	if input.Phone != nil {
+		v.Check(utf8.RuneCountInString(*input.Phone) <= 50, "phone", "must not be more than 50 characters")
+	}
+
+	if input.Description != nil {
+		v.Check(utf8.RuneCountInString(*input.Description) <= 1000, "description", "must not be more than 1000 characters")
+	}
+
+	validateMetadata(v, input.Metadata)
+}
+
+func customerFromProvider(customer *provider.Customer) *data.Customer {
+	c := &data.Customer{
+		StripeCustomerID: customer.ID,
+		Metadata:         customer.Metadata,
+	}
+
+	if customer.Email != "" {
+		c.Email = &customer.Email
+	}
+	if customer.Name != "" {
+		c.Name = &customer.Name
+	}
+	if customer.Phone != "" {
+		c.Phone = &customer.Phone
+	}
+	if customer.Description != "" {
+		c.Description = &customer.Description
+	}
+	if customer.DefaultSource != "" {
+		c.DefaultSource = &customer.DefaultSource
+	}
+
+	return c
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
 )
 
 func openDB() (*sql.DB, error) {
@@ -20,7 +22,7 @@ func openDB() (*sql.DB, error) {
 		return nil, err
 	}
 
-	db, err := sql.Open("postgres", *dsn)
+	db, err := otelsql.Open("postgres", *dsn, otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -47,29 +49,36 @@ func openDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func runMigrations(db *sql.DB) error {
+// runMigrations applies the pending migrations and returns the resulting
+// schema version.
+func runMigrations(logger *slog.Logger, db *sql.DB) (uint, error) {
 
 	driver, err := postgres.WithInstance(db, &postgres.Config{})
 	if err != nil {
-		return fmt.Errorf("could not create database driver: %w", err)
+		return 0, fmt.Errorf("could not create database driver: %w", err)
 	}
 
 	// Create file source instance
 	source, err := (&file.File{}).Open("./migrations")
 	if err != nil {
-		return fmt.Errorf("could not open migrations directory: %w", err)
+		return 0, fmt.Errorf("could not open migrations directory: %w", err)
 	}
 
 	// Create migrate instance
 	m, err := migrate.NewWithInstance("file", source, "postgres", driver)
 	if err != nil {
-		return fmt.Errorf("could not create migrate instance: %w", err)
+		return 0, fmt.Errorf("could not create migrate instance: %w", err)
 	}
 
 	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("could not run migrations: %w", err)
+		return 0, fmt.Errorf("could not run migrations: %w", err)
 	}
 
-	log.Println("Migrations completed successfully")
-	return nil
+	version, _, err := m.Version()
+	if err != nil {
+		return 0, fmt.Errorf("could not read schema version: %w", err)
+	}
+
+	logger.Info("migrations completed", "version", version)
+	return version, nil
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Disputes are opened by cardholders at the provider and kept in sync from
+// charge.dispute webhooks. The endpoints below are for the operators who
+// answer them, so they require the disputes permissions rather than
+// ownership of the payment.
+
+// disputeEvidenceTextFields and disputeEvidenceFileFields are the evidence
+// fields accepted by the provider. File fields take the ID of a file
+// uploaded with the dispute_evidence purpose.
+var (
+	disputeEvidenceTextFields = []string{
+		"access_activity_log", "billing_address", "cancellation_policy_disclosure", "cancellation_rebuttal",
+		"customer_email_address", "customer_name", "customer_purchase_ip", "duplicate_charge_explanation",
+		"duplicate_charge_id", "product_description", "refund_policy_disclosure", "refund_refusal_explanation",
+		"service_date", "shipping_address", "shipping_carrier", "shipping_date", "shipping_tracking_number",
+		"uncategorized_text",
+	}
+	disputeEvidenceFileFields = []string{
+		"cancellation_policy", "customer_communication", "customer_signature", "duplicate_charge_documentation",
+		"receipt", "refund_policy", "service_documentation", "shipping_documentation", "uncategorized_file",
+	}
+)
+
+// fileIDRX matches provider file IDs.
+var fileIDRX = regexp.MustCompile(`^file_[A-Za-z0-9_]+$`)
+
+// maxDisputeEvidenceFileSize is the provider's limit for dispute evidence.
+const maxDisputeEvidenceFileSize = 5 << 20
+
+// disputeBatchSize bounds the disputes reminded about per check.
+const disputeBatchSize = 100
+
+func (s *service) listDisputesHandler(c *gin.Context) {
+	v := validator.New()
+
+	status := s.readString(c, "status", "open")
+
+	filters := data.Filters{
+		Page:         s.readInt(c, "page", 1, v),
+		PageSize:     s.readInt(c, "page_size", 20, v),
+		Sort:         s.readString(c, "sort", "evidence_due_by"),
+		SortSafelist: []string{"evidence_due_by", "created_at", "amount", "-evidence_due_by", "-created_at", "-amount"},
+	}
+
+	permittedStatuses := append([]string{"open", "all", "won", "lost", "warning_closed"}, data.OpenDisputeStatuses...)
+	v.Check(validator.PermittedValue(status, permittedStatuses...), "status", "invalid status value")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	var statuses []string
+	switch status {
+	case "open":
+		statuses = data.OpenDisputeStatuses
+	case "all":
+	default:
+		statuses = []string{status}
+	}
+
+	disputes, metadata, err := s.models.Dispute.GetAll(c.Request.Context(), statuses, filters)
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"disputes": disputes, "metadata": metadata})
+}
+
+func (s *service) showDisputeHandler(c *gin.Context) {
+	dispute, err := s.models.Dispute.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dispute": dispute})
+}
+
+type submitDisputeEvidenceInput struct {
+	Evidence map[string]string `json:"evidence"`
+	// Submit sends the staged evidence to the card network. It cannot be
+	// changed afterwards.
+	Submit bool `json:"submit"`
+}
+
+// submitDisputeEvidenceHandler stages evidence on a dispute and optionally
+// submits it.
+func (s *service) submitDisputeEvidenceHandler(c *gin.Context) {
+	var input submitDisputeEvidenceInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	dispute, err := s.models.Dispute.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	v := validator.New()
+	if validateDisputeEvidence(v, dispute, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	dispute, err = s.updateDispute(c.Request.Context(), dispute, &provider.UpdateDisputeParams{
+		Evidence:       input.Evidence,
+		Submit:         input.Submit,
+		IdempotencyKey: providerIdempotencyKey(c),
+	})
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	s.logger.InfoContext(c.Request.Context(), "dispute evidence updated", "dispute_id", dispute.ID, "fields", len(input.Evidence), "submitted", input.Submit)
+
+	c.JSON(http.StatusOK, gin.H{"dispute": dispute})
+}
+
+// uploadDisputeEvidenceFileHandler uploads a multipart "file" to the
+// provider and stages it on the dispute as the evidence field named by
+// "evidence_type", e.g. receipt. The evidence still has to be submitted.
+func (s *service) uploadDisputeEvidenceFileHandler(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		s.badRequestResponse(c, "body must be a multipart form with a file field")
+		return
+	}
+
+	evidenceType := c.PostForm("evidence_type")
+
+	dispute, err := s.models.Dispute.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(disputeAwaitingEvidence(dispute), "dispute", "is not awaiting evidence")
+	v.Check(slices.Contains(disputeEvidenceFileFields, evidenceType), "evidence_type", "must be a file evidence field")
+	v.Check(header.Size <= maxDisputeEvidenceFileSize, "file", "must not be larger than 5MB")
+
+	file, err := header.Open()
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+	defer file.Close()
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+	contentType := http.DetectContentType(sniff[:n])
+	v.Check(validator.PermittedValue(contentType, "application/pdf", "image/jpeg", "image/png"), "file", "must be a PDF, JPEG or PNG file")
+
+	if !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	idempotencyKey := providerIdempotencyKey(c)
+
+	uploaded, err := s.paymentProvider.UploadFile(c.Request.Context(), &provider.UploadFileParams{
+		Purpose:        "dispute_evidence",
+		Filename:       header.Filename,
+		Content:        file,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	// The upload and the update are separate provider requests, so they need
+	// separate keys.
+	if idempotencyKey != "" {
+		idempotencyKey += ":evidence"
+	}
+
+	dispute, err = s.updateDispute(c.Request.Context(), dispute, &provider.UpdateDisputeParams{
+		Evidence:       map[string]string{evidenceType: uploaded.ID},
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	s.logger.InfoContext(c.Request.Context(), "dispute evidence file uploaded", "dispute_id", dispute.ID, "provider_file_id", uploaded.ID, "evidence_type", evidenceType)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file": gin.H{
+			"id":       uploaded.ID,
+			"filename": uploaded.Filename,
+			"size":     uploaded.Size,
+			"type":     uploaded.Type,
+		},
+		"dispute": dispute,
+	})
+}
+
+// updateDispute updates the dispute at the provider and stores the result.
+func (s *service) updateDispute(ctx context.Context, dispute *data.Dispute, params *provider.UpdateDisputeParams) (*data.Dispute, error) {
+	updated, err := s.paymentProvider.UpdateDispute(ctx, dispute.StripeDisputeID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := disputeFromProvider(updated)
+
+	err = s.models.Transact(ctx, func(tx data.Models) error {
+		return applyDispute(ctx, tx, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.outboxRelay.notify()
+
+	return stored, nil
+}
+
+func validateDisputeEvidence(v *validator.Validator, dispute *data.Dispute, input *submitDisputeEvidenceInput) {
+	v.Check(disputeAwaitingEvidence(dispute), "dispute", "is not awaiting evidence")
+	v.Check(len(input.Evidence) > 0 || input.Submit, "evidence", "must be provided")
+
+	for field, value := range input.Evidence {
+		key := "evidence." + field
+
+		switch {
+		case slices.Contains(disputeEvidenceTextFields, field):
+			v.Check(utf8.RuneCountInString(value) <= 20000, key, "must not be more than 20000 characters")
+		case slices.Contains(disputeEvidenceFileFields, field):
+			v.Check(validator.Matches(value, fileIDRX), key, "must be the ID of an uploaded file")
+		default:
+			v.AddError(key, "is not a known evidence field")
+		}
+	}
+}
+
+// disputeAwaitingEvidence reports whether evidence can still be added to the
+// dispute.
+func disputeAwaitingEvidence(dispute *data.Dispute) bool {
+	return dispute.Status == "needs_response" || dispute.Status == "warning_needs_response"
+}
+
+func handleDisputeEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var stripeDispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &stripeDispute); err != nil {
+		return permanentError{fmt.Errorf("failed to decode dispute: %w", err)}
+	}
+
+	if stripeDispute.Charge == nil {
+		return permanentError{errors.New("dispute has no charge")}
+	}
+
+	providerDispute := provider.DisputeFromStripe(&stripeDispute)
+	dispute := disputeFromProvider(providerDispute)
+
+	if err := applyDispute(ctx, tx, dispute); err != nil {
+		return err
+	}
+
+	if err := postDisputeFees(ctx, tx, providerDispute); err != nil {
+		return err
+	}
+
+	var withdrawn bool
+	switch event.Type {
+	case stripe.EventTypeChargeDisputeFundsWithdrawn:
+		withdrawn = true
+	case stripe.EventTypeChargeDisputeFundsReinstated:
+		withdrawn = false
+	default:
+		return nil
+	}
+
+	if err := tx.Dispute.RecordFundsMovement(ctx, dispute.StripeDisputeID, withdrawn); err != nil {
+		return err
+	}
+
+	if err := postDisputeFunds(ctx, tx, dispute, withdrawn); err != nil {
+		return err
+	}
+
+	eventType := "dispute.funds_reinstated"
+	if withdrawn {
+		eventType = "dispute.funds_withdrawn"
+	}
+
+	return enqueueServiceEvent(ctx, tx, eventType, dispute)
+}
+
+// applyDispute stores the dispute, flags its charge and publishes a
+// dispute.<status> event when the dispute is new or changed status.
+func applyDispute(ctx context.Context, tx data.Models, dispute *data.Dispute) error {
+	statusChanged, err := tx.Dispute.Upsert(ctx, dispute)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Charge.SetDisputed(ctx, dispute.StripeChargeID, true)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+
+	if !statusChanged {
+		return nil
+	}
+
+	return enqueueServiceEvent(ctx, tx, "dispute."+dispute.Status, dispute)
+}
+
+// monitorDisputeDeadlines periodically publishes dispute.evidence_due_soon
+// events.
+func (s *service) monitorDisputeDeadlines() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.remindDisputeDeadlines(ctx, time.Now())
+		}
+	}
+}
+
+// remindDisputeDeadlines publishes one event per dispute whose evidence is
+// due within the configured notice and that still needs a response.
+func (s *service) remindDisputeDeadlines(ctx context.Context, now time.Time) {
+	disputes, err := s.models.Dispute.GetDueForReminder(ctx, now.Add(s.config.disputeDeadlineNotice), disputeBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list disputes due for a reminder", "err", err)
+		return
+	}
+
+	reminded := 0
+
+	for _, dispute := range disputes {
+		err := s.models.Transact(ctx, func(tx data.Models) error {
+			if err := tx.Dispute.MarkDeadlineReminded(ctx, dispute.ID); err != nil {
+				return err
+			}
+
+			return enqueueServiceEvent(ctx, tx, "dispute.evidence_due_soon", dispute)
+		})
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Reminded by a concurrent check.
+		case err != nil:
+			s.logger.Error("failed to queue dispute deadline reminder", "dispute_id", dispute.ID, "err", err)
+		default:
+			reminded++
+		}
+	}
+
+	if reminded > 0 {
+		s.outboxRelay.notify()
+		s.logger.Info("dispute deadline reminders queued", "count", reminded)
+	}
+}
+
+func disputeFromProvider(dispute *provider.Dispute) *data.Dispute {
+	return &data.Dispute{
+		StripeDisputeID:       dispute.ID,
+		StripeChargeID:        dispute.ChargeID,
+		StripePaymentIntentID: dispute.PaymentIntentID,
+		Amount:                dispute.Amount,
+		Currency:              dispute.Currency,
+		Reason:                dispute.Reason,
+		Status:                dispute.Status,
+		EvidenceDueBy:         dispute.EvidenceDueBy,
+		HasEvidence:           dispute.HasEvidence,
+		PastDue:               dispute.PastDue,
+		SubmissionCount:       dispute.SubmissionCount,
+		IsChargeRefundable:    dispute.IsChargeRefundable,
+		Metadata:              dispute.Metadata,
+	}
+}
@@ -1,23 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
 )
 
 type ErrorMessage struct {
-	reason  string
-	message string
-	details *string
+	Reason  string  `json:"reason"`
+	Message string  `json:"message"`
+	Details *string `json:"details,omitempty"`
 }
 
 func newErrorMessage(reason string, message string, details string) *ErrorMessage {
 	return &ErrorMessage{
-		reason:  reason,
-		message: message,
-		details: &details,
+		Reason:  reason,
+		Message: message,
+		Details: &details,
 	}
 }
 
@@ -51,14 +55,26 @@ func (s *service) badRequestResponse(c *gin.Context, errMsg string) {
 }
 
 // failedValidationResponse sends a 422 Unprocessable Entity response for validation failures.
-// func FailedValidationResponse(c *gin.Context, validationErrors map[string]string) {
-// 	var details string
-// 	for key, value := range validationErrors {
-// 		details += fmt.Sprintf("%s: %s; ", key, value)
-// 	}
-// 	err := newErrorMessage("VALIDATION_FAILED", "invalid data submitted", details)
-// 	c.JSON(http.StatusUnprocessableEntity, err)
-// }
+func (s *service) failedValidationResponse(c *gin.Context, validationErrors map[string]string) {
+	err := newErrorMessage("VALIDATION_FAILED", "invalid data submitted", validationDetails(validationErrors))
+	c.JSON(http.StatusUnprocessableEntity, err)
+}
+
+// validationDetails flattens validator errors into one message, sorted by
+// field.
+func validationDetails(validationErrors map[string]string) string {
+	keys := make([]string, 0, len(validationErrors))
+	for key := range validationErrors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var details string
+	for _, key := range keys {
+		details += fmt.Sprintf("%s: %s; ", key, validationErrors[key])
+	}
+	return details
+}
 
 // editConflictResponse sends a 409 Conflict response.
 func (s *service) editConflictResponse(c *gin.Context) {
@@ -66,6 +82,18 @@ func (s *service) editConflictResponse(c *gin.Context) {
 	c.JSON(http.StatusConflict, err)
 }
 
+// idempotentRequestInProgressResponse sends a 409 Conflict response when a request with the same Idempotency-Key is still being processed.
+func (s *service) idempotentRequestInProgressResponse(c *gin.Context) {
+	err := newErrorMessage("IDEMPOTENT_REQUEST_IN_PROGRESS", "request in progress", "a request with this Idempotency-Key is still being processed, please retry later")
+	c.JSON(http.StatusConflict, err)
+}
+
+// customerExistsResponse sends a 409 Conflict response when the user already has a customer.
+func (s *service) customerExistsResponse(c *gin.Context) {
+	err := newErrorMessage("CUSTOMER_EXISTS", "customer already exists", "a customer already exists for this user, update it instead")
+	c.JSON(http.StatusConflict, err)
+}
+
 // rateLimitExceededResponse sends a 429 Too Many Requests response.
 func (s *service) rateLimitExceededResponse(c *gin.Context) {
 	err := newErrorMessage("RATE_LIMIT_EXCEEDED", "rate limit exceeded", "you have exceeded the allowed number of requests")
@@ -103,6 +131,65 @@ func (s *service) notPermittedResponse(c *gin.Context) {
 	c.JSON(http.StatusForbidden, err)
 }
 
+// invalidWebhookSignatureResponse sends a 400 Bad Request response for webhooks that fail signature verification.
+func (s *service) invalidWebhookSignatureResponse(c *gin.Context) {
+	err := newErrorMessage("INVALID_SIGNATURE", "invalid webhook signature", "the Stripe-Signature header could not be verified")
+	c.JSON(http.StatusBadRequest, err)
+}
+
+// providerErrorResponse maps a payment provider error onto a response: bad
+// input and declines are the client's to fix, anything else is reported as
+// a provider failure.
+func (s *service) providerErrorResponse(c *gin.Context, err error) {
+	var providerErr *provider.Error
+	if !errors.As(err, &providerErr) {
+		s.paymentProviderErrorResponse(c, err)
+		return
+	}
+
+	switch {
+	case errors.Is(err, provider.ErrCardDeclined):
+		s.cardDeclinedResponse(c, providerErr)
+	case errors.Is(err, provider.ErrInvalidRequest):
+		s.badRequestResponse(c, providerErr.Message)
+	case errors.Is(err, provider.ErrNotFound):
+		s.notFoundResponse(c)
+	default:
+		s.paymentProviderErrorResponse(c, err)
+	}
+}
+
+// paymentOperationErrorResponse maps the error of a payment operation, which
+// may come from the provider or the database, onto a response.
+func (s *service) paymentOperationErrorResponse(c *gin.Context, err error) {
+	var providerErr *provider.Error
+	switch {
+	case errors.As(err, &providerErr):
+		s.providerErrorResponse(c, err)
+	case errors.Is(err, data.ErrRecordNotFound):
+		s.notFoundResponse(c)
+	default:
+		s.InternalServerErrorResponse(c, err)
+	}
+}
+
+// cardDeclinedResponse sends a 402 Payment Required response when the provider declines a card.
+func (s *service) cardDeclinedResponse(c *gin.Context, err *provider.Error) {
+	reason := err.DeclineCode
+	if reason == "" {
+		reason = err.Code
+	}
+	response := newErrorMessage("CARD_DECLINED", err.Message, reason)
+	c.JSON(http.StatusPaymentRequired, response)
+}
+
+// paymentProviderErrorResponse sends a 502 Bad Gateway response when the payment provider fails.
+func (s *service) paymentProviderErrorResponse(c *gin.Context, err error) {
+	s.logger.ErrorContext(c.Request.Context(), "payment provider request failed", "err", err)
+	response := newErrorMessage("PAYMENT_PROVIDER_ERROR", "payment provider error", "the payment provider could not process the request, please try again")
+	c.JSON(http.StatusBadGateway, response)
+}
+
 func (s *service) serviceUnavailableResponse(c *gin.Context) {
 	errMsg := "the server is temporarily unable to handle the request"
 	response := newErrorMessage("SERVICE_UNAVAILABLE", "service unavailable", errMsg)
@@ -110,6 +197,7 @@ func (s *service) serviceUnavailableResponse(c *gin.Context) {
 }
 
 func (s *service) InternalServerErrorResponse(c *gin.Context, err error) {
+	s.logger.ErrorContext(c.Request.Context(), "internal server error", "method", c.Request.Method, "path", c.Request.URL.Path, "err", err)
 	errMsg := "the server encountered a problem and could not process your request"
 	response := newErrorMessage("INTERNAL_SERVER_ERROR", "internal server error", errMsg)
 	c.JSON(http.StatusInternalServerError, response)
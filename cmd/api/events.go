@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// eventHandler applies a single Stripe event. It runs inside the same
+// transaction that marks the webhook_events row as processed.
+type eventHandler func(ctx context.Context, tx data.Models, event *stripe.Event) error
+
+type eventDispatcher struct {
+	logger   *slog.Logger
+	models   *data.Models
+	handlers map[stripe.EventType]eventHandler
+}
+
+func newEventDispatcher(logger *slog.Logger, models *data.Models) *eventDispatcher {
+	d := &eventDispatcher{
+		logger:   logger,
+		models:   models,
+		handlers: make(map[stripe.EventType]eventHandler),
+	}
+
+	for _, eventType := range []stripe.EventType{
+		stripe.EventTypePaymentIntentCreated,
+		stripe.EventTypePaymentIntentProcessing,
+		stripe.EventTypePaymentIntentRequiresAction,
+		stripe.EventTypePaymentIntentAmountCapturableUpdated,
+		stripe.EventTypePaymentIntentSucceeded,
+		stripe.EventTypePaymentIntentPaymentFailed,
+		stripe.EventTypePaymentIntentCanceled,
+	} {
+		d.register(eventType, handlePaymentIntentEvent)
+	}
+
+	for _, eventType := range []stripe.EventType{
+		stripe.EventTypeChargePending,
+		stripe.EventTypeChargeSucceeded,
+		stripe.EventTypeChargeFailed,
+		stripe.EventTypeChargeCaptured,
+		stripe.EventTypeChargeUpdated,
+		stripe.EventTypeChargeRefunded,
+	} {
+		d.register(eventType, handleChargeEvent)
+	}
+
+	for _, eventType := range []stripe.EventType{
+		stripe.EventTypeChargeRefundUpdated,
+		stripe.EventTypeRefundCreated,
+		stripe.EventTypeRefundUpdated,
+		stripe.EventTypeRefundFailed,
+	} {
+		d.register(eventType, handleRefundEvent)
+	}
+
+	for _, eventType := range []stripe.EventType{
+		stripe.EventTypeChargeDisputeCreated,
+		stripe.EventTypeChargeDisputeUpdated,
+		stripe.EventTypeChargeDisputeClosed,
+		stripe.EventTypeChargeDisputeFundsWithdrawn,
+		stripe.EventTypeChargeDisputeFundsReinstated,
+	} {
+		d.register(eventType, handleDisputeEvent)
+	}
+
+	d.register(stripe.EventTypeCustomerCreated, handleCustomerEvent)
+	d.register(stripe.EventTypeCustomerUpdated, handleCustomerEvent)
+	d.register(stripe.EventTypeCustomerDeleted, handleCustomerDeleted)
+
+	for _, eventType := range []stripe.EventType{
+		stripe.EventTypePaymentMethodAttached,
+		stripe.EventTypePaymentMethodDetached,
+		stripe.EventTypePaymentMethodUpdated,
+		stripe.EventTypePaymentMethodAutomaticallyUpdated,
+	} {
+		d.register(eventType, handlePaymentMethodEvent)
+	}
+
+	return d
+}
+
+func (d *eventDispatcher) register(eventType stripe.EventType, handler eventHandler) {
+	d.handlers[eventType] = handler
+}
+
+// permanentError marks failures that cannot succeed on a later attempt,
+// such as an undecodable payload. They skip the retry queues.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func isPermanent(err error) bool {
+	var pErr permanentError
+	return errors.As(err, &pErr)
+}
+
+// shouldDeadLetter reports whether a failed delivery goes to the dead-letter
+// queue instead of the delay queue for its attempt.
+func shouldDeadLetter(err error, attempt int) bool {
+	return isPermanent(err) || attempt >= maxProcessingAttempts
+}
+
+// dispatch decodes a Stripe event and runs the handler registered for its
+// type. Events already marked as processed are skipped, so redeliveries are
+// harmless. A handler error is recorded on the webhook_events row, together
+// with the delivery attempt, and returned to the caller.
+func (d *eventDispatcher) dispatch(ctx context.Context, body []byte, attempt int) error {
+	var event stripe.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return permanentError{fmt.Errorf("failed to decode stripe event: %w", err)}
+	}
+
+	if event.ID == "" || event.Data == nil {
+		return permanentError{errors.New("stripe event is missing an id or data")}
+	}
+
+	handler, ok := d.handlers[event.Type]
+	applied := false
+
+	err := d.models.Transact(ctx, func(tx data.Models) error {
+		stored, err := tx.WebhookEvent.GetForUpdate(ctx, event.ID)
+		if err != nil {
+			return err
+		}
+
+		if stored.Processed {
+			d.logger.InfoContext(ctx, "event already processed, skipping", "stripe_event_id", event.ID, "event_type", event.Type)
+			return nil
+		}
+
+		if !ok {
+			d.logger.WarnContext(ctx, "no handler registered for event, acknowledging", "stripe_event_id", event.ID, "event_type", event.Type)
+			note := fmt.Sprintf("unhandled event type %s", event.Type)
+			return tx.WebhookEvent.MarkProcessed(ctx, event.ID, &note)
+		}
+
+		if err := handler(ctx, tx, &event); err != nil {
+			return err
+		}
+
+		applied = true
+		return tx.WebhookEvent.MarkProcessed(ctx, event.ID, nil)
+	})
+	if err != nil {
+		if markErr := d.models.WebhookEvent.MarkFailed(ctx, event.ID, err.Error(), attempt); markErr != nil {
+			d.logger.ErrorContext(ctx, "failed to record event error", "stripe_event_id", event.ID, "err", markErr)
+		}
+		return fmt.Errorf("event %s (%s) failed on attempt %d: %w", event.ID, event.Type, attempt, err)
+	}
+
+	if applied {
+		countPaymentOutcome(&event)
+	}
+
+	return nil
+}
+
+// countPaymentOutcome counts the payment intents that succeeded or failed,
+// once their event has been applied.
+func countPaymentOutcome(event *stripe.Event) {
+	currency, _ := event.Data.Object["currency"].(string)
+
+	switch event.Type {
+	case stripe.EventTypePaymentIntentSucceeded:
+		paymentIntentsSucceededTotal.WithLabelValues(currency).Inc()
+	case stripe.EventTypePaymentIntentPaymentFailed:
+		paymentIntentsFailedTotal.WithLabelValues(currency).Inc()
+	}
+}
+
+func handlePaymentIntentEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var intent stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+		return permanentError{fmt.Errorf("failed to decode payment intent: %w", err)}
+	}
+
+	return applyPaymentIntent(ctx, tx, paymentFromProvider(provider.PaymentIntentFromStripe(&intent)))
+}
+
+func handleChargeEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		return permanentError{fmt.Errorf("failed to decode charge: %w", err)}
+	}
+
+	if err := applyCharge(ctx, tx, chargeFromStripe(&charge)); err != nil {
+		return err
+	}
+
+	if charge.Refunds == nil {
+		return nil
+	}
+
+	for _, refund := range charge.Refunds.Data {
+		if err := applyRefund(ctx, tx, refundFromStripe(refund)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyCharge stores the charge and posts its money movements to the ledger.
+// Stale updates are ignored.
+func applyCharge(ctx context.Context, tx data.Models, charge *data.Charge) error {
+	updated, err := tx.Charge.Upsert(ctx, charge)
+	if err != nil || !updated {
+		return err
+	}
+
+	return postCharge(ctx, tx, charge)
+}
+
+func handleRefundEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var refund stripe.Refund
+	if err := json.Unmarshal(event.Data.Raw, &refund); err != nil {
+		return permanentError{fmt.Errorf("failed to decode refund: %w", err)}
+	}
+
+	return applyRefund(ctx, tx, refundFromStripe(&refund))
+}
+
+func handleCustomerEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var customer stripe.Customer
+	if err := json.Unmarshal(event.Data.Raw, &customer); err != nil {
+		return permanentError{fmt.Errorf("failed to decode customer: %w", err)}
+	}
+
+	return tx.Customer.Upsert(ctx, customerFromProvider(provider.CustomerFromStripe(&customer)))
+}
+
+func handleCustomerDeleted(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var customer stripe.Customer
+	if err := json.Unmarshal(event.Data.Raw, &customer); err != nil {
+		return permanentError{fmt.Errorf("failed to decode customer: %w", err)}
+	}
+
+	err := tx.Customer.Delete(ctx, customer.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+func handlePaymentMethodEvent(ctx context.Context, tx data.Models, event *stripe.Event) error {
+	var paymentMethod stripe.PaymentMethod
+	if err := json.Unmarshal(event.Data.Raw, &paymentMethod); err != nil {
+		return permanentError{fmt.Errorf("failed to decode payment method: %w", err)}
+	}
+
+	return tx.PaymentMethod.Upsert(ctx, paymentMethodFromProvider(provider.PaymentMethodFromStripe(&paymentMethod)))
+}
+
+func chargeFromStripe(charge *stripe.Charge) *data.Charge {
+	c := &data.Charge{
+		StripeChargeID: charge.ID,
+		Amount:         charge.Amount,
+		AmountCaptured: charge.AmountCaptured,
+		AmountRefunded: charge.AmountRefunded,
+		Currency:       string(charge.Currency),
+		Status:         string(charge.Status),
+		Paid:           charge.Paid,
+		Refunded:       charge.Refunded,
+		Captured:       charge.Captured,
+		Disputed:       charge.Disputed,
+		Metadata:       charge.Metadata,
+	}
+
+	if charge.PaymentIntent != nil {
+		c.StripePaymentIntentID = charge.PaymentIntent.ID
+	}
+	if charge.FailureCode != "" {
+		c.FailureCode = &charge.FailureCode
+	}
+	if charge.FailureMessage != "" {
+		c.FailureMessage = &charge.FailureMessage
+	}
+	if charge.ReceiptURL != "" {
+		c.ReceiptURL = &charge.ReceiptURL
+	}
+	if txn := charge.BalanceTransaction; txn != nil {
+		c.BalanceTransactionID = &txn.ID
+		// Only set when the balance transaction was expanded.
+		if txn.Currency != "" {
+			currency := string(txn.Currency)
+			c.Fee = &txn.Fee
+			c.FeeCurrency = &currency
+		}
+	}
+
+	c.Outcome = marshalOptional(charge.Outcome)
+	c.BillingDetails = marshalOptional(charge.BillingDetails)
+	c.PaymentMethodDetails = marshalOptional(charge.PaymentMethodDetails)
+
+	return c
+}
+
+func chargeFromProvider(charge *provider.Charge) *data.Charge {
+	c := &data.Charge{
+		StripeChargeID:        charge.ID,
+		StripePaymentIntentID: charge.PaymentIntentID,
+		Amount:                charge.Amount,
+		AmountCaptured:        charge.AmountCaptured,
+		AmountRefunded:        charge.AmountRefunded,
+		Currency:              charge.Currency,
+		Status:                charge.Status,
+		Paid:                  charge.Paid,
+		Refunded:              charge.Refunded,
+		Captured:              charge.Captured,
+		Disputed:              charge.Disputed,
+		Metadata:              charge.Metadata,
+	}
+
+	if charge.BalanceTransactionID != "" {
+		c.BalanceTransactionID = &charge.BalanceTransactionID
+	}
+
+	return c
+}
+
+func refundFromStripe(refund *stripe.Refund) *data.Refund {
+	r := &data.Refund{
+		StripeRefundID: refund.ID,
+		Amount:         refund.Amount,
+		Currency:       string(refund.Currency),
+		Status:         string(refund.Status),
+		Metadata:       refund.Metadata,
+	}
+
+	if refund.Charge != nil {
+		r.StripeChargeID = refund.Charge.ID
+	}
+	if refund.PaymentIntent != nil {
+		r.StripePaymentIntentID = refund.PaymentIntent.ID
+	}
+	// Reasons set by Stripe itself, such as expired_uncaptured_charge, are
+	// not allowed by chk_refunds_reason_valid.
+	switch reason := string(refund.Reason); reason {
+	case "duplicate", "fraudulent", "requested_by_customer":
+		r.Reason = &reason
+	}
+	if refund.FailureReason != "" {
+		failureReason := string(refund.FailureReason)
+		r.FailureReason = &failureReason
+	}
+	if refund.ReceiptNumber != "" {
+		r.ReceiptNumber = &refund.ReceiptNumber
+	}
+
+	return r
+}
+
+func paymentMethodFromProvider(paymentMethod *provider.PaymentMethod) *data.PaymentMethod {
+	pm := &data.PaymentMethod{
+		StripePaymentMethodID: paymentMethod.ID,
+		StripeCustomerID:      paymentMethod.CustomerID,
+		Type:                  paymentMethod.Type,
+		Metadata:              paymentMethod.Metadata,
+		BillingDetails:        paymentMethod.BillingDetails,
+	}
+
+	if card := paymentMethod.Card; card != nil {
+		pm.CardBrand = &card.Brand
+		pm.CardLast4 = &card.Last4
+		pm.CardExpMonth = &card.ExpMonth
+		pm.CardExpYear = &card.ExpYear
+		if card.Fingerprint != "" {
+			pm.CardFingerprint = &card.Fingerprint
+		}
+		if card.Country != "" {
+			pm.CardCountry = &card.Country
+		}
+	}
+
+	return pm
+}
+
+// marshalOptional encodes a nested Stripe object for a JSONB column, leaving
+// the column NULL when the object is absent.
+func marshalOptional[T any](v *T) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return raw
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestShouldDeadLetter(t *testing.T) {
+	transient := errors.New("connection reset")
+	permanent := permanentError{errors.New("failed to decode stripe event")}
+
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		want    bool
+	}{
+		{name: "transient first attempt", err: transient, attempt: 1, want: false},
+		{name: "transient before last attempt", err: transient, attempt: maxProcessingAttempts - 1, want: false},
+		{name: "transient last attempt", err: transient, attempt: maxProcessingAttempts, want: true},
+		{name: "transient past last attempt", err: transient, attempt: maxProcessingAttempts + 1, want: true},
+		{name: "permanent first attempt", err: permanent, attempt: 1, want: true},
+		{name: "wrapped permanent", err: fmt.Errorf("handle event: %w", permanent), attempt: 1, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldDeadLetter(tt.err, tt.attempt); got != tt.want {
+				t.Errorf("shouldDeadLetter(%v, %d) = %v, want %v", tt.err, tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
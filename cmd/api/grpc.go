@@ -1,33 +1,56 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
 	payments "github.com/pirasl/payment-service/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// PaymentServer implements the gRPC PaymentService on top of the same
+// service methods as the HTTP API.
 type PaymentServer struct {
 	payments.UnimplementedPaymentServiceServer
 
-	models data.Models
+	service *service
+	models  *data.Models
+}
+
+// newGRPCServer creates the gRPC server with the payment and health
+// services registered.
+func (s *service) newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(s.grpcServerOptions()...)
+
+	payments.RegisterPaymentServiceServer(server, &PaymentServer{service: s, models: s.models})
+	healthpb.RegisterHealthServer(server, s.grpcHealth)
+
+	return server
 }
 
 func (s *service) gRPCListen() {
 
-	gRPCPort := getOptionalStringEnv("SERVICE_GRPC_PORT", "50001")
-	appEnv := getOptionalStringEnv("APP_ENV", "developement")
+	appEnv := getOptionalStringEnv("APP_ENV", "development")
 
 	var listenAddr string
 
 	if appEnv == "production" {
-		listenAddr = fmt.Sprintf(":%s", gRPCPort)
+		listenAddr = fmt.Sprintf(":%d", s.config.gRPCPort)
 	} else {
 
-		listenAddr = fmt.Sprintf("localhost:%s", gRPCPort)
+		listenAddr = fmt.Sprintf("localhost:%d", s.config.gRPCPort)
 	}
 
 	lis, err := net.Listen("tcp", listenAddr)
@@ -36,14 +59,277 @@ func (s *service) gRPCListen() {
 		os.Exit(1)
 	}
 
-	grpc := grpc.NewServer()
+	s.logger.Info("gRPC server started", "port:", s.config.gRPCPort)
 
-	payments.RegisterPaymentServiceServer(grpc, &PaymentServer{models: *s.models})
-	s.logger.Info("gRPC server started", "port:", gRPCPort)
-
-	if err := grpc.Serve(lis); err != nil {
+	// Serve returns nil once the server is stopped by the shutdown.
+	if err := s.grpcServer.Serve(lis); err != nil {
 		s.logger.Error("failed to listen to gRPC", "err: ", err)
 		os.Exit(1)
 	}
 
 }
+
+func (ps *PaymentServer) CreatePaymentIntent(ctx context.Context, req *payments.CreatePaymentIntentRequest) (*payments.CreatePaymentIntentResponse, error) {
+	input := createPaymentIntentInput{
+		Amount:             req.GetAmount(),
+		Currency:           req.GetCurrency(),
+		CaptureMethod:      req.GetCaptureMethod(),
+		Description:        req.Description,
+		ReceiptEmail:       req.ReceiptEmail,
+		PaymentMethodTypes: req.GetPaymentMethodTypes(),
+		SetupFutureUsage:   req.SetupFutureUsage,
+		Metadata:           req.GetMetadata(),
+	}
+	input.setDefaults()
+
+	v := validator.New()
+	if validateCreatePaymentIntentInput(v, &input); !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	userID := contextGetUserID(ctx)
+
+	payment, clientSecret, err := ps.service.createPayment(ctx, userID, &input, scopedIdempotencyKey(userID, req.GetIdempotencyKey()))
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	return &payments.CreatePaymentIntentResponse{
+		Payment:      paymentToProto(payment),
+		ClientSecret: clientSecret,
+	}, nil
+}
+
+func (ps *PaymentServer) GetPayment(ctx context.Context, req *payments.GetPaymentRequest) (*payments.Payment, error) {
+	payment, err := ps.service.getUserPayment(ctx, contextGetUserID(ctx), req.GetId())
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	return paymentToProto(payment), nil
+}
+
+func (ps *PaymentServer) ListPayments(ctx context.Context, req *payments.ListPaymentsRequest) (*payments.ListPaymentsResponse, error) {
+	filters := data.Filters{
+		Page:         int(req.GetPage()),
+		PageSize:     int(req.GetPageSize()),
+		Sort:         req.GetSort(),
+		SortSafelist: []string{"created_at", "amount", "status", "-created_at", "-amount", "-status"},
+	}
+	if filters.Page == 0 {
+		filters.Page = 1
+	}
+	if filters.PageSize == 0 {
+		filters.PageSize = 20
+	}
+	if filters.Sort == "" {
+		filters.Sort = "-created_at"
+	}
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	userID := strconv.FormatInt(contextGetUserID(ctx), 10)
+
+	list, metadata, err := ps.models.Payment.GetAll(ctx, userID, req.GetStatus(), filters)
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	response := &payments.ListPaymentsResponse{
+		Payments: make([]*payments.Payment, 0, len(list)),
+		Metadata: &payments.PaginationMetadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+	}
+	for _, payment := range list {
+		response.Payments = append(response.Payments, paymentToProto(payment))
+	}
+
+	return response, nil
+}
+
+func (ps *PaymentServer) CapturePayment(ctx context.Context, req *payments.CapturePaymentRequest) (*payments.Payment, error) {
+	payment, err := ps.service.getUserPayment(ctx, contextGetUserID(ctx), req.GetId())
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	v := validator.New()
+	if validateCapture(v, payment, req.AmountToCapture); !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	payment, err = ps.service.capturePayment(ctx, payment, req.AmountToCapture, scopedIdempotencyKey(contextGetUserID(ctx), req.GetIdempotencyKey()))
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	return paymentToProto(payment), nil
+}
+
+func (ps *PaymentServer) CancelPayment(ctx context.Context, req *payments.CancelPaymentRequest) (*payments.Payment, error) {
+	payment, err := ps.service.getUserPayment(ctx, contextGetUserID(ctx), req.GetId())
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	v := validator.New()
+	if validateCancel(v, payment, req.CancellationReason); !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	payment, err = ps.service.cancelPayment(ctx, payment, req.CancellationReason, scopedIdempotencyKey(contextGetUserID(ctx), req.GetIdempotencyKey()))
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	return paymentToProto(payment), nil
+}
+
+func (ps *PaymentServer) CreateRefund(ctx context.Context, req *payments.CreateRefundRequest) (*payments.Refund, error) {
+	input := createRefundInput{
+		Amount:   req.Amount,
+		Reason:   req.Reason,
+		Metadata: req.GetMetadata(),
+	}
+
+	v := validator.New()
+	if validateCreateRefundInput(v, &input); !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	payment, err := ps.service.getUserPayment(ctx, contextGetUserID(ctx), req.GetPaymentId())
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	if err := ps.service.checkRefundable(ctx, v, payment, input.Amount); err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+	if !v.Valid() {
+		return nil, failedValidationStatus(v.Errors)
+	}
+
+	refund, err := ps.service.createRefund(ctx, payment, &input, scopedIdempotencyKey(contextGetUserID(ctx), req.GetIdempotencyKey()))
+	if err != nil {
+		return nil, ps.service.grpcError(err)
+	}
+
+	return refundToProto(refund, payment.ID), nil
+}
+
+// scopedIdempotencyKey prefixes a caller supplied key so it cannot collide
+// with keys from other users, or from the HTTP API, at the provider.
+func scopedIdempotencyKey(userID int64, key string) string {
+	if key == "" {
+		return ""
+	}
+	return fmt.Sprintf("grpc:%d:%s", userID, key)
+}
+
+// grpcError maps an error from a payment operation onto a gRPC status.
+// Unexpected errors are logged and reported as Internal.
+func (s *service) grpcError(err error) error {
+	var providerErr *provider.Error
+	if errors.As(err, &providerErr) {
+		switch {
+		case errors.Is(err, provider.ErrCardDeclined):
+			return status.Error(codes.FailedPrecondition, providerErr.Message)
+		case errors.Is(err, provider.ErrInvalidRequest):
+			return status.Error(codes.InvalidArgument, providerErr.Message)
+		case errors.Is(err, provider.ErrNotFound):
+			return status.Error(codes.NotFound, "resource not found")
+		default:
+			s.logger.Error("payment provider request failed", "err", err)
+			return status.Error(codes.Unavailable, "the payment provider could not process the request, please try again")
+		}
+	}
+
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Error(codes.NotFound, "resource not found")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request canceled")
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	default:
+		s.logger.Error("grpc request failed", "err", err)
+		return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+	}
+}
+
+func failedValidationStatus(validationErrors map[string]string) error {
+	return status.Error(codes.InvalidArgument, validationDetails(validationErrors))
+}
+
+func paymentToProto(payment *data.Payment) *payments.Payment {
+	p := &payments.Payment{
+		Id:                 payment.ID,
+		ProviderPaymentId:  payment.StripePaymentIntentID,
+		Amount:             payment.Amount,
+		Currency:           payment.Currency,
+		Status:             payment.Status,
+		CaptureMethod:      payment.CaptureMethod,
+		PaymentMethodTypes: payment.PaymentMethodTypes,
+		Metadata:           payment.Metadata,
+		CreatedAt:          timestampOrNil(&payment.CreatedAt),
+		UpdatedAt:          timestampOrNil(&payment.UpdatedAt),
+		ConfirmedAt:        timestampOrNil(payment.ConfirmedAt),
+		CanceledAt:         timestampOrNil(payment.CanceledAt),
+		SucceededAt:        timestampOrNil(payment.SucceededAt),
+	}
+
+	if payment.CustomerID != nil {
+		p.CustomerId = *payment.CustomerID
+	}
+	if payment.Description != nil {
+		p.Description = *payment.Description
+	}
+	if payment.ReceiptEmail != nil {
+		p.ReceiptEmail = *payment.ReceiptEmail
+	}
+	if payment.PaymentMethodID != nil {
+		p.PaymentMethodId = *payment.PaymentMethodID
+	}
+	if payment.SetupFutureUsage != nil {
+		p.SetupFutureUsage = *payment.SetupFutureUsage
+	}
+
+	return p
+}
+
+func refundToProto(refund *data.Refund, paymentID string) *payments.Refund {
+	r := &payments.Refund{
+		Id:               refund.ID,
+		ProviderRefundId: refund.StripeRefundID,
+		PaymentId:        paymentID,
+		Amount:           refund.Amount,
+		Currency:         refund.Currency,
+		Status:           refund.Status,
+		Metadata:         refund.Metadata,
+		CreatedAt:        timestampOrNil(&refund.CreatedAt),
+	}
+
+	if refund.Reason != nil {
+		r.Reason = *refund.Reason
+	}
+	if refund.FailureReason != nil {
+		r.FailureReason = *refund.FailureReason
+	}
+
+	return r
+}
+
+func timestampOrNil(t *time.Time) *timestamppb.Timestamp {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	payments "github.com/pirasl/payment-service/proto"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthCheckHandler reports whether the service is up. While the RabbitMQ
+// client is reconnecting the service keeps accepting requests (webhooks are
+// buffered in the outbox), so it reports "degraded" rather than failing.
+func (s *service) healthCheckHandler(c *gin.Context) {
+	status := "available"
+	rabbitmqState := s.rabbitmqClient.state()
+	if rabbitmqState != "connected" {
+		status = "degraded"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": status,
+		"system_info": gin.H{
+			"environment": getOptionalStringEnv("APP_ENV", "development"),
+			"rabbitmq":    rabbitmqState,
+		},
+	})
+}
+
+// dependencyCheck is the outcome of probing one dependency. A failing
+// critical dependency fails readiness; the others only degrade it.
+type dependencyCheck struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// livenessHandler reports that the process is serving requests. It checks
+// no dependencies, so an outage elsewhere never gets the service restarted.
+func (s *service) livenessHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// readinessHandler reports whether the service should receive traffic,
+// with the status of each dependency.
+func (s *service) readinessHandler(c *gin.Context) {
+	status, checks := s.readiness(c.Request.Context())
+
+	code := http.StatusOK
+	if status != "ready" && status != "degraded" {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// readiness probes the dependencies. Postgres and the schema are critical.
+// Without RabbitMQ or the workers the API keeps working, as webhooks are
+// buffered in the outbox, so they only degrade readiness.
+func (s *service) readiness(ctx context.Context) (string, map[string]*dependencyCheck) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	probes := map[string]struct {
+		critical bool
+		probe    func(ctx context.Context) error
+	}{
+		"postgres":   {true, s.models.DB.PingContext},
+		"migrations": {true, s.checkSchemaVersion},
+		"rabbitmq":   {false, s.checkRabbitMQ},
+		"workers":    {false, s.checkWorkers},
+	}
+
+	checks := make(map[string]*dependencyCheck, len(probes))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, p := range probes {
+		wg.Go(func() {
+			check := &dependencyCheck{Status: "up", Critical: p.critical}
+			if err := p.probe(ctx); err != nil {
+				check.Status = "down"
+				check.Error = err.Error()
+			}
+
+			mu.Lock()
+			checks[name] = check
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if s.shuttingDown.Load() {
+		return "shutting_down", checks
+	}
+
+	status := "ready"
+	for _, check := range checks {
+		if check.Status == "up" {
+			continue
+		}
+		if check.Critical {
+			return "not_ready", checks
+		}
+		status = "degraded"
+	}
+
+	return status, checks
+}
+
+func (s *service) checkSchemaVersion(ctx context.Context) error {
+	version, dirty, err := s.models.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("migration %d failed part way", version)
+	case version != int64(s.schemaVersion):
+		return fmt.Errorf("schema is at version %d, expected %d", version, s.schemaVersion)
+	}
+
+	return nil
+}
+
+// checkRabbitMQ checks the state of the supervised connection. Probes run
+// often, so it opens nothing on the broker.
+func (s *service) checkRabbitMQ(ctx context.Context) error {
+	if state := s.rabbitmqClient.state(); state != "connected" {
+		return fmt.Errorf("connection is %s", state)
+	}
+
+	return nil
+}
+
+func (s *service) checkWorkers(ctx context.Context) error {
+	if s.workerPool == nil {
+		return errors.New("worker pool not started")
+	}
+
+	if alive := s.workerPool.alive(); alive < s.workerPool.workerCount {
+		return fmt.Errorf("%d of %d workers running", alive, s.workerPool.workerCount)
+	}
+
+	return nil
+}
+
+// monitorGRPCHealth mirrors readiness in the gRPC health service. Once
+// shutdown begins the health server reports NOT_SERVING and ignores updates.
+func (s *service) monitorGRPCHealth() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		status, _ := s.readiness(ctx)
+
+		serving := healthpb.HealthCheckResponse_SERVING
+		if status != "ready" && status != "degraded" {
+			serving = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		s.grpcHealth.SetServingStatus("", serving)
+		s.grpcHealth.SetServingStatus(payments.PaymentService_ServiceDesc.ServiceName, serving)
+
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
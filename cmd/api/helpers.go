@@ -5,13 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/validator"
 )
 
 func (s *service) readJSON(c *gin.Context, dst any) error {
@@ -64,6 +65,32 @@ func (s *service) readJSON(c *gin.Context, dst any) error {
 	return nil
 }
 
+// readString returns a query string value, or defaultValue when the key is
+// absent or empty.
+func (s *service) readString(c *gin.Context, key string, defaultValue string) string {
+	value := c.Query(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// readInt returns a query string value as an integer, or defaultValue when
+// the key is absent. An invalid integer is recorded on the validator.
+func (s *service) readInt(c *gin.Context, key string, defaultValue int, v *validator.Validator) int {
+	value := c.Query(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
 // getRequiredStringEnv retrieves a required environment variable as a string.
 // It will log a fatal error and exit if the variable is not set.
 func getRequiredStringEnv(key string) (*string, error) {
@@ -107,12 +134,36 @@ func getOptionalIntEnv(key string, fallback int) int {
 	}
 	intValue, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("Warning: Environment variable '%s' is not a valid integer. Using fallback value %d. Error: %v", key, fallback, err)
+		slog.Warn("environment variable is not a valid integer, using fallback", "key", key, "fallback", fallback, "err", err)
 		return fallback
 	}
 	return intValue
 }
 
+// getOptionalIntListEnv retrieves an optional environment variable as a
+// comma separated list of integers, returning a fallback value if the
+// variable is not set or contains an invalid integer.
+func getOptionalIntListEnv(key string, fallback []int) []int {
+	value := getOptionalStringEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+
+	var ints []int
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		intValue, err := strconv.Atoi(part)
+		if err != nil {
+			slog.Warn("environment variable is not a valid list of integers, using fallback", "key", key, "fallback", fallback, "err", err)
+			return fallback
+		}
+		ints = append(ints, intValue)
+	}
+	return ints
+}
+
 // getRequiredBoolEnv retrieves a required environment variable as a boolean.
 // It will log a fatal error and exit if the variable is not set or is not a valid boolean.
 func getRequiredBoolEnv(key string) (*bool, error) {
@@ -137,7 +188,7 @@ func getOptionalBoolEnv(key string, fallback bool) bool {
 	}
 	boolValue, err := strconv.ParseBool(value)
 	if err != nil {
-		log.Printf("Warning: Environment variable '%s' is not a valid boolean. Using fallback value %t. Error: %v", key, fallback, err)
+		slog.Warn("environment variable is not a valid boolean, using fallback", "key", key, "fallback", fallback, "err", err)
 		return fallback
 	}
 	return boolValue
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC interceptors mirror the gin middleware: every call is traced,
+// tagged with a request ID, measured and logged, panics are turned into
+// Internal errors, clients are rate limited per IP and must present the same
+// JWT as the HTTP API.
+
+// grpcServerOptions returns the interceptor chains for the gRPC server. Unary
+// and streaming calls share one rate limiter.
+func (s *service) grpcServerOptions() []grpc.ServerOption {
+	limiter := newIPRateLimiter(s.config.rateLimiterConfig)
+
+	return []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(
+			s.requestIDUnary,
+			s.metricsUnary,
+			s.logUnary,
+			s.recoverUnary,
+			s.rateLimitUnary(limiter),
+			s.authenticateUnary,
+		),
+		grpc.ChainStreamInterceptor(
+			s.requestIDStream,
+			s.metricsStream,
+			s.logStream,
+			s.recoverStream,
+			s.rateLimitStream(limiter),
+			s.authenticateStream,
+		),
+	}
+}
+
+func (s *service) requestIDUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(withGRPCRequestID(ctx), req)
+}
+
+func (s *service) requestIDStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: ss, ctx: withGRPCRequestID(ss.Context())})
+}
+
+// withGRPCRequestID accepts the caller's x-request-id metadata, or generates
+// one, returns it in the response headers and stores it in the context.
+func withGRPCRequestID(ctx context.Context) context.Context {
+	var supplied string
+	if values := metadata.ValueFromIncomingContext(ctx, requestIDHeader); len(values) > 0 {
+		supplied = values[0]
+	}
+
+	requestID := requestIDOrNew(supplied)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, requestID))
+
+	return contextSetRequestID(ctx, requestID)
+}
+
+func (s *service) logUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	s.logGRPCCall(ctx, info.FullMethod, start, err)
+
+	return resp, err
+}
+
+func (s *service) logStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	err := handler(srv, ss)
+
+	s.logGRPCCall(ss.Context(), info.FullMethod, start, err)
+
+	return err
+}
+
+func (s *service) logGRPCCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+
+	attrs := []any{
+		"method", method,
+		"code", code.String(),
+		"duration", time.Since(start),
+		"peer", peerIP(ctx),
+	}
+
+	switch code {
+	case codes.OK:
+		s.logger.InfoContext(ctx, "grpc request", attrs...)
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		s.logger.ErrorContext(ctx, "grpc request", append(attrs, "err", err)...)
+	default:
+		s.logger.WarnContext(ctx, "grpc request", append(attrs, "err", err)...)
+	}
+}
+
+func (s *service) recoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recoveredPanic(ctx, info.FullMethod, r)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+func (s *service) recoverStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recoveredPanic(ss.Context(), info.FullMethod, r)
+		}
+	}()
+
+	return handler(srv, ss)
+}
+
+func (s *service) recoveredPanic(ctx context.Context, method string, r any) error {
+	s.logger.ErrorContext(ctx, "grpc handler panicked", "method", method, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+}
+
+func (s *service) rateLimitUnary(limiter *ipRateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !limiter.allow(peerIP(ctx)) {
+			return nil, errRateLimitExceeded
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func (s *service) rateLimitStream(limiter *ipRateLimiter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !limiter.allow(peerIP(ss.Context())) {
+			return errRateLimitExceeded
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+var errRateLimitExceeded = status.Error(codes.ResourceExhausted, "rate limit exceeded")
+
+func (s *service) authenticateUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if isHealthMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	ctx, err := s.authenticateGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *service) authenticateStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	ctx, err := s.authenticateGRPC(ss.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// isHealthMethod reports whether method belongs to the gRPC health service,
+// which probes call without credentials.
+func isHealthMethod(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.Health/")
+}
+
+// authenticateGRPC validates the bearer token in the call's authorization
+// metadata and returns a context carrying the user ID.
+func (s *service) authenticateGRPC(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		s.logger.WarnContext(ctx, "no auth token.")
+		return nil, status.Error(codes.Unauthenticated, "missing authentication token")
+	}
+
+	user, err := s.userFromAuthHeader(ctx, values[0])
+	if err != nil {
+		switch {
+		case errors.Is(err, errMalformedAuthHeader):
+			return nil, status.Error(codes.Unauthenticated, "authorization metadata must be in the format Bearer <token>")
+		case errors.Is(err, errExpiredToken):
+			return nil, status.Error(codes.Unauthenticated, "expired authentication token")
+		case errors.Is(err, errInvalidToken):
+			return nil, status.Error(codes.Unauthenticated, "invalid authentication token")
+		default:
+			return nil, s.grpcError(err)
+		}
+	}
+
+	return contextSetUserID(ctx, user.ID), nil
+}
+
+// contextStream overrides the stream's context, e.g. with one carrying the
+// request or user ID.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// peerIP returns the IP address of the client, or an empty string when it is
+// unknown.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+// Money movements are posted to the ledger in the transaction that records
+// them. Entry references are derived from provider IDs, so reprocessing a
+// webhook never posts twice. Sales, refunds and dispute withdrawals are in
+// the charge's currency, fees in the currency the funds settled in.
+
+// feeBatchSize bounds the charge fees looked up per check.
+const feeBatchSize = 100
+
+func (s *service) showLedgerBalancesHandler(c *gin.Context) {
+	v := validator.New()
+
+	at := time.Now()
+	if value := c.Query("at"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			v.AddError("at", "must be an RFC 3339 timestamp")
+		}
+		at = parsed
+	}
+
+	account := s.readString(c, "account", "")
+	if account != "" {
+		exists, err := s.models.Ledger.AccountExists(c.Request.Context(), account)
+		if err != nil {
+			s.InternalServerErrorResponse(c, err)
+			return
+		}
+		v.Check(exists, "account", "must be a known ledger account")
+	}
+
+	if !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	balances, err := s.models.Ledger.Balances(c.Request.Context(), account, at)
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"at": at, "balances": balances})
+}
+
+// postCharge posts the captured amount of a charge, and its fee once known.
+func postCharge(ctx context.Context, tx data.Models, charge *data.Charge) error {
+	if charge.Captured && charge.AmountCaptured > 0 {
+		_, err := tx.Ledger.Post(ctx, &data.LedgerEntry{
+			Reference:   fmt.Sprintf("charge:%s:captured", charge.StripeChargeID),
+			Description: fmt.Sprintf("Charge %s captured", charge.StripeChargeID),
+			Postings: []*data.LedgerPosting{
+				{Account: data.LedgerProviderBalance, Amount: charge.AmountCaptured, Currency: charge.Currency},
+				{Account: data.LedgerSales, Amount: -charge.AmountCaptured, Currency: charge.Currency},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if charge.BalanceTransactionID != nil && charge.Fee != nil && charge.FeeCurrency != nil {
+		return postFee(ctx, tx, *charge.BalanceTransactionID, *charge.Fee, *charge.FeeCurrency)
+	}
+
+	return nil
+}
+
+// postRefund posts a refund that succeeded, and reverses it when it fails
+// or is canceled afterwards.
+func postRefund(ctx context.Context, tx data.Models, refund *data.Refund) error {
+	succeeded := fmt.Sprintf("refund:%s:succeeded", refund.StripeRefundID)
+
+	switch refund.Status {
+	case "succeeded":
+		_, err := tx.Ledger.Post(ctx, &data.LedgerEntry{
+			Reference:   succeeded,
+			Description: fmt.Sprintf("Refund %s succeeded", refund.StripeRefundID),
+			Postings: []*data.LedgerPosting{
+				{Account: data.LedgerRefunds, Amount: refund.Amount, Currency: refund.Currency},
+				{Account: data.LedgerProviderBalance, Amount: -refund.Amount, Currency: refund.Currency},
+			},
+		})
+		return err
+	case "failed", "canceled":
+		_, err := tx.Ledger.Reverse(ctx, succeeded,
+			fmt.Sprintf("refund:%s:%s", refund.StripeRefundID, refund.Status),
+			fmt.Sprintf("Refund %s %s after succeeding", refund.StripeRefundID, refund.Status))
+		return err
+	default:
+		return nil
+	}
+}
+
+// postDisputeFunds posts the disputed amount leaving the balance, or
+// reverses that when the funds are reinstated.
+func postDisputeFunds(ctx context.Context, tx data.Models, dispute *data.Dispute, withdrawn bool) error {
+	withdrawal := fmt.Sprintf("dispute:%s:funds_withdrawn", dispute.StripeDisputeID)
+
+	if !withdrawn {
+		_, err := tx.Ledger.Reverse(ctx, withdrawal,
+			fmt.Sprintf("dispute:%s:funds_reinstated", dispute.StripeDisputeID),
+			fmt.Sprintf("Dispute %s funds reinstated", dispute.StripeDisputeID))
+		return err
+	}
+
+	_, err := tx.Ledger.Post(ctx, &data.LedgerEntry{
+		Reference:   withdrawal,
+		Description: fmt.Sprintf("Dispute %s funds withdrawn", dispute.StripeDisputeID),
+		Postings: []*data.LedgerPosting{
+			{Account: data.LedgerDisputeLosses, Amount: dispute.Amount, Currency: dispute.Currency},
+			{Account: data.LedgerProviderBalance, Amount: -dispute.Amount, Currency: dispute.Currency},
+		},
+	})
+	return err
+}
+
+// postDisputeFees posts the fees charged, or given back, with the dispute's
+// balance transactions.
+func postDisputeFees(ctx context.Context, tx data.Models, dispute *provider.Dispute) error {
+	for _, txn := range dispute.BalanceTransactions {
+		if err := postFee(ctx, tx, txn.ID, txn.Fee, txn.Currency); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// postFee posts the provider's fee on a balance transaction. A negative fee
+// is a fee given back.
+func postFee(ctx context.Context, tx data.Models, balanceTransactionID string, fee int64, currency string) error {
+	if fee == 0 {
+		return nil
+	}
+
+	_, err := tx.Ledger.Post(ctx, &data.LedgerEntry{
+		Reference:   fmt.Sprintf("balance_transaction:%s:fee", balanceTransactionID),
+		Description: fmt.Sprintf("Provider fee on %s", balanceTransactionID),
+		Postings: []*data.LedgerPosting{
+			{Account: data.LedgerProviderFees, Amount: fee, Currency: currency},
+			{Account: data.LedgerProviderBalance, Amount: -fee, Currency: currency},
+		},
+	})
+	return err
+}
+
+// monitorChargeFees periodically looks up the fees of settled charges.
+// Charge webhooks only carry the ID of the balance transaction holding them.
+func (s *service) monitorChargeFees() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.recordChargeFees(ctx)
+		}
+	}
+}
+
+func (s *service) recordChargeFees(ctx context.Context) {
+	pending, err := s.models.Charge.GetPendingFees(ctx, feeBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list charges without a fee", "err", err)
+		return
+	}
+
+	recorded := 0
+
+	for _, p := range pending {
+		txn, err := s.paymentProvider.GetBalanceTransaction(ctx, p.BalanceTransactionID)
+		if err != nil {
+			s.logger.Error("failed to get balance transaction", "charge_id", p.ChargeID, "balance_transaction_id", p.BalanceTransactionID, "err", err)
+			continue
+		}
+
+		err = s.models.Transact(ctx, func(tx data.Models) error {
+			if err := tx.Charge.SetFee(ctx, p.ChargeID, txn.Fee, txn.Currency); err != nil {
+				return err
+			}
+
+			return postFee(ctx, tx, txn.ID, txn.Fee, txn.Currency)
+		})
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Recorded from a webhook in the meantime.
+		case err != nil:
+			s.logger.Error("failed to record charge fee", "charge_id", p.ChargeID, "err", err)
+		default:
+			recorded++
+		}
+	}
+
+	if recorded > 0 {
+		s.logger.Info("charge fees recorded", "count", recorded)
+	}
+}
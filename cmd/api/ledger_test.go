@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+)
+
+func TestLedgerPost(t *testing.T) {
+	sale := func(reference string, debit, credit int64) *data.LedgerEntry {
+		return &data.LedgerEntry{
+			Reference:   reference,
+			Description: "test sale",
+			Postings: []*data.LedgerPosting{
+				{Account: data.LedgerProviderBalance, Amount: debit, Currency: "eur"},
+				{Account: data.LedgerSales, Amount: -credit, Currency: "eur"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		entries []*data.LedgerEntry
+
+		wantPosted  []bool
+		wantErr     error
+		wantBalance int64
+	}{
+		{
+			name:        "balanced",
+			entries:     []*data.LedgerEntry{sale("a", 1000, 1000)},
+			wantPosted:  []bool{true},
+			wantBalance: 1000,
+		},
+		{
+			name:        "reference posted once",
+			entries:     []*data.LedgerEntry{sale("a", 1000, 1000), sale("a", 1000, 1000)},
+			wantPosted:  []bool{true, false},
+			wantBalance: 1000,
+		},
+		{
+			name:    "unbalanced",
+			entries: []*data.LedgerEntry{sale("a", 1000, 900)},
+			wantErr: data.ErrUnbalancedEntry,
+		},
+		{
+			name:    "zero posting",
+			entries: []*data.LedgerEntry{sale("a", 0, 0)},
+			wantErr: data.ErrUnbalancedEntry,
+		},
+		{
+			name:    "no postings",
+			entries: []*data.LedgerEntry{{Reference: "a", Description: "empty"}},
+			wantErr: data.ErrUnbalancedEntry,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+
+			var posted []bool
+			err := s.models.Transact(t.Context(), func(tx data.Models) error {
+				for _, entry := range tt.entries {
+					ok, err := tx.Ledger.Post(t.Context(), entry)
+					if err != nil {
+						return err
+					}
+					posted = append(posted, ok)
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			for i := range tt.wantPosted {
+				if posted[i] != tt.wantPosted[i] {
+					t.Errorf("entry %d posted = %v, want %v", i, posted[i], tt.wantPosted[i])
+				}
+			}
+
+			if balance := testBalance(t, s, data.LedgerProviderBalance); balance != tt.wantBalance {
+				t.Errorf("provider balance = %d, want %d", balance, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestLedgerReverse(t *testing.T) {
+	s, _ := newTestService(t)
+
+	err := s.models.Transact(t.Context(), func(tx data.Models) error {
+		_, err := tx.Ledger.Post(t.Context(), &data.LedgerEntry{
+			Reference:   "refund:re_1:succeeded",
+			Description: "test refund",
+			Postings: []*data.LedgerPosting{
+				{Account: data.LedgerRefunds, Amount: 500, Currency: "eur"},
+				{Account: data.LedgerProviderBalance, Amount: -500, Currency: "eur"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, want := range []bool{true, false} {
+			reversed, err := tx.Ledger.Reverse(t.Context(), "refund:re_1:succeeded", "refund:re_1:failed", "test reversal")
+			if err != nil {
+				return err
+			}
+			if reversed != want {
+				t.Errorf("reversed = %v, want %v", reversed, want)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("post and reverse: %v", err)
+	}
+
+	if balance := testBalance(t, s, data.LedgerProviderBalance); balance != 0 {
+		t.Errorf("provider balance = %d after the reversal, want 0", balance)
+	}
+}
+
+// TestLedgerTriggers writes to the ledger tables directly, bypassing the
+// checks in LedgerModel.Post.
+func TestLedgerTriggers(t *testing.T) {
+	tests := []struct {
+		name    string
+		stmts   []string
+		wantErr string
+	}{
+		{
+			name: "unbalanced entry fails at commit",
+			stmts: []string{
+				`INSERT INTO ledger_entries (id, reference, description) VALUES ('00000000-0000-0000-0000-000000000001', 'a', 'unbalanced')`,
+				`INSERT INTO ledger_postings (entry_id, account_id, amount, currency)
+				 SELECT '00000000-0000-0000-0000-000000000001', id, 1000, 'eur' FROM ledger_accounts WHERE code = 'provider_balance'`,
+			},
+			wantErr: "is not balanced",
+		},
+		{
+			name: "entries cannot change",
+			stmts: []string{
+				`INSERT INTO ledger_entries (reference, description) VALUES ('a', 'entry')`,
+				`UPDATE ledger_entries SET description = 'edited'`,
+			},
+			wantErr: "append-only",
+		},
+		{
+			name: "entries cannot be deleted",
+			stmts: []string{
+				`INSERT INTO ledger_entries (reference, description) VALUES ('a', 'entry')`,
+				`DELETE FROM ledger_entries`,
+			},
+			wantErr: "append-only",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+
+			tx, err := s.models.DB.BeginTx(t.Context(), nil)
+			if err != nil {
+				t.Fatalf("begin: %v", err)
+			}
+			defer tx.Rollback()
+
+			for _, stmt := range tt.stmts {
+				if _, err = tx.ExecContext(t.Context(), stmt); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func testBalance(t *testing.T, s *service, account string) int64 {
+	t.Helper()
+
+	balances, err := s.models.Ledger.Balances(t.Context(), account, time.Now())
+	if err != nil {
+		t.Fatalf("get balances: %v", err)
+	}
+
+	var total int64
+	for _, balance := range balances {
+		total += balance.Balance
+	}
+	return total
+}
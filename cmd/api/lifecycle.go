@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Shutdown runs in phases, in dependency order: readiness fails first so
+// load balancers drain us, then the servers stop accepting, the workers
+// finish and settle their in-flight deliveries, the outbox relay and the
+// background jobs stop, and only then are RabbitMQ and Postgres closed.
+// Each phase has its own timeout; a phase that fails or times out is logged
+// and the next one still runs.
+
+// shutdownPhase is one step of the shutdown. stop must return once ctx is
+// done, or the phase is abandoned when its timeout expires.
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	stop    func(ctx context.Context) error
+}
+
+// lifecycle runs the shutdown phases in the order they were added.
+type lifecycle struct {
+	logger *slog.Logger
+	phases []shutdownPhase
+}
+
+func (l *lifecycle) add(name string, timeout time.Duration, stop func(ctx context.Context) error) {
+	l.phases = append(l.phases, shutdownPhase{name: name, timeout: timeout, stop: stop})
+}
+
+// shutdown runs every phase and returns the errors of those that failed.
+func (l *lifecycle) shutdown() error {
+	var errs []error
+
+	for _, phase := range l.phases {
+		if err := l.run(phase); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown %s: %w", phase.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *lifecycle) run(phase shutdownPhase) error {
+	ctx, cancel := context.WithTimeout(context.Background(), phase.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- phase.stop(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		l.logger.Error("shutdown phase timed out", "phase", phase.name, "timeout", phase.timeout)
+	case err != nil:
+		l.logger.Error("shutdown phase failed", "phase", phase.name, "duration", time.Since(start), "err", err)
+	default:
+		l.logger.Info("shutdown phase completed", "phase", phase.name, "duration", time.Since(start))
+	}
+
+	return err
+}
+
+// background runs fn in a goroutine tracked by s.wg, which the background
+// phase of the shutdown waits for.
+func (s *service) background(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// backgroundContext returns a context that is cancelled once the background
+// jobs are told to stop, so their in-flight work is abandoned rather than
+// racing the closing of the database. The caller must call cancel.
+func (s *service) backgroundContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// waitFor adapts a blocking stop function that takes no context.
+func waitFor(stop func() error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return stop()
+	}
+}
+
+// newLifecycle lays out the shutdown of the service and its servers.
+func (s *service) newLifecycle(server, admin *http.Server) *lifecycle {
+	cfg := s.config.shutdown
+	l := &lifecycle{logger: s.logger}
+
+	l.add("drain", cfg.drainDelay+time.Second, func(ctx context.Context) error {
+		s.shuttingDown.Store(true)
+		s.grpcHealth.Shutdown()
+
+		select {
+		case <-time.After(cfg.drainDelay):
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	l.add("http", cfg.httpTimeout, func(ctx context.Context) error {
+		return errors.Join(server.Shutdown(ctx), admin.Shutdown(ctx))
+	})
+
+	// GracefulStop waits for in-flight calls; once the timeout expires the
+	// remaining ones are cancelled.
+	l.add("grpc", cfg.grpcTimeout, func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+			return ctx.Err()
+		}
+	})
+
+	// Workers finish the delivery in hand and ack or nack it before their
+	// channel closes; unacknowledged prefetched deliveries are requeued by
+	// the broker.
+	l.add("workers", cfg.workersTimeout, waitFor(func() error {
+		if s.workerPool == nil {
+			return nil
+		}
+		return s.workerPool.Shutdown()
+	}))
+
+	l.add("outbox", cfg.outboxTimeout, waitFor(func() error {
+		s.outboxRelay.Shutdown()
+		return nil
+	}))
+
+	l.add("background", cfg.backgroundTimeout, waitFor(func() error {
+		close(s.shutdown)
+		s.wg.Wait()
+		return nil
+	}))
+
+	l.add("amqp", cfg.amqpTimeout, waitFor(s.rabbitmqClient.Close))
+
+	l.add("database", cfg.databaseTimeout, waitFor(s.models.DB.Close))
+
+	return l
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 )
 
 type service struct {
@@ -16,27 +22,73 @@ type service struct {
 	models         *data.Models
 	rabbitmqClient *rabbitMQClient
 
-	stripeClient *stripeConfig
-	workerPool   *workerPool
+	stripeClient    *stripeConfig
+	paymentProvider provider.PaymentProvider
+	workerPool      *workerPool
+	outboxRelay     *outboxRelay
+	grpcServer      *grpc.Server
+	grpcHealth      *health.Server
 
-	wg sync.WaitGroup
+	// schemaVersion is the migration version the service was started
+	// with; readiness fails if the database moves away from it.
+	schemaVersion uint
+
+	// shuttingDown fails readiness once shutdown begins.
+	shuttingDown atomic.Bool
+
+	// shutdown is closed to stop the background goroutines tracked by wg.
+	shutdown chan struct{}
+	wg       sync.WaitGroup
 }
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil)).With(slog.String("service", "[PAYMENT-STRIPE]"))
+	// The env file is loaded first as it may configure logging.
+	var envFileErr error
+	devMode := getOptionalStringEnv("APP_ENV", "development") == "development"
+	if devMode {
+		envFileErr = godotenv.Load()
+	}
+
+	logger, err := newLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot configure logging:", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
 
 	logger.Info("starting...")
 
-	if getOptionalStringEnv("APP_ENV", "development") == "development" {
-		logger.Info("[DEV MODE]: loading env file")
-		err := godotenv.Load()
+	if devMode {
+		if envFileErr != nil {
+			logger.Warn("[DEV MODE]: error loading .env file, using OS environment variables", "err", envFileErr)
+		} else {
+			logger.Info("[DEV MODE]: loaded env file")
+		}
+	}
+
+	if ran, err := runCommand(logger, os.Args[1:]); ran {
 		if err != nil {
-			log.Println("Error loading .env file, using OS environment variables")
+			logger.Error("command failed", "command", os.Args[1], "err", err)
+			os.Exit(1)
 		}
+		return
 	}
 
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		logger.Error("cannot set up tracing. exiting...", "err:", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("failed to flush traces", "err", err)
+		}
+	}()
+
 	logger.Info("reaching for rabbitmq...")
-	rabbitmq, err := newRabbitMQClient()
+	rabbitmq, err := newRabbitMQClient(logger)
 	if err != nil {
 		logger.Error("could not reach rabbitmq. exiting...", "err: ", err)
 		os.Exit(1)
@@ -51,6 +103,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	paymentProvider, err := newPaymentProvider()
+	if err != nil {
+		logger.Error("cannot load payment provider. exiting...", "err:", err)
+		os.Exit(1)
+	}
+	logger.Info("payment provider loaded", "provider", paymentProvider.Name())
+
 	logger.Info("connecting to transactions db...")
 
 	db, err := openDB()
@@ -60,7 +119,8 @@ func main() {
 	}
 	defer db.Close()
 
-	if err := runMigrations(db); err != nil {
+	schemaVersion, err := runMigrations(logger, db)
+	if err != nil {
 		logger.Error("failed to run migrations. exiting...", "err:", err)
 		os.Exit(1)
 	}
@@ -73,24 +133,44 @@ func main() {
 		os.Exit(1)
 	}
 
-	wp, err := newWorkerPool(5, rabbitmq)
+	models := data.NewModels(db)
+
+	wp, err := newWorkerPool(logger, 5, rabbitmq, newEventDispatcher(logger, &models))
 	if err != nil {
 		logger.Error("unable to create worker pool. exiting...", "err:", err)
 	}
 
 	s := &service{
-		logger:         logger,
-		rabbitmqClient: rabbitmq,
-		models:         data.NewModels(db),
-		stripeClient:   stripeClient,
-		config:         serviceConfig,
-		workerPool:     wp,
+		logger:          logger,
+		rabbitmqClient:  rabbitmq,
+		models:          &models,
+		stripeClient:    stripeClient,
+		paymentProvider: paymentProvider,
+		config:          serviceConfig,
+		workerPool:      wp,
+		outboxRelay:     newOutboxRelay(logger, &models, rabbitmq),
+		grpcHealth:      health.NewServer(),
+		schemaVersion:   schemaVersion,
+		shutdown:        make(chan struct{}),
 	}
 
+	s.grpcServer = s.newGRPCServer()
+
 	logger.Info("service config loaded")
 
 	go s.gRPCListen()
 
+	// Background jobs stop in the lifecycle's background phase.
+	s.background(s.monitorGRPCHealth)
+	s.background(s.purgeExpiredIdempotencyKeys)
+	s.background(s.monitorAuthorizations)
+	s.background(s.monitorCardExpiry)
+	s.background(s.monitorDisputeDeadlines)
+	s.background(s.monitorChargeFees)
+	s.background(s.monitorReconciliation)
+	s.background(s.sweepPendingWebhooks)
+	s.background(s.purgeSentOutbox)
+
 	logger.Info("stripe payment service up and running", "port", serviceConfig.gRPCPort)
 
 	if err := s.serve(); err != nil {
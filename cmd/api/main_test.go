@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+)
+
+// newTestService returns a service backed by the database in TEST_DB_DSN,
+// migrated and emptied, and by a fake payment provider. The test is skipped
+// when TEST_DB_DSN is not set. The outbox relay only collects wake-ups, so
+// messages stay in the outbox for the test to inspect.
+func newTestService(t *testing.T) (*service, *provider.Fake) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Migrations are read relative to the repository root.
+	t.Chdir("../..")
+	if _, err := runMigrations(logger, db); err != nil {
+		t.Fatalf("run migrations: %v", err)
+	}
+
+	// The ledger accounts are seeded by a migration.
+	_, err = db.ExecContext(t.Context(), `
+		DO $$
+		DECLARE tables text;
+		BEGIN
+			SELECT string_agg(quote_ident(tablename), ', ') INTO tables
+			FROM pg_tables
+			WHERE schemaname = 'public' AND tablename NOT IN ('schema_migrations', 'ledger_accounts');
+			EXECUTE 'TRUNCATE ' || tables || ' RESTART IDENTITY CASCADE';
+		END $$`)
+	if err != nil {
+		t.Fatalf("empty database: %v", err)
+	}
+
+	models := data.NewModels(db)
+	fake := provider.NewFake()
+
+	s := &service{
+		config:          &serviceConfig{idempotencyKeyTTL: time.Hour},
+		logger:          logger,
+		models:          &models,
+		paymentProvider: fake,
+		outboxRelay:     &outboxRelay{wake: make(chan struct{}, 1)},
+	}
+
+	return s, fake
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics are registered with the default Prometheus registry, which also
+// carries the Go runtime and process collectors, and served on the admin
+// port so they are never exposed with the public API.
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	grpcRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "gRPC calls handled, by method and status code.",
+	}, []string{"method", "code"})
+	grpcRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Time taken to handle gRPC calls, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	webhooksReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stripe_webhooks_received_total",
+		Help: "Stripe webhook requests received, before verification.",
+	})
+	webhooksVerifiedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stripe_webhooks_verified_total",
+		Help: "Stripe webhooks with a valid signature, by event type.",
+	}, []string{"type"})
+	webhooksRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stripe_webhooks_rejected_total",
+		Help: "Stripe webhooks rejected, by reason.",
+	}, []string{"reason"})
+
+	eventProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stripe_event_processing_duration_seconds",
+		Help:    "Time taken by the worker pool to process a Stripe event, by type and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type", "outcome"})
+	eventDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stripe_event_deliveries_total",
+		Help: "Stripe event deliveries settled by the worker pool: acked, retried or dead_lettered.",
+	}, []string{"outcome"})
+	workersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stripe_event_workers_busy",
+		Help: "Workers currently processing a Stripe event.",
+	})
+
+	webhookEventsStuck = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_events_stuck",
+		Help: "Webhook events still unprocessed after the stuck threshold, as of the last sweep.",
+	})
+	webhookEventsFailed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "webhook_events_failed",
+		Help: "Webhook events marked permanently failed or dead-lettered, as of the last sweep.",
+	})
+	webhookEventsSweptTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_events_swept_total",
+		Help: "Stuck webhook events queued again by the sweeper.",
+	})
+	webhookEventsExhaustedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_events_exhausted_total",
+		Help: "Webhook events marked permanently failed by the sweeper.",
+	})
+
+	outboxMessagesDeadTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_messages_dead_total",
+		Help: "Outbox messages parked after failing every publish attempt, by type.",
+	}, []string{"type"})
+
+	paymentIntentsCreatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_intents_created_total",
+		Help: "Payment intents created, by currency.",
+	}, []string{"currency"})
+	paymentIntentsSucceededTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_intents_succeeded_total",
+		Help: "Payment intents that succeeded, by currency.",
+	}, []string{"currency"})
+	paymentIntentsFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_intents_failed_total",
+		Help: "Payment attempts that failed, by currency.",
+	}, []string{"currency"})
+)
+
+// adminServer serves the metrics endpoint on the admin port.
+func (s *service) adminServer() *http.Server {
+	var addr string
+	if getOptionalStringEnv("APP_ENV", "development") == "development" {
+		addr = fmt.Sprintf("localhost:%d", s.config.metricsPort)
+	} else {
+		addr = fmt.Sprintf(":%d", s.config.metricsPort)
+	}
+
+	if s.rabbitmqClient != nil {
+		prometheus.MustRegister(&queueDepthCollector{rabbitmq: s.rabbitmqClient})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	return &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// instrument records the latency and status of HTTP requests. Requests that
+// matched no route share one label so unknown paths cannot grow the series.
+func (s *service) instrument() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (s *service) metricsUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	observeGRPCCall(info.FullMethod, start, err)
+
+	return resp, err
+}
+
+func (s *service) metricsStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	err := handler(srv, ss)
+
+	observeGRPCCall(info.FullMethod, start, err)
+
+	return err
+}
+
+func observeGRPCCall(method string, start time.Time, err error) {
+	grpcRequestsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpcRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// queueDepthCollector reports the messages waiting in the processing and
+// dead-letter queues, asking the broker at scrape time. Nothing is reported
+// while the broker is unreachable.
+type queueDepthCollector struct {
+	rabbitmq *rabbitMQClient
+}
+
+var queueDepthDesc = prometheus.NewDesc("rabbitmq_queue_messages", "Messages ready in a queue.", []string{"queue"}, nil)
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	depths, err := c.rabbitmq.queueDepths(ctx, stripeProcessingQueue, deadLetterQueue)
+	if err != nil {
+		return
+	}
+
+	for queue, depth := range depths {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), queue)
+	}
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -9,131 +18,434 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/pascaldekloe/jwt"
+	"github.com/pirasl/payment-service/internal/data"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 )
 
+const (
+	jwtIssuer   = "api-gateway"
+	jwtAudience = "quizify.leo-piras.com"
+)
+
+var (
+	errMalformedAuthHeader = errors.New("malformed authorization header")
+	errInvalidToken        = errors.New("invalid authentication token")
+	errExpiredToken        = errors.New("expired authentication token")
+)
+
+// requestID accepts the caller's X-Request-ID, or generates one, echoes it on
+// the response and stores it in the request context for logging.
+func (s *service) requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := requestIDOrNew(c.GetHeader(requestIDHeader))
+
+		c.Header(requestIDHeader, requestID)
+		c.Request = c.Request.WithContext(contextSetRequestID(c.Request.Context(), requestID))
+		c.Next()
+	}
+}
+
+// logRequest logs every request once it has been handled.
+func (s *service) logRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			"ip", c.ClientIP(),
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= http.StatusInternalServerError:
+			s.logger.ErrorContext(c.Request.Context(), "http request", attrs...)
+		case status >= http.StatusBadRequest:
+			s.logger.WarnContext(c.Request.Context(), "http request", attrs...)
+		default:
+			s.logger.InfoContext(c.Request.Context(), "http request", attrs...)
+		}
+	}
+}
+
+// recoverPanic turns a handler panic into a 500 response.
+func (s *service) recoverPanic() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		s.logger.ErrorContext(c.Request.Context(), "http handler panicked", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+		s.InternalServerErrorResponse(c, fmt.Errorf("panic: %v", recovered))
+		c.Abort()
+	})
+}
+
 func (s *service) authenticate() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Vary", "Authorization")
 
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			s.logger.Error("no auth token.")
+			s.logger.WarnContext(c.Request.Context(), "no auth token.")
 			s.invalidAuthenticationTokenResponse(c)
 			c.Abort()
 			return
 		}
 
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-
-			s.logger.Error("malformed authorization header", "header", authHeader)
-			s.malformedAuthTokenResponse(c)
+		user, err := s.userFromAuthHeader(c.Request.Context(), authHeader)
+		if err != nil {
+			switch {
+			case errors.Is(err, errMalformedAuthHeader):
+				s.malformedAuthTokenResponse(c)
+			case errors.Is(err, errExpiredToken):
+				s.expiredTokenResponse(c)
+			case errors.Is(err, errInvalidToken):
+				s.invalidAuthenticationTokenResponse(c)
+			default:
+				s.InternalServerErrorResponse(c, err)
+			}
 			c.Abort()
 			return
 		}
 
-		token := headerParts[1]
+		c.Set("userID", user.ID)
+		c.Set("permissions", user.Permissions)
+		c.Request = c.Request.WithContext(contextSetUserID(c.Request.Context(), user.ID))
+		c.Next()
+	}
+}
 
-		claims, err := jwt.HMACCheck([]byte(token), []byte(s.config.jwtConfig.secret))
-		if err != nil {
-			s.logger.Error("jwt signature validation failed", "error", err)
-			s.invalidAuthenticationTokenResponse(c)
+// requirePermission rejects requests whose token does not grant the given
+// permission. It must run after authenticate.
+func (s *service) requirePermission(code string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(c.GetStringSlice("permissions"), code) {
+			s.notPermittedResponse(c)
 			c.Abort()
 			return
 		}
 
-		if !claims.Valid(time.Now()) {
-			s.logger.Error("jwt token is invalid or expired")
-			s.expiredTokenResponse(c)
-			c.Abort()
-			return
-		}
+		c.Next()
+	}
+}
 
-		if claims.Issuer != "api-gateway" {
-			s.logger.Error("jwt issuer mismatch", "expected_issuer", "api-gateway", "actual_issuer", claims.Issuer)
-			s.invalidAuthenticationTokenResponse(c)
-			c.Abort()
-			return
-		}
+// authenticatedUser is the caller identified by a JWT.
+type authenticatedUser struct {
+	ID int64
+	// Permissions come from the token's "permissions" claim, e.g.
+	// "disputes:read".
+	Permissions []string
+}
+
+// userFromAuthHeader validates a "Bearer <token>" authorization value and
+// returns the user in the token's subject. It is shared by the HTTP and
+// gRPC APIs.
+func (s *service) userFromAuthHeader(ctx context.Context, authHeader string) (*authenticatedUser, error) {
+	headerParts := strings.Split(authHeader, " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		s.logger.WarnContext(ctx, "malformed authorization header")
+		return nil, errMalformedAuthHeader
+	}
 
-		if !claims.AcceptAudience("quizify.leo-piras.com") {
+	token := headerParts[1]
 
-			s.logger.Error("jwt audience mismatch", "expected_audience", "quizify.leo-piras.com", "actual_audiences", claims.Audiences)
-			s.invalidAuthenticationTokenResponse(c)
-			c.Abort()
-			return
+	claims, err := jwt.HMACCheck([]byte(token), []byte(s.config.jwtConfig.secret))
+	if err != nil {
+		s.logger.WarnContext(ctx, "jwt signature validation failed", "error", err)
+		return nil, errInvalidToken
+	}
+
+	if !claims.Valid(time.Now()) {
+		s.logger.WarnContext(ctx, "jwt token is invalid or expired")
+		return nil, errExpiredToken
+	}
+
+	if claims.Issuer != jwtIssuer {
+		s.logger.WarnContext(ctx, "jwt issuer mismatch", "expected_issuer", jwtIssuer, "actual_issuer", claims.Issuer)
+		return nil, errInvalidToken
+	}
+
+	if !claims.AcceptAudience(jwtAudience) {
+		s.logger.WarnContext(ctx, "jwt audience mismatch", "expected_audience", jwtAudience, "actual_audiences", claims.Audiences)
+		return nil, errInvalidToken
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "failed to parse user ID from jwt subject", "subject", claims.Subject, "error", err)
+		return nil, fmt.Errorf("parse jwt subject: %w", err)
+	}
+
+	user := &authenticatedUser{ID: userID}
+
+	if permissions, ok := claims.Set["permissions"].([]any); ok {
+		for _, permission := range permissions {
+			if code, ok := permission.(string); ok {
+				user.Permissions = append(user.Permissions, code)
+			}
 		}
+	}
 
-		userID, err := strconv.ParseInt(claims.Subject, 10, 64)
-		if err != nil {
-			s.logger.Error("failed to parse user ID from jwt subject", "subject", claims.Subject, "error", err)
-			s.InternalServerErrorResponse(c, err)
+	return user, nil
+}
+
+func (s *service) rateLimiter() gin.HandlerFunc {
+	limiter := newIPRateLimiter(s.config.rateLimiterConfig)
+
+	return func(c *gin.Context) {
+		if !limiter.allow(realip.FromRequest(c.Request)) {
+			s.rateLimitExceededResponse(c)
 			c.Abort()
 			return
 		}
 
-		c.Set("userID", userID)
 		c.Next()
 	}
 }
 
-func (s *service) rateLimiter() gin.HandlerFunc {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// ipRateLimiter keeps a token bucket per client IP. Buckets of clients not
+// seen for three minutes are dropped.
+type ipRateLimiter struct {
+	config *rateLimiterConfig
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+	mu      sync.Mutex
+	clients map[string]*rateLimitedClient
+}
+
+type rateLimitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPRateLimiter(config *rateLimiterConfig) *ipRateLimiter {
+	l := &ipRateLimiter{
+		config:  config,
+		clients: make(map[string]*rateLimitedClient),
+	}
 
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 
-			mu.Lock()
+			l.mu.Lock()
 
-			for ip, client := range clients {
+			for ip, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, ip)
 				}
 			}
 
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
+	return l
+}
+
+// allow reports whether a request from ip may proceed. It always does when
+// rate limiting is disabled.
+func (l *ipRateLimiter) allow(ip string) bool {
+	if !l.config.enabled {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.clients[ip]; !found {
+		l.clients[ip] = &rateLimitedClient{
+			limiter: rate.NewLimiter(rate.Limit(l.config.rps), l.config.burst),
+		}
+	}
+
+	l.clients[ip].lastSeen = time.Now()
+
+	return l.clients[ip].limiter.Allow()
+}
+
+func (s *service) limitBodySize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(8<<20))
+		c.Next()
+	}
+}
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 200
+
+	// idempotencyKeyStaleAfter is how long a request that never completed
+	// (e.g. the instance died) holds its key before a retry may take it over.
+	// It is well above the server's write timeout.
+	idempotencyKeyStaleAfter = time.Minute
+)
+
+// idempotent makes a mutating endpoint safe to retry. When the request
+// carries an Idempotency-Key header the first response is stored and
+// replayed for later requests with the same key; reusing a key with a
+// different request is a conflict. Server errors release the key so the
+// request can be retried. It must run after authenticate, as keys are scoped
+// to the user.
+func (s *service) idempotent() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := realip.FromRequest(c.Request)
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
 
-		mu.Lock()
+		if len(key) > maxIdempotencyKeyLength {
+			s.badRequestResponse(c, fmt.Sprintf("%s must not be more than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			c.Abort()
+			return
+		}
 
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				limiter: rate.NewLimiter(rate.Limit(s.config.rateLimiterConfig.rps), s.config.rateLimiterConfig.burst),
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				s.badRequestResponse(c, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+			} else {
+				s.InternalServerErrorResponse(c, err)
 			}
+			c.Abort()
+			return
 		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
 
-		clients[ip].lastSeen = time.Now()
+		userID := c.GetInt64("userID")
 
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
-			s.rateLimitExceededResponse(c)
+		record := &data.IdempotencyKey{
+			UserID:        userID,
+			Key:           key,
+			RequestMethod: c.Request.Method,
+			RequestPath:   c.Request.URL.Path,
+			RequestHash:   requestFingerprint(userID, c.Request.Method, c.Request.URL.Path, body),
+			ExpiresAt:     time.Now().Add(s.config.idempotencyKeyTTL),
+		}
+
+		err = s.models.IdempotencyKey.Insert(c.Request.Context(), record, idempotencyKeyStaleAfter)
+		if err != nil {
+			if errors.Is(err, data.ErrIdempotencyKeyInUse) {
+				s.replayIdempotentResponse(c, record)
+			} else {
+				s.InternalServerErrorResponse(c, err)
+			}
+			c.Abort()
 			return
 		}
 
-		mu.Unlock()
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Set("idempotencyKey", key)
 
 		c.Next()
+
+		// The request context may already be done; the outcome must still be
+		// recorded.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if recorder.Status() >= http.StatusInternalServerError {
+			if err := s.models.IdempotencyKey.Delete(ctx, record.ID); err != nil {
+				s.logger.ErrorContext(c.Request.Context(), "failed to release idempotency key", "key", key, "err", err)
+			}
+			return
+		}
+
+		if err := s.models.IdempotencyKey.SaveResponse(ctx, record.ID, recorder.Status(), recorder.body.Bytes()); err != nil {
+			s.logger.ErrorContext(c.Request.Context(), "failed to store idempotent response", "key", key, "err", err)
+		}
 	}
 }
 
-func (s *service) limitBodySize() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(8<<20))
-		c.Next()
+// replayIdempotentResponse answers a request whose key is already taken.
+func (s *service) replayIdempotentResponse(c *gin.Context, record *data.IdempotencyKey) {
+	existing, err := s.models.IdempotencyKey.Get(c.Request.Context(), record.UserID, record.Key)
+	if err != nil {
+		// Released by a failed request in the meantime; the client can retry.
+		if errors.Is(err, data.ErrRecordNotFound) {
+			s.idempotentRequestInProgressResponse(c)
+			return
+		}
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	if existing.RequestHash != record.RequestHash {
+		s.editConflictResponse(c)
+		return
+	}
+
+	if existing.ResponseStatus == nil {
+		s.idempotentRequestInProgressResponse(c)
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(*existing.ResponseStatus, "application/json; charset=utf-8", existing.ResponseBody)
+}
+
+// requestFingerprint identifies a request for idempotency checks.
+func requestFingerprint(userID int64, method, path string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n", userID, method, path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// providerIdempotencyKey returns the key to forward to the payment provider,
+// scoped to the user so keys from different users never collide. It is empty
+// when the request has no Idempotency-Key.
+func providerIdempotencyKey(c *gin.Context) string {
+	key := c.GetString("idempotencyKey")
+	if key == "" {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", c.GetInt64("userID"), key)
+}
+
+// responseRecorder keeps a copy of the response body for idempotent replay.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(str string) (int, error) {
+	w.body.WriteString(str)
+	return w.ResponseWriter.WriteString(str)
+}
+
+// purgeExpiredIdempotencyKeys periodically deletes expired idempotency keys.
+// Expired keys are already ignored on insert, this only keeps the table small.
+func (s *service) purgeExpiredIdempotencyKeys() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := s.models.IdempotencyKey.DeleteExpired(ctx)
+		if err != nil {
+			s.logger.Error("failed to purge expired idempotency keys", "err", err)
+			continue
+		}
+
+		if deleted > 0 {
+			s.logger.Info("purged expired idempotency keys", "count", deleted)
+		}
 	}
 }
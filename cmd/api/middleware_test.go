@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotent(t *testing.T) {
+	type request struct {
+		userID int64
+		key    string
+		body   string
+	}
+
+	tests := []struct {
+		name string
+
+		// statuses are answered by the handler, one per call.
+		statuses []int
+		requests []request
+
+		wantCodes    []int
+		wantCalls    int
+		wantReplayed bool
+		wantReason   string
+	}{
+		{
+			name:         "replays the stored response",
+			statuses:     []int{http.StatusCreated},
+			requests:     []request{{1, "key", `{"amount": 1}`}, {1, "key", `{"amount": 1}`}},
+			wantCodes:    []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    1,
+			wantReplayed: true,
+		},
+		{
+			name:         "replays a client error",
+			statuses:     []int{http.StatusUnprocessableEntity},
+			requests:     []request{{1, "key", `{"amount": 1}`}, {1, "key", `{"amount": 1}`}},
+			wantCodes:    []int{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+			wantCalls:    1,
+			wantReplayed: true,
+		},
+		{
+			name:       "conflicts on a different body",
+			statuses:   []int{http.StatusCreated},
+			requests:   []request{{1, "key", `{"amount": 1}`}, {1, "key", `{"amount": 2}`}},
+			wantCodes:  []int{http.StatusCreated, http.StatusConflict},
+			wantCalls:  1,
+			wantReason: "EDIT_CONFLICT",
+		},
+		{
+			name:      "releases the key on a server error",
+			statuses:  []int{http.StatusInternalServerError, http.StatusCreated},
+			requests:  []request{{1, "key", `{"amount": 1}`}, {1, "key", `{"amount": 1}`}},
+			wantCodes: []int{http.StatusInternalServerError, http.StatusCreated},
+			wantCalls: 2,
+		},
+		{
+			name:      "scopes keys to the user",
+			statuses:  []int{http.StatusCreated, http.StatusCreated},
+			requests:  []request{{1, "key", `{"amount": 1}`}, {2, "key", `{"amount": 1}`}},
+			wantCodes: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls: 2,
+		},
+		{
+			name:      "runs every request without a key",
+			statuses:  []int{http.StatusCreated, http.StatusCreated},
+			requests:  []request{{1, "", `{"amount": 1}`}, {1, "", `{"amount": 1}`}},
+			wantCodes: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+
+			calls := 0
+			handler := func(c *gin.Context) {
+				calls++
+				c.JSON(tt.statuses[calls-1], gin.H{"call": calls})
+			}
+
+			r := gin.New()
+			// authenticate is stood in for by a header naming the user.
+			r.POST("/payments", func(c *gin.Context) {
+				userID, _ := strconv.ParseInt(c.GetHeader("X-User-ID"), 10, 64)
+				c.Set("userID", userID)
+			}, s.idempotent(), handler)
+
+			var first, last *httptest.ResponseRecorder
+
+			for i, rq := range tt.requests {
+				req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(rq.body))
+				req.Header.Set("Content-Type", "application/json")
+				if rq.key != "" {
+					req.Header.Set(idempotencyKeyHeader, rq.key)
+				}
+				req.Header.Set("X-User-ID", strconv.FormatInt(rq.userID, 10))
+
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+
+				if rec.Code != tt.wantCodes[i] {
+					t.Fatalf("request %d: status = %d, want %d: %s", i, rec.Code, tt.wantCodes[i], rec.Body)
+				}
+
+				if first == nil {
+					first = rec
+				}
+				last = rec
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+
+			replayed := last.Header().Get("Idempotent-Replayed") == "true"
+			if replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && last.Body.String() != first.Body.String() {
+				t.Errorf("replayed body = %s, want %s", last.Body, first.Body)
+			}
+
+			if tt.wantReason != "" {
+				var body ErrorMessage
+				if err := json.Unmarshal(last.Body.Bytes(), &body); err != nil {
+					t.Fatalf("decode error response: %v", err)
+				}
+				if body.Reason != tt.wantReason {
+					t.Errorf("reason = %q, want %q", body.Reason, tt.wantReason)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// paymentEventsExchange carries the events this service emits about its own
+// state changes, routed by event type (e.g. payment.succeeded).
+const paymentEventsExchange = "payment_events"
+
+// outboxRelay publishes rows from the outbox table to RabbitMQ. Messages are
+// only marked as sent once the broker has confirmed them, so a crash can at
+// worst publish a message twice, never lose it. A message that still fails
+// after maxAttempts publishes is parked, so it stops holding back the rest.
+type outboxRelay struct {
+	logger      *slog.Logger
+	models      *data.Models
+	amqp        *rabbitMQClient
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newOutboxRelay(logger *slog.Logger, models *data.Models, rabbitmq *rabbitMQClient) *outboxRelay {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	relay := &outboxRelay{
+		logger:      logger,
+		models:      models,
+		amqp:        rabbitmq,
+		interval:    time.Duration(getOptionalIntEnv("OUTBOX_POLL_INTERVAL_MS", 1000)) * time.Millisecond,
+		batchSize:   getOptionalIntEnv("OUTBOX_BATCH_SIZE", 100),
+		maxAttempts: getOptionalIntEnv("OUTBOX_MAX_ATTEMPTS", 10),
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	relay.wg.Add(1)
+	go relay.run()
+
+	return relay
+}
+
+// notify asks the relay to poll immediately instead of waiting for the next
+// tick. It never blocks.
+func (r *outboxRelay) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *outboxRelay) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var ch *amqp.Channel
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+
+		if ch == nil || ch.IsClosed() {
+			var err error
+			ch, err = r.openChannel()
+			if err != nil {
+				r.logger.Error("outbox relay could not open channel", "err", err)
+				ch = nil
+				continue
+			}
+		}
+
+		// Keep draining while full batches come back.
+		for {
+			sent, err := r.relayBatch(ch)
+			if err != nil {
+				r.logger.Error("outbox relay failed", "err", err)
+				break
+			}
+			if sent < r.batchSize || r.ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+func (r *outboxRelay) openChannel() (*amqp.Channel, error) {
+	ch, err := r.amqp.Channel(r.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	return ch, nil
+}
+
+// relayBatch publishes one batch of unsent messages and returns how many
+// were sent. Publishing stops at the first failure to preserve ordering,
+// unless the failed message was parked.
+func (r *outboxRelay) relayBatch(ch *amqp.Channel) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sent := 0
+
+	err := r.models.Transact(ctx, func(tx data.Models) error {
+		messages, err := tx.Outbox.ClaimUnsent(ctx, r.batchSize)
+		if err != nil {
+			return err
+		}
+
+		var sentIDs []string
+		for _, msg := range messages {
+			if err := publishOutboxMessage(ctx, ch, msg); err != nil {
+				r.logger.Warn("failed to publish outbox message", "id", msg.ID, "type", msg.MessageType, "attempt", msg.Attempts+1, "err", err)
+
+				dead, markErr := tx.Outbox.MarkFailed(ctx, msg.ID, err.Error(), r.maxAttempts)
+				if markErr != nil {
+					return markErr
+				}
+				if !dead {
+					break
+				}
+
+				r.logger.Error("outbox message parked after failing every attempt", "id", msg.ID, "type", msg.MessageType, "attempts", msg.Attempts+1, "err", err)
+				outboxMessagesDeadTotal.WithLabelValues(msg.MessageType).Inc()
+				continue
+			}
+			sentIDs = append(sentIDs, msg.ID)
+		}
+
+		sent = len(sentIDs)
+		return tx.Outbox.MarkSent(ctx, sentIDs)
+	})
+
+	return sent, err
+}
+
+func publishOutboxMessage(ctx context.Context, ch *amqp.Channel, msg *data.OutboxMessage) (err error) {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+
+	ctx, span := startPublishSpan(ctx, headers, msg.Exchange, msg.MessageID, msg.MessageType)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, msg.Exchange, msg.RoutingKey, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageID,
+		Type:         msg.MessageType,
+		Timestamp:    msg.CreatedAt,
+		Body:         msg.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked message %s", msg.MessageID)
+	}
+
+	return nil
+}
+
+// outboxPurgeBatchSize bounds the rows deleted per statement, so a large
+// backlog does not hold locks for long.
+const outboxPurgeBatchSize = 1000
+
+// purgeSentOutbox periodically deletes outbox messages sent longer ago than
+// the configured retention.
+func (s *service) purgeSentOutbox() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		before := time.Now().Add(-s.config.outboxRetention)
+		purged := int64(0)
+
+		for {
+			deleted, err := s.models.Outbox.DeleteSentBefore(ctx, before, outboxPurgeBatchSize)
+			if err != nil {
+				s.logger.Error("failed to purge sent outbox messages", "err", err)
+				break
+			}
+
+			purged += deleted
+			if deleted < outboxPurgeBatchSize {
+				break
+			}
+		}
+
+		if purged > 0 {
+			s.logger.Info("purged sent outbox messages", "count", purged)
+		}
+	}
+}
+
+func (r *outboxRelay) Shutdown() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// serviceEvent is the envelope for events published on payment_events.
+type serviceEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       any       `json:"data"`
+}
+
+// enqueueServiceEvent writes a service event to the outbox. It must be called
+// with the transaction that performs the state change being announced.
+func enqueueServiceEvent(ctx context.Context, tx data.Models, eventType string, payload any) error {
+	id, err := newEventID()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(serviceEvent{
+		ID:         id,
+		Type:       eventType,
+		OccurredAt: time.Now().UTC(),
+		Data:       payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Outbox.Insert(ctx, &data.OutboxMessage{
+		Exchange:    paymentEventsExchange,
+		RoutingKey:  eventType,
+		MessageID:   id,
+		MessageType: eventType,
+		Headers:     messageHeaders(ctx),
+		Payload:     body,
+	})
+}
+
+// enqueueStripeEvent writes a verified Stripe event to the outbox for the
+// stripe_events exchange.
+func enqueueStripeEvent(ctx context.Context, tx data.Models, eventID, eventType string, payload []byte) error {
+	return tx.Outbox.Insert(ctx, &data.OutboxMessage{
+		Exchange:    stripeEventsExchange,
+		MessageID:   eventID,
+		MessageType: eventType,
+		Headers:     messageHeaders(ctx),
+		Payload:     payload,
+	})
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
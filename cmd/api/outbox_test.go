@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pirasl/payment-service/internal/data"
+)
+
+func TestOutboxParking(t *testing.T) {
+	const maxAttempts = 3
+
+	tests := []struct {
+		name     string
+		failures int
+
+		wantDead    bool
+		wantClaimed []string
+	}{
+		{name: "failing message stays first", failures: 1, wantClaimed: []string{"first", "second"}},
+		{name: "one attempt left", failures: maxAttempts - 1, wantClaimed: []string{"first", "second"}},
+		{name: "parked after the last attempt", failures: maxAttempts, wantDead: true, wantClaimed: []string{"second"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+
+			var first *data.OutboxMessage
+			for _, id := range []string{"first", "second"} {
+				msg := &data.OutboxMessage{
+					Exchange:    paymentEventsExchange,
+					MessageID:   id,
+					MessageType: "payment.created",
+					Payload:     []byte(`{}`),
+				}
+				if err := s.models.Outbox.Insert(t.Context(), msg); err != nil {
+					t.Fatalf("insert %s: %v", id, err)
+				}
+				if first == nil {
+					first = msg
+				}
+			}
+
+			var dead bool
+			for i := 0; i < tt.failures; i++ {
+				var err error
+				dead, err = s.models.Outbox.MarkFailed(t.Context(), first.ID, "unroutable", maxAttempts)
+				if err != nil {
+					t.Fatalf("MarkFailed: %v", err)
+				}
+			}
+			if dead != tt.wantDead {
+				t.Errorf("dead = %v, want %v", dead, tt.wantDead)
+			}
+
+			var claimed []string
+			err := s.models.Transact(t.Context(), func(tx data.Models) error {
+				messages, err := tx.Outbox.ClaimUnsent(t.Context(), 10)
+				for _, msg := range messages {
+					claimed = append(claimed, msg.MessageID)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ClaimUnsent: %v", err)
+			}
+
+			if len(claimed) != len(tt.wantClaimed) {
+				t.Fatalf("claimed %v, want %v", claimed, tt.wantClaimed)
+			}
+			for i := range claimed {
+				if claimed[i] != tt.wantClaimed[i] {
+					t.Errorf("claimed %v, want %v", claimed, tt.wantClaimed)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+// Saved payment methods live at the provider. The payment_methods table is
+// kept in sync from payment_method webhooks, except for the default flag,
+// which only this service sets.
+
+type createSetupIntentInput struct {
+	PaymentMethodTypes []string          `json:"payment_method_types"`
+	Usage              string            `json:"usage"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// createSetupIntentHandler starts saving a payment method without charging
+// it. The client confirms the setup intent with the returned secret and the
+// method is attached to the user's customer, creating the customer if needed.
+func (s *service) createSetupIntentHandler(c *gin.Context) {
+	var input createSetupIntentInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	if len(input.PaymentMethodTypes) == 0 {
+		input.PaymentMethodTypes = []string{"card"}
+	}
+	if input.Usage == "" {
+		input.Usage = "off_session"
+	}
+
+	v := validator.New()
+	if validateCreateSetupIntentInput(v, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	userID := c.GetInt64("userID")
+
+	customer, err := s.customerForUser(c.Request.Context(), userID)
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	metadata := make(map[string]string, len(input.Metadata)+1)
+	for key, value := range input.Metadata {
+		metadata[key] = value
+	}
+	metadata["user_id"] = strconv.FormatInt(userID, 10)
+
+	intent, err := s.paymentProvider.CreateSetupIntent(c.Request.Context(), &provider.CreateSetupIntentParams{
+		CustomerID:         customer.StripeCustomerID,
+		PaymentMethodTypes: input.PaymentMethodTypes,
+		Usage:              input.Usage,
+		Metadata:           metadata,
+		IdempotencyKey:     providerIdempotencyKey(c),
+	})
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	s.logger.InfoContext(c.Request.Context(), "setup intent created", "provider_setup_intent_id", intent.ID)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"setup_intent": gin.H{
+			"id":                   intent.ID,
+			"status":               intent.Status,
+			"usage":                intent.Usage,
+			"payment_method_types": intent.PaymentMethodTypes,
+		},
+		"client_secret": intent.ClientSecret,
+	})
+}
+
+func (s *service) listPaymentMethodsHandler(c *gin.Context) {
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), c.GetInt64("userID"))
+	if err != nil {
+		// A user without a customer has nothing saved.
+		if errors.Is(err, data.ErrRecordNotFound) {
+			c.JSON(http.StatusOK, gin.H{"payment_methods": []*data.PaymentMethod{}})
+			return
+		}
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	paymentMethods, err := s.models.PaymentMethod.GetAllForCustomer(c.Request.Context(), customer.ID)
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment_methods": paymentMethods})
+}
+
+func (s *service) detachPaymentMethodHandler(c *gin.Context) {
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), c.GetInt64("userID"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	paymentMethod, err := s.models.PaymentMethod.GetForCustomer(c.Request.Context(), customer.ID, c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	detached, err := s.paymentProvider.DetachPaymentMethod(c.Request.Context(), paymentMethod.StripePaymentMethodID)
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	// The payment_method.detached webhook does the same; storing it now
+	// hides the method from the list straight away.
+	if err := s.models.PaymentMethod.Upsert(c.Request.Context(), paymentMethodFromProvider(detached)); err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	s.logger.InfoContext(c.Request.Context(), "payment method detached", "payment_method_id", paymentMethod.ID, "customer_id", customer.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "payment method successfully detached"})
+}
+
+func (s *service) setDefaultPaymentMethodHandler(c *gin.Context) {
+	customer, err := s.models.Customer.GetForUser(c.Request.Context(), c.GetInt64("userID"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	paymentMethod, err := s.models.PaymentMethod.GetForCustomer(c.Request.Context(), customer.ID, c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	err = s.models.Transact(c.Request.Context(), func(tx data.Models) error {
+		return tx.PaymentMethod.SetDefault(c.Request.Context(), customer.ID, paymentMethod.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			s.editConflictResponse(c)
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Detached in the meantime.
+			s.notFoundResponse(c)
+		default:
+			s.InternalServerErrorResponse(c, err)
+		}
+		return
+	}
+
+	paymentMethod.IsDefault = true
+
+	c.JSON(http.StatusOK, gin.H{"payment_method": paymentMethod})
+}
+
+func validateCreateSetupIntentInput(v *validator.Validator, input *createSetupIntentInput) {
+	v.Check(validator.PermittedValue(input.Usage, "on_session", "off_session"), "usage", "must be on_session or off_session")
+
+	v.Check(validator.Unique(input.PaymentMethodTypes), "payment_method_types", "must not contain duplicate values")
+	for _, paymentMethodType := range input.PaymentMethodTypes {
+		v.Check(paymentMethodType != "", "payment_method_types", "must not contain empty values")
+	}
+
+	validateMetadata(v, input.Metadata)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+// maxPaymentAmount is the largest amount Stripe accepts, in the smallest
+// currency unit.
+const maxPaymentAmount = 99999999
+
+type createPaymentIntentInput struct {
+	Amount             int64             `json:"amount"`
+	Currency           string            `json:"currency"`
+	CaptureMethod      string            `json:"capture_method"`
+	Description        *string           `json:"description"`
+	ReceiptEmail       *string           `json:"receipt_email"`
+	PaymentMethodTypes []string          `json:"payment_method_types"`
+	SetupFutureUsage   *string           `json:"setup_future_usage"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+func (s *service) createPaymentIntentHandler(c *gin.Context) {
+	var input createPaymentIntentInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	input.setDefaults()
+
+	v := validator.New()
+	if validateCreatePaymentIntentInput(v, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	payment, clientSecret, err := s.createPayment(c.Request.Context(), c.GetInt64("userID"), &input, providerIdempotencyKey(c))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"payment":       payment,
+		"client_secret": clientSecret,
+	})
+}
+
+type capturePaymentInput struct {
+	AmountToCapture *int64 `json:"amount_to_capture"`
+}
+
+func (s *service) capturePaymentHandler(c *gin.Context) {
+	var input capturePaymentInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	payment, err := s.getUserPayment(c.Request.Context(), c.GetInt64("userID"), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	v := validator.New()
+	if validateCapture(v, payment, input.AmountToCapture); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	payment, err = s.capturePayment(c.Request.Context(), payment, input.AmountToCapture, providerIdempotencyKey(c))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": payment})
+}
+
+type cancelPaymentInput struct {
+	CancellationReason *string `json:"cancellation_reason"`
+}
+
+func (s *service) cancelPaymentHandler(c *gin.Context) {
+	var input cancelPaymentInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	payment, err := s.getUserPayment(c.Request.Context(), c.GetInt64("userID"), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	v := validator.New()
+	if validateCancel(v, payment, input.CancellationReason); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	payment, err = s.cancelPayment(c.Request.Context(), payment, input.CancellationReason, providerIdempotencyKey(c))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": payment})
+}
+
+func (input *createPaymentIntentInput) setDefaults() {
+	if input.CaptureMethod == "" {
+		input.CaptureMethod = "automatic"
+	}
+
+	if len(input.PaymentMethodTypes) == 0 {
+		input.PaymentMethodTypes = []string{"card"}
+	}
+}
+
+// createPayment creates a payment intent with the provider for userID, under
+// the user's customer, and records it. It is shared by the HTTP and gRPC
+// APIs and expects validated input.
+func (s *service) createPayment(ctx context.Context, userID int64, input *createPaymentIntentInput, idempotencyKey string) (*data.Payment, string, error) {
+	metadata := make(map[string]string, len(input.Metadata)+1)
+	for key, value := range input.Metadata {
+		metadata[key] = value
+	}
+	metadata["user_id"] = strconv.FormatInt(userID, 10)
+
+	customer, err := s.customerForUser(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	intent, err := s.paymentProvider.CreatePaymentIntent(ctx, &provider.CreatePaymentIntentParams{
+		Amount:             input.Amount,
+		Currency:           input.Currency,
+		CaptureMethod:      input.CaptureMethod,
+		CustomerID:         &customer.StripeCustomerID,
+		Description:        input.Description,
+		ReceiptEmail:       input.ReceiptEmail,
+		PaymentMethodTypes: input.PaymentMethodTypes,
+		SetupFutureUsage:   input.SetupFutureUsage,
+		Metadata:           metadata,
+		IdempotencyKey:     idempotencyKey,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	payment := paymentFromProvider(intent)
+	payment.CustomerID = &customer.ID
+
+	err = s.models.Transact(ctx, func(tx data.Models) error {
+		if err := tx.Payment.Insert(ctx, payment); err != nil {
+			return err
+		}
+		return enqueueServiceEvent(ctx, tx, "payment.created", payment)
+	})
+	switch {
+	case err == nil:
+		paymentIntentsCreatedTotal.WithLabelValues(payment.Currency).Inc()
+	case errors.Is(err, data.ErrDuplicatePaymentIntent):
+		// A retried request got the same intent back from the provider, or
+		// its payment_intent.created webhook was stored first.
+		payment, err = s.models.Payment.GetByStripeID(ctx, intent.ID)
+		if err != nil {
+			return nil, "", err
+		}
+	case err != nil:
+		s.logger.ErrorContext(ctx, "failed to persist payment intent", "provider_payment_id", intent.ID, "err", err)
+		return nil, "", err
+	}
+
+	s.outboxRelay.notify()
+
+	s.logger.InfoContext(ctx, "payment intent created", "payment_id", payment.ID, "provider_payment_id", intent.ID)
+
+	return payment, intent.ClientSecret, nil
+}
+
+// capturePayment captures an authorized payment, in full unless amount is
+// set.
+func (s *service) capturePayment(ctx context.Context, payment *data.Payment, amount *int64, idempotencyKey string) (*data.Payment, error) {
+	intent, err := s.paymentProvider.CapturePaymentIntent(ctx, payment.StripePaymentIntentID, &provider.CapturePaymentIntentParams{
+		AmountToCapture: amount,
+		IdempotencyKey:  idempotencyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.recordPaymentIntent(ctx, intent)
+}
+
+// cancelPayment cancels a payment that has not succeeded yet, releasing any
+// authorization.
+func (s *service) cancelPayment(ctx context.Context, payment *data.Payment, reason *string, idempotencyKey string) (*data.Payment, error) {
+	intent, err := s.paymentProvider.CancelPaymentIntent(ctx, payment.StripePaymentIntentID, &provider.CancelPaymentIntentParams{
+		CancellationReason: reason,
+		IdempotencyKey:     idempotencyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.recordPaymentIntent(ctx, intent)
+}
+
+// recordPaymentIntent stores the provider's view of a payment intent after an
+// API call and returns the stored payment.
+func (s *service) recordPaymentIntent(ctx context.Context, intent *provider.PaymentIntent) (*data.Payment, error) {
+	err := s.models.Transact(ctx, func(tx data.Models) error {
+		return applyPaymentIntent(ctx, tx, paymentFromProvider(intent))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.outboxRelay.notify()
+
+	return s.models.Payment.GetByStripeID(ctx, intent.ID)
+}
+
+// applyPaymentIntent upserts a payment and announces its new status when it
+// changed. Webhooks and API calls both go through it, so each transition is
+// published once whichever is seen first.
+func applyPaymentIntent(ctx context.Context, tx data.Models, payment *data.Payment) error {
+	statusChanged, err := tx.Payment.Upsert(ctx, payment)
+	if err != nil || !statusChanged {
+		return err
+	}
+
+	return enqueueServiceEvent(ctx, tx, "payment."+payment.Status, payment)
+}
+
+func validateCreatePaymentIntentInput(v *validator.Validator, input *createPaymentIntentInput) {
+	v.Check(input.Amount > 0, "amount", "must be greater than zero")
+	v.Check(input.Amount <= maxPaymentAmount, "amount", "must not be more than 99999999")
+
+	v.Check(input.Currency != "", "currency", "must be provided")
+	v.Check(validator.Matches(input.Currency, validator.CurrencyRX), "currency", "must be a lowercase three-letter ISO code")
+
+	v.Check(validator.PermittedValue(input.CaptureMethod, "automatic", "manual"), "capture_method", "must be automatic or manual")
+
+	if input.SetupFutureUsage != nil {
+		v.Check(validator.PermittedValue(*input.SetupFutureUsage, "on_session", "off_session"), "setup_future_usage", "must be on_session or off_session")
+	}
+
+	if input.ReceiptEmail != nil {
+		v.Check(validator.Matches(*input.ReceiptEmail, validator.EmailRX), "receipt_email", "must be a valid email address")
+	}
+
+	if input.Description != nil {
+		v.Check(utf8.RuneCountInString(*input.Description) <= 1000, "description", "must not be more than 1000 characters")
+	}
+
+	v.Check(validator.Unique(input.PaymentMethodTypes), "payment_method_types", "must not contain duplicate values")
+	for _, paymentMethodType := range input.PaymentMethodTypes {
+		v.Check(paymentMethodType != "", "payment_method_types", "must not contain empty values")
+	}
+
+	validateMetadata(v, input.Metadata)
+}
+
+// getUserPayment fetches a payment created for userID. Other users' payments
+// are reported as not found.
+func (s *service) getUserPayment(ctx context.Context, userID int64, id string) (*data.Payment, error) {
+	payment, err := s.models.Payment.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !paymentBelongsTo(payment, userID) {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return payment, nil
+}
+
+// paymentBelongsTo reports whether payment was created for userID.
+func paymentBelongsTo(payment *data.Payment, userID int64) bool {
+	return payment.Metadata["user_id"] == strconv.FormatInt(userID, 10)
+}
+
+// validateCapture checks that payment holds an authorization and that amount,
+// when set, does not exceed it. Capturing less releases the remainder.
+func validateCapture(v *validator.Validator, payment *data.Payment, amount *int64) {
+	v.Check(payment.Status == "requires_capture", "payment", "must be authorized and awaiting capture")
+
+	if amount != nil {
+		v.Check(*amount > 0, "amount_to_capture", "must be greater than zero")
+		v.Check(*amount <= payment.Amount, "amount_to_capture", "must not be more than the authorized amount")
+	}
+}
+
+// validateCancel checks that payment can still be canceled, which releases
+// any authorization hold.
+func validateCancel(v *validator.Validator, payment *data.Payment, reason *string) {
+	v.Check(validator.PermittedValue(payment.Status, "requires_payment_method", "requires_confirmation", "requires_action", "requires_capture", "processing"), "payment", "can no longer be canceled")
+
+	if reason != nil {
+		v.Check(validator.PermittedValue(*reason, "duplicate", "fraudulent", "requested_by_customer", "abandoned"), "cancellation_reason", "must be duplicate, fraudulent, requested_by_customer or abandoned")
+	}
+}
+
+// validateMetadata applies Stripe's metadata limits. user_id is reserved for
+// the service.
+func validateMetadata(v *validator.Validator, metadata map[string]string) {
+	v.Check(len(metadata) < 50, "metadata", "must not contain more than 49 keys")
+	for key, value := range metadata {
+		v.Check(key != "user_id", "metadata", "user_id is a reserved key")
+		v.Check(key != "" && utf8.RuneCountInString(key) <= 40, "metadata", "keys must be between 1 and 40 characters")
+		v.Check(utf8.RuneCountInString(value) <= 500, "metadata", "values must not be more than 500 characters")
+	}
+}
+
+// paymentFromProvider maps a provider payment intent onto the payments table.
+// Provider IDs are stored in the stripe_* columns whichever provider is used.
+func paymentFromProvider(intent *provider.PaymentIntent) *data.Payment {
+	payment := &data.Payment{
+		StripePaymentIntentID: intent.ID,
+		StripeCustomerID:      intent.CustomerID,
+		Amount:                intent.Amount,
+		Currency:              intent.Currency,
+		Status:                intent.Status,
+		Metadata:              intent.Metadata,
+		PaymentMethodTypes:    intent.PaymentMethodTypes,
+		CaptureMethod:         intent.CaptureMethod,
+		ConfirmationMethod:    intent.ConfirmationMethod,
+		ShippingAddress:       intent.Shipping,
+		CanceledAt:            intent.CanceledAt,
+	}
+
+	if intent.ClientSecret != "" {
+		payment.ClientSecret = &intent.ClientSecret
+	}
+	if intent.Description != "" {
+		payment.Description = &intent.Description
+	}
+	if intent.ReceiptEmail != "" {
+		payment.ReceiptEmail = &intent.ReceiptEmail
+	}
+	if intent.PaymentMethodID != "" {
+		payment.PaymentMethodID = &intent.PaymentMethodID
+	}
+	if intent.SetupFutureUsage != "" {
+		payment.SetupFutureUsage = &intent.SetupFutureUsage
+	}
+
+	return payment
+}
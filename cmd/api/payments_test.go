@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreatePaymentIntentHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		failNext bool
+
+		wantCode     int
+		wantPayments int
+	}{
+		{name: "created", wantCode: http.StatusCreated, wantPayments: 1},
+		{name: "provider unreachable", failNext: true, wantCode: http.StatusBadGateway, wantPayments: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := newTestService(t)
+
+			// The customer is created first, so the failure hits the
+			// payment intent.
+			if _, err := s.customerForUser(t.Context(), 1); err != nil {
+				t.Fatalf("create customer: %v", err)
+			}
+			if tt.failNext {
+				fake.FailNext(nil)
+			}
+
+			r := gin.New()
+			r.POST("/payments", func(c *gin.Context) { c.Set("userID", int64(1)) }, s.createPaymentIntentHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(`{"amount": 1000, "currency": "eur"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			var count int
+			if err := s.models.DB.QueryRowContext(t.Context(), `SELECT count(*) FROM payment_intents`).Scan(&count); err != nil {
+				t.Fatalf("count payments: %v", err)
+			}
+			if count != tt.wantPayments {
+				t.Errorf("stored %d payments, want %d", count, tt.wantPayments)
+			}
+
+			if tt.wantCode != http.StatusCreated {
+				return
+			}
+
+			var body struct {
+				Payment struct {
+					StripePaymentIntentID string `json:"stripe_payment_intent_id"`
+					Status                string `json:"status"`
+				} `json:"payment"`
+				ClientSecret string `json:"client_secret"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+
+			intent, err := fake.GetPaymentIntent(t.Context(), body.Payment.StripePaymentIntentID)
+			if err != nil {
+				t.Fatalf("payment intent not created at the provider: %v", err)
+			}
+			if body.Payment.Status != intent.Status {
+				t.Errorf("status = %q, want the provider's %q", body.Payment.Status, intent.Status)
+			}
+			if body.ClientSecret != intent.ClientSecret {
+				t.Errorf("client secret = %q, want %q", body.ClientSecret, intent.ClientSecret)
+			}
+		})
+	}
+}
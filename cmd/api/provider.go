@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pirasl/payment-service/internal/provider"
+)
+
+// newPaymentProvider selects the payment provider from PAYMENT_PROVIDER.
+// "fake" runs entirely in memory and needs no credentials, which is meant for
+// local development and tests only.
+func newPaymentProvider() (provider.PaymentProvider, error) {
+	switch name := getOptionalStringEnv("PAYMENT_PROVIDER", "stripe"); name {
+	case "stripe":
+		apiKey, err := getRequiredStringEnv("STRIPE_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		return provider.NewStripe(*apiKey, tracedHTTPClient()), nil
+	case "fake":
+		return provider.NewFake(), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q, expected stripe or fake", name)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+)
+
+// Reconciliation compares the provider's payment intents, charges and
+// refunds created in a date range with the stored copies and records every
+// discrepancy in reconciliation_findings. With auto-heal, the provider's
+// state is applied the way a webhook would, so the ledger and outbound
+// events catch up too. Intermediate transitions that were missed are not
+// replayed, only the move to the current state.
+
+// reconciliationSkew widens the provider range when looking for stored
+// objects missing at the provider, as rows are created a little after the
+// provider's objects.
+const reconciliationSkew = time.Hour
+
+// fieldDiff is one field whose provider and stored values differ.
+type fieldDiff struct {
+	field         string
+	providerValue string
+	localValue    string
+}
+
+// diffFields returns the fields whose provider and stored values differ.
+func diffFields(fields ...fieldDiff) []fieldDiff {
+	var diffs []fieldDiff
+	for _, f := range fields {
+		if f.providerValue != f.localValue {
+			diffs = append(diffs, f)
+		}
+	}
+	return diffs
+}
+
+// field pairs the provider's and the stored value of a field.
+func field(name string, providerValue, localValue any) fieldDiff {
+	return fieldDiff{field: name, providerValue: fmt.Sprint(providerValue), localValue: fmt.Sprint(localValue)}
+}
+
+// monitorReconciliation runs a reconciliation once a day at the configured
+// UTC hour, over the configured lookback.
+func (s *service) monitorReconciliation() {
+	if s.config.reconciliationHour < 0 {
+		return
+	}
+
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	for {
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), s.config.reconciliationHour, 0, 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		to := time.Now()
+		_, err := s.reconcile(ctx, to.Add(-s.config.reconciliationLookback), to, s.config.reconciliationAutoHeal)
+		if err != nil {
+			s.logger.Error("reconciliation failed", "err", err)
+		}
+	}
+}
+
+// reconcile runs a reconciliation over objects created in [from, to). The
+// run is recorded even when it fails part way.
+func (s *service) reconcile(ctx context.Context, from, to time.Time, autoHeal bool) (*data.ReconciliationRun, error) {
+	run := &data.ReconciliationRun{
+		RangeFrom: from,
+		RangeTo:   to,
+		AutoHeal:  autoHeal,
+	}
+
+	if err := s.models.Reconciliation.InsertRun(ctx, run); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("reconciliation started", "run_id", run.ID, "from", from, "to", to, "auto_heal", autoHeal)
+
+	healed, reconcileErr := s.reconcileObjects(ctx, run)
+
+	run.Status = "completed"
+	if reconcileErr != nil {
+		run.Status = "failed"
+		message := reconcileErr.Error()
+		run.Error = &message
+	}
+
+	if err := s.models.Reconciliation.FinishRun(ctx, run); err != nil {
+		return run, errors.Join(reconcileErr, err)
+	}
+
+	if healed > 0 && s.outboxRelay != nil {
+		s.outboxRelay.notify()
+	}
+
+	s.logger.Info("reconciliation finished", "run_id", run.ID, "status", run.Status, "objects_checked", run.ObjectsChecked, "findings", run.FindingsCount, "healed", healed)
+
+	return run, reconcileErr
+}
+
+// reconcileObjects checks payment intents before charges and refunds, so
+// healed charges and refunds find the payment they belong to.
+func (s *service) reconcileObjects(ctx context.Context, run *data.ReconciliationRun) (healed int, err error) {
+	params := &provider.ListParams{
+		CreatedFrom: run.RangeFrom.Add(-reconciliationSkew),
+		CreatedTo:   run.RangeTo.Add(reconciliationSkew),
+	}
+
+	checks := []struct {
+		objectType string
+		list       func(seen map[string]bool) error
+	}{
+		{"payment_intent", func(seen map[string]bool) error {
+			return s.paymentProvider.ListPaymentIntents(ctx, params, func(intent *provider.PaymentIntent) error {
+				seen[intent.ID] = true
+				run.ObjectsChecked++
+				n, err := s.reconcilePaymentIntent(ctx, run, intent)
+				healed += n
+				return err
+			})
+		}},
+		{"charge", func(seen map[string]bool) error {
+			return s.paymentProvider.ListCharges(ctx, params, func(charge *provider.Charge) error {
+				seen[charge.ID] = true
+				run.ObjectsChecked++
+				n, err := s.reconcileCharge(ctx, run, charge)
+				healed += n
+				return err
+			})
+		}},
+		{"refund", func(seen map[string]bool) error {
+			return s.paymentProvider.ListRefunds(ctx, params, func(refund *provider.Refund) error {
+				seen[refund.ID] = true
+				run.ObjectsChecked++
+				n, err := s.reconcileRefund(ctx, run, refund)
+				healed += n
+				return err
+			})
+		}},
+	}
+
+	for _, check := range checks {
+		seen := make(map[string]bool)
+
+		if err := check.list(seen); err != nil {
+			return healed, fmt.Errorf("reconcile %s: %w", check.objectType, err)
+		}
+
+		ids, err := s.models.Reconciliation.GetStripeIDsCreatedBetween(ctx, check.objectType, run.RangeFrom, run.RangeTo)
+		if err != nil {
+			return healed, fmt.Errorf("reconcile %s: %w", check.objectType, err)
+		}
+
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			if err := s.recordFinding(ctx, run, check.objectType, id, "missing_at_provider", fieldDiff{}, false, nil); err != nil {
+				return healed, err
+			}
+		}
+	}
+
+	return healed, nil
+}
+
+func (s *service) reconcilePaymentIntent(ctx context.Context, run *data.ReconciliationRun, intent *provider.PaymentIntent) (int, error) {
+	compare := func(m data.Models) (bool, []fieldDiff, error) {
+		local, err := m.Payment.GetByStripeID(ctx, intent.ID)
+		if err != nil {
+			return errors.Is(err, data.ErrRecordNotFound), nil, ignoreNotFound(err)
+		}
+
+		return false, diffFields(
+			field("amount", intent.Amount, local.Amount),
+			field("currency", intent.Currency, local.Currency),
+			field("status", intent.Status, local.Status),
+		), nil
+	}
+
+	return s.settleDiscrepancies(ctx, run, "payment_intent", intent.ID, compare, func(tx data.Models) error {
+		return applyPaymentIntent(ctx, tx, paymentFromProvider(intent))
+	})
+}
+
+func (s *service) reconcileCharge(ctx context.Context, run *data.ReconciliationRun, charge *provider.Charge) (int, error) {
+	compare := func(m data.Models) (bool, []fieldDiff, error) {
+		local, err := m.Charge.GetByStripeID(ctx, charge.ID)
+		if err != nil {
+			return errors.Is(err, data.ErrRecordNotFound), nil, ignoreNotFound(err)
+		}
+
+		return false, diffFields(
+			field("amount", charge.Amount, local.Amount),
+			field("amount_captured", charge.AmountCaptured, local.AmountCaptured),
+			field("amount_refunded", charge.AmountRefunded, local.AmountRefunded),
+			field("status", charge.Status, local.Status),
+			field("captured", charge.Captured, local.Captured),
+			field("refunded", charge.Refunded, local.Refunded),
+			field("disputed", charge.Disputed, local.Disputed),
+		), nil
+	}
+
+	return s.settleDiscrepancies(ctx, run, "charge", charge.ID, compare, func(tx data.Models) error {
+		healed := chargeFromProvider(charge)
+
+		local, err := tx.Charge.GetByStripeID(ctx, charge.ID)
+		switch {
+		case err == nil:
+			// The list only carries the compared fields; keep the stored
+			// details the webhooks filled in.
+			healed = local
+			healed.Amount = charge.Amount
+			healed.AmountCaptured = charge.AmountCaptured
+			healed.AmountRefunded = charge.AmountRefunded
+			healed.Status = charge.Status
+			healed.Paid = charge.Paid
+			healed.Captured = charge.Captured
+			healed.Refunded = charge.Refunded
+			healed.Disputed = charge.Disputed
+			healed.StripePaymentIntentID = charge.PaymentIntentID
+			if charge.BalanceTransactionID != "" {
+				healed.BalanceTransactionID = &charge.BalanceTransactionID
+			}
+		case !errors.Is(err, data.ErrRecordNotFound):
+			return err
+		}
+
+		return applyCharge(ctx, tx, healed)
+	})
+}
+
+func (s *service) reconcileRefund(ctx context.Context, run *data.ReconciliationRun, refund *provider.Refund) (int, error) {
+	compare := func(m data.Models) (bool, []fieldDiff, error) {
+		local, err := m.Refund.GetByStripeID(ctx, refund.ID)
+		if err != nil {
+			return errors.Is(err, data.ErrRecordNotFound), nil, ignoreNotFound(err)
+		}
+
+		return false, diffFields(
+			field("amount", refund.Amount, local.Amount),
+			field("status", refund.Status, local.Status),
+		), nil
+	}
+
+	return s.settleDiscrepancies(ctx, run, "refund", refund.ID, compare, func(tx data.Models) error {
+		return applyRefund(ctx, tx, refundFromProvider(refund))
+	})
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+// errNotHealed is recorded on findings that healing did not resolve, e.g.
+// when an upsert guard kept the stored row from moving backwards.
+var errNotHealed = errors.New("stored row still differs from the provider after healing")
+
+// compareFunc reports whether the object is missing from m, or the fields
+// in which the stored row differs from the provider's object.
+type compareFunc func(m data.Models) (missing bool, diffs []fieldDiff, err error)
+
+// settleDiscrepancies records an object missing locally or its mismatched
+// fields, healing it first when the run auto-heals. The object is compared
+// again after healing, in the same transaction, and a finding is only
+// marked healed once the stored row matches. It returns 1 when the object
+// was healed.
+func (s *service) settleDiscrepancies(ctx context.Context, run *data.ReconciliationRun, objectType, id string, compare compareFunc, heal func(tx data.Models) error) (int, error) {
+	missing, diffs, err := compare(*s.models)
+	if err != nil {
+		return 0, err
+	}
+
+	if !missing && len(diffs) == 0 {
+		return 0, nil
+	}
+
+	var healErr error
+	stillMissing := missing
+	unresolved := make(map[string]bool)
+
+	if run.AutoHeal {
+		healErr = s.models.Transact(ctx, func(tx data.Models) error {
+			if err := heal(tx); err != nil {
+				return err
+			}
+
+			var remaining []fieldDiff
+			var err error
+			stillMissing, remaining, err = compare(tx)
+			if err != nil {
+				return err
+			}
+
+			for _, diff := range remaining {
+				unresolved[diff.field] = true
+			}
+			return nil
+		})
+		if healErr != nil {
+			s.logger.Error("failed to heal reconciliation finding", "run_id", run.ID, "object_type", objectType, "provider_object_id", id, "err", healErr)
+		}
+	}
+
+	// outcome returns whether a finding was healed, or why it was not.
+	outcome := func(resolved bool) (bool, error) {
+		switch {
+		case !run.AutoHeal:
+			return false, nil
+		case healErr != nil:
+			return false, healErr
+		case !resolved:
+			return false, errNotHealed
+		}
+		return true, nil
+	}
+
+	healed := 0
+	if run.AutoHeal && healErr == nil && !stillMissing && len(unresolved) == 0 {
+		healed = 1
+	}
+
+	if missing {
+		ok, findingErr := outcome(!stillMissing && len(unresolved) == 0)
+		return healed, s.recordFinding(ctx, run, objectType, id, "missing_locally", fieldDiff{}, ok, findingErr)
+	}
+
+	for _, diff := range diffs {
+		ok, findingErr := outcome(!stillMissing && !unresolved[diff.field])
+		if err := s.recordFinding(ctx, run, objectType, id, "mismatch", diff, ok, findingErr); err != nil {
+			return healed, err
+		}
+	}
+
+	return healed, nil
+}
+
+// recordFinding stores a finding. healed marks it as resolved by the run;
+// healErr records why an attempted heal did not resolve it.
+func (s *service) recordFinding(ctx context.Context, run *data.ReconciliationRun, objectType, id, kind string, diff fieldDiff, healed bool, healErr error) error {
+	finding := &data.ReconciliationFinding{
+		RunID:          run.ID,
+		ObjectType:     objectType,
+		StripeObjectID: id,
+		Kind:           kind,
+	}
+
+	if diff.field != "" {
+		finding.Field = &diff.field
+		finding.ProviderValue = &diff.providerValue
+		finding.LocalValue = &diff.localValue
+	}
+
+	switch {
+	case healErr != nil:
+		message := healErr.Error()
+		finding.HealError = &message
+	case healed:
+		now := time.Now()
+		finding.HealedAt = &now
+	}
+
+	if err := s.models.Reconciliation.InsertFinding(ctx, finding); err != nil {
+		return err
+	}
+
+	run.FindingsCount++
+
+	s.logger.Warn("reconciliation finding", "run_id", run.ID, "object_type", objectType, "provider_object_id", id, "kind", kind, "field", diff.field)
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/provider"
+)
+
+// testFinding is the part of a stored reconciliation finding the tests
+// compare.
+type testFinding struct {
+	objectType string
+	kind       string
+	field      string
+	healed     bool
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name     string
+		autoHeal bool
+
+		// setup leaves the provider and the database out of step and
+		// returns the payment intent to look at.
+		setup func(t *testing.T, s *service, fake *provider.Fake) string
+
+		wantFindings []testFinding
+		wantStatus   string
+	}{
+		{
+			name: "missing locally",
+			setup: func(t *testing.T, s *service, fake *provider.Fake) string {
+				return createTestIntent(t, fake, true).ID
+			},
+			wantFindings: []testFinding{
+				{objectType: "payment_intent", kind: "missing_locally"},
+				{objectType: "charge", kind: "missing_locally"},
+			},
+		},
+		{
+			name: "missing at provider",
+			setup: func(t *testing.T, s *service, fake *provider.Fake) string {
+				intent := createTestIntent(t, fake, false)
+				recordTestIntent(t, s, intent)
+
+				s.paymentProvider = provider.NewFake()
+				return intent.ID
+			},
+			wantFindings: []testFinding{
+				{objectType: "payment_intent", kind: "missing_at_provider"},
+			},
+			wantStatus: "requires_confirmation",
+		},
+		{
+			name: "field mismatch",
+			setup: func(t *testing.T, s *service, fake *provider.Fake) string {
+				intent := createTestIntent(t, fake, false)
+				recordTestIntent(t, s, intent)
+				confirmTestIntent(t, fake, intent.ID)
+				return intent.ID
+			},
+			wantFindings: []testFinding{
+				{objectType: "charge", kind: "missing_locally"},
+				{objectType: "payment_intent", kind: "mismatch", field: "status"},
+			},
+			wantStatus: "requires_confirmation",
+		},
+		{
+			name:     "auto-heal applies the provider state",
+			autoHeal: true,
+			setup: func(t *testing.T, s *service, fake *provider.Fake) string {
+				intent := createTestIntent(t, fake, false)
+				recordTestIntent(t, s, intent)
+				confirmTestIntent(t, fake, intent.ID)
+				return intent.ID
+			},
+			wantFindings: []testFinding{
+				{objectType: "charge", kind: "missing_locally", healed: true},
+				{objectType: "payment_intent", kind: "mismatch", field: "status", healed: true},
+			},
+			wantStatus: "succeeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := newTestService(t)
+
+			id := tt.setup(t, s, fake)
+
+			now := time.Now()
+			run, err := s.reconcile(t.Context(), now.Add(-time.Hour), now.Add(time.Hour), tt.autoHeal)
+			if err != nil {
+				t.Fatalf("reconcile: %v", err)
+			}
+			if run.Status != "completed" {
+				t.Errorf("run status = %q, want completed", run.Status)
+			}
+
+			findings := getTestFindings(t, s, run.ID)
+			if len(findings) != len(tt.wantFindings) {
+				t.Fatalf("findings = %+v, want %+v", findings, tt.wantFindings)
+			}
+			for i, want := range tt.wantFindings {
+				if findings[i] != want {
+					t.Errorf("finding %d = %+v, want %+v", i, findings[i], want)
+				}
+			}
+			if run.FindingsCount != len(tt.wantFindings) {
+				t.Errorf("run counted %d findings, want %d", run.FindingsCount, len(tt.wantFindings))
+			}
+
+			if tt.wantStatus == "" {
+				return
+			}
+
+			payment, err := s.models.Payment.GetByStripeID(t.Context(), id)
+			if err != nil {
+				t.Fatalf("get payment: %v", err)
+			}
+			if payment.Status != tt.wantStatus {
+				t.Errorf("stored status = %q, want %q", payment.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// createTestIntent creates a payment intent for the test visa card at the
+// fake provider, confirmed or not.
+func createTestIntent(t *testing.T, fake *provider.Fake, confirm bool) *provider.PaymentIntent {
+	t.Helper()
+
+	card := provider.FakeCardVisa
+	intent, err := fake.CreatePaymentIntent(t.Context(), &provider.CreatePaymentIntentParams{
+		Amount:          1000,
+		Currency:        "eur",
+		PaymentMethodID: &card,
+		Confirm:         confirm,
+	})
+	if err != nil {
+		t.Fatalf("create payment intent: %v", err)
+	}
+
+	return intent
+}
+
+func confirmTestIntent(t *testing.T, fake *provider.Fake, id string) {
+	t.Helper()
+
+	if _, err := fake.ConfirmPaymentIntent(t.Context(), id, &provider.ConfirmPaymentIntentParams{}); err != nil {
+		t.Fatalf("confirm payment intent: %v", err)
+	}
+}
+
+func recordTestIntent(t *testing.T, s *service, intent *provider.PaymentIntent) {
+	t.Helper()
+
+	if _, err := s.recordPaymentIntent(t.Context(), intent); err != nil {
+		t.Fatalf("record payment intent: %v", err)
+	}
+}
+
+// getTestFindings returns the findings of a run, ordered by object type.
+func getTestFindings(t *testing.T, s *service, runID string) []testFinding {
+	t.Helper()
+
+	rows, err := s.models.DB.QueryContext(t.Context(), `
+		SELECT object_type, kind, field, healed_at IS NOT NULL, heal_error
+		FROM reconciliation_findings
+		WHERE run_id = $1
+		ORDER BY object_type, kind, field`, runID)
+	if err != nil {
+		t.Fatalf("get findings: %v", err)
+	}
+	defer rows.Close()
+
+	var findings []testFinding
+
+	for rows.Next() {
+		var f testFinding
+		var field, healError sql.NullString
+		if err := rows.Scan(&f.objectType, &f.kind, &field, &f.healed, &healError); err != nil {
+			t.Fatalf("scan finding: %v", err)
+		}
+		if healError.Valid {
+			t.Errorf("%s %s finding has heal error %q", f.objectType, f.kind, healError.String)
+		}
+		f.field = field.String
+		findings = append(findings, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatalf("get findings: %v", err)
+	}
+
+	return findings
+}
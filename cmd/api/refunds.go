@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/provider"
+	"github.com/pirasl/payment-service/internal/validator"
+)
+
+type createRefundInput struct {
+	Amount   *int64            `json:"amount"`
+	Reason   *string           `json:"reason"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (s *service) createRefundHandler(c *gin.Context) {
+	var input createRefundInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	v := validator.New()
+	if validateCreateRefundInput(v, &input); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	payment, err := s.getUserPayment(c.Request.Context(), c.GetInt64("userID"), c.Param("id"))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	if err := s.checkRefundable(c.Request.Context(), v, payment, input.Amount); err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+	if !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	refund, err := s.createRefund(c.Request.Context(), payment, &input, providerIdempotencyKey(c))
+	if err != nil {
+		s.paymentOperationErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"refund": refund})
+}
+
+func validateCreateRefundInput(v *validator.Validator, input *createRefundInput) {
+	if input.Amount != nil {
+		v.Check(*input.Amount > 0, "amount", "must be greater than zero")
+		v.Check(*input.Amount <= maxPaymentAmount, "amount", "must not be more than 99999999")
+	}
+
+	if input.Reason != nil {
+		v.Check(validator.PermittedValue(*input.Reason, "duplicate", "fraudulent", "requested_by_customer"), "reason", "must be duplicate, fraudulent or requested_by_customer")
+	}
+
+	validateMetadata(v, input.Metadata)
+}
+
+// checkRefundable records a validation error on v when payment has no
+// captured charge or amount exceeds what is left to refund. Concurrent
+// refunds can still race past it; the provider rejects those.
+func (s *service) checkRefundable(ctx context.Context, v *validator.Validator, payment *data.Payment, amount *int64) error {
+	refundable, err := s.models.Charge.RefundableAmount(ctx, payment.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			v.AddError("payment", "has no captured charge to refund")
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case refundable <= 0:
+		v.AddError("payment", "has already been fully refunded")
+	case amount != nil && *amount > refundable:
+		v.AddError("amount", fmt.Sprintf("must not be more than the refundable amount of %d", refundable))
+	}
+
+	return nil
+}
+
+// createRefund refunds a succeeded payment, in full unless an amount is
+// given, and records the refund. Callers check the amount with
+// checkRefundable first.
+func (s *service) createRefund(ctx context.Context, payment *data.Payment, input *createRefundInput, idempotencyKey string) (*data.Refund, error) {
+	providerRefund, err := s.paymentProvider.CreateRefund(ctx, &provider.CreateRefundParams{
+		PaymentIntentID: payment.StripePaymentIntentID,
+		Amount:          input.Amount,
+		Reason:          input.Reason,
+		Metadata:        input.Metadata,
+		IdempotencyKey:  idempotencyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refund := refundFromProvider(providerRefund)
+
+	err = s.models.Transact(ctx, func(tx data.Models) error {
+		return applyRefund(ctx, tx, refund)
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "failed to persist refund", "provider_refund_id", providerRefund.ID, "err", err)
+		return nil, err
+	}
+
+	s.outboxRelay.notify()
+
+	s.logger.InfoContext(ctx, "refund created", "refund_id", refund.ID, "payment_id", payment.ID, "amount", refund.Amount)
+
+	return refund, nil
+}
+
+// applyRefund upserts a refund and announces its new status, e.g.
+// refund.pending or refund.failed, when it changed. Like applyPaymentIntent it
+// is shared by API calls and webhooks.
+func applyRefund(ctx context.Context, tx data.Models, refund *data.Refund) error {
+	statusChanged, err := tx.Refund.Upsert(ctx, refund)
+	if err != nil || !statusChanged {
+		return err
+	}
+
+	if err := postRefund(ctx, tx, refund); err != nil {
+		return err
+	}
+
+	return enqueueServiceEvent(ctx, tx, "refund."+refund.Status, refund)
+}
+
+func refundFromProvider(refund *provider.Refund) *data.Refund {
+	r := &data.Refund{
+		StripeRefundID:        refund.ID,
+		StripeChargeID:        refund.ChargeID,
+		StripePaymentIntentID: refund.PaymentIntentID,
+		Amount:                refund.Amount,
+		Currency:              refund.Currency,
+		Status:                refund.Status,
+		Metadata:              refund.Metadata,
+	}
+
+	// Reasons set by the provider itself are not allowed by
+	// chk_refunds_reason_valid.
+	switch reason := refund.Reason; reason {
+	case "duplicate", "fraudulent", "requested_by_customer":
+		r.Reason = &reason
+	}
+	if refund.FailureReason != "" {
+		r.FailureReason = &refund.FailureReason
+	}
+
+	return r
+}
@@ -7,16 +7,42 @@ import (
 )
 
 func (s *service) routes() http.Handler {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(s.requestID(), s.logRequest(), s.recoverPanic(), s.instrument(), s.traceRoute())
 
 	r.Use(func(c *gin.Context) {
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(8<<20))
 		c.Next()
 	})
 	r.GET("/healthcheck", s.healthCheckHandler)
+	r.GET("/livez", s.livenessHandler)
+	r.GET("/readyz", s.readinessHandler)
 
 	rv1 := r.Group("/stripe/v1")
-	rv1.POST("/create-payment-intent", s.createPaymentIntentHandler)
+	rv1.POST("/create-payment-intent", s.authenticate(), s.idempotent(), s.createPaymentIntentHandler)
+	rv1.POST("/payments/:id/capture", s.authenticate(), s.idempotent(), s.capturePaymentHandler)
+	rv1.POST("/payments/:id/cancel", s.authenticate(), s.idempotent(), s.cancelPaymentHandler)
+	rv1.POST("/payments/:id/refunds", s.authenticate(), s.idempotent(), s.createRefundHandler)
+
+	rv1.GET("/customers/me", s.authenticate(), s.showCustomerHandler)
+	rv1.POST("/customers/me", s.authenticate(), s.idempotent(), s.createCustomerHandler)
+	rv1.PATCH("/customers/me", s.authenticate(), s.idempotent(), s.updateCustomerHandler)
+	rv1.DELETE("/customers/me", s.authenticate(), s.idempotent(), s.deleteCustomerHandler)
+
+	rv1.POST("/customers/me/setup-intents", s.authenticate(), s.idempotent(), s.createSetupIntentHandler)
+	rv1.GET("/customers/me/payment-methods", s.authenticate(), s.listPaymentMethodsHandler)
+	rv1.DELETE("/customers/me/payment-methods/:id", s.authenticate(), s.idempotent(), s.detachPaymentMethodHandler)
+	rv1.PUT("/customers/me/payment-methods/:id/default", s.authenticate(), s.idempotent(), s.setDefaultPaymentMethodHandler)
+
+	rv1.GET("/disputes", s.authenticate(), s.requirePermission("disputes:read"), s.listDisputesHandler)
+	rv1.GET("/disputes/:id", s.authenticate(), s.requirePermission("disputes:read"), s.showDisputeHandler)
+	rv1.POST("/disputes/:id/evidence", s.authenticate(), s.requirePermission("disputes:write"), s.idempotent(), s.submitDisputeEvidenceHandler)
+	rv1.POST("/disputes/:id/evidence/files", s.authenticate(), s.requirePermission("disputes:write"), s.idempotent(), s.uploadDisputeEvidenceFileHandler)
+
+	rv1.GET("/ledger/balances", s.authenticate(), s.requirePermission("ledger:read"), s.showLedgerBalancesHandler)
+
+	rv1.POST("/webhook-events/replay", s.authenticate(), s.requirePermission("webhooks:write"), s.replayWebhookEventsHandler)
+	rv1.POST("/webhook-events/:id/replay", s.authenticate(), s.requirePermission("webhooks:write"), s.replayWebhookEventHandler)
 
 	rv1.POST("/webhook", s.webhookHandler)
 
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -9,6 +8,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 type jwtConfig struct {
@@ -27,12 +28,22 @@ func (s *service) serve() error {
 
 	server := &http.Server{
 		Addr:         addr,
-		Handler:      s.routes(),
+		Handler:      otelhttp.NewHandler(s.routes(), "http.server"),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 
+	admin := s.adminServer()
+
+	go func() {
+		s.logger.Info("starting admin server", "addr", admin.Addr)
+		if err := admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("admin server failed", "addr", admin.Addr, "err", err)
+		}
+	}()
+
+	lifecycle := s.newLifecycle(server, admin)
 	shutdownError := make(chan error)
 
 	go func() {
@@ -42,25 +53,7 @@ func (s *service) serve() error {
 
 		s.logger.Info("caught signal", "signal", sign.String())
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		err := server.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
-		}
-
-		s.logger.Info("completing background tasks", "addr", server.Addr)
-
-		s.logger.Info("closing RabbitMQ connection")
-		s.rabbitmqClient.channel.Close()
-		s.rabbitmqClient.conn.Close()
-
-		s.logger.Info("closing workerpool")
-		s.workerPool.Shutdown()
-
-		s.wg.Wait()
-		shutdownError <- nil
+		shutdownError <- lifecycle.shutdown()
 	}()
 
 	s.logger.Info("starting server", "addr", server.Addr)
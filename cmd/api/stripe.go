@@ -1,8 +1,23 @@
 package main
 
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+// stripeConfig holds what the webhook endpoint needs to verify Stripe
+// events. API calls go through the PaymentProvider instead.
 type stripeConfig struct {
 	webhookSecret string
-	apiKey        string
+
+	// previousWebhookSecrets are still accepted after the endpoint secret has
+	// been rolled in the Stripe dashboard, until the old secret expires.
+	previousWebhookSecrets []string
+	webhookTolerance       time.Duration
 }
 
 func newStripeConfig() (*stripeConfig, error) {
@@ -11,13 +26,49 @@ func newStripeConfig() (*stripeConfig, error) {
 		return nil, err
 	}
 
-	apiKey, err := getRequiredStringEnv("STRIPE_API_KEY")
-	if err != nil {
-		return nil, err
+	var previousSecrets []string
+	for _, secret := range strings.Split(getOptionalStringEnv("STRIPE_WEBHOOK_PREVIOUS_SECRETS", ""), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			previousSecrets = append(previousSecrets, secret)
+		}
 	}
 
+	tolerance := getOptionalIntEnv("STRIPE_WEBHOOK_TOLERANCE", int(webhook.DefaultTolerance/time.Second))
+
 	return &stripeConfig{
-		webhookSecret: *webhookSecret,
-		apiKey:        *apiKey,
+		webhookSecret:          *webhookSecret,
+		previousWebhookSecrets: previousSecrets,
+		webhookTolerance:       time.Duration(tolerance) * time.Second,
 	}, nil
 }
+
+// constructEvent verifies the Stripe-Signature header against the current
+// webhook secret and then any previous ones. Every v1 signature in the header
+// is checked, so events signed during a secret roll are accepted.
+func (sc *stripeConfig) constructEvent(payload []byte, signature string) (stripe.Event, error) {
+	opts := webhook.ConstructEventOptions{
+		Tolerance: sc.webhookTolerance,
+		// Events are stored raw and decoded by the workers, so an endpoint
+		// pinned to another API version must not be rejected here.
+		IgnoreAPIVersionMismatch: true,
+	}
+
+	secrets := append([]string{sc.webhookSecret}, sc.previousWebhookSecrets...)
+
+	var event stripe.Event
+	var err error
+	for _, secret := range secrets {
+		event, err = webhook.ConstructEventWithOptions(payload, signature, secret, opts)
+		if err == nil {
+			return event, nil
+		}
+
+		// A stale timestamp or an unreadable header will not get better
+		// with a different secret.
+		if !errors.Is(err, webhook.ErrNoValidSignature) {
+			return event, err
+		}
+	}
+
+	return event, err
+}
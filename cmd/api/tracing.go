@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A payment is traced from the HTTP or gRPC call through the provider and
+// Postgres, and a webhook through stripe_events into the worker that applies
+// it. Messages are published by the outbox relay long after the request
+// that wrote them, so the trace context travels in the outbox row's headers
+// and from there in the AMQP message headers.
+
+// tracer creates the spans the instrumentation libraries don't.
+var tracer = otel.Tracer("github.com/pirasl/payment-service")
+
+// setupTracing installs the global tracer provider and W3C trace context
+// propagator. OTEL_TRACES_EXPORTER selects otlp, stdout or none; the OTLP
+// exporter and the sampler are configured by the standard OTEL_* variables.
+// The returned function flushes and stops the provider.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch name := getOptionalStringEnv("OTEL_TRACES_EXPORTER", "none"); name {
+	case "otlp":
+		exporter, err = otlptracegrpc.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, expected otlp, stdout or none", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("payment-service")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// tracedHTTPClient returns an HTTP client whose requests are traced, for
+// calls to the payment provider.
+func tracedHTTPClient() *http.Client {
+	return &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+}
+
+// traceRoute names the span started by otelhttp after the matched route, as
+// the route is only known once gin has routed the request.
+func (s *service) traceRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+
+		span := trace.SpanFromContext(c.Request.Context())
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
+}
+
+// messageHeaders returns the trace context and request ID of ctx as message
+// headers, to be stored with an outbox message.
+func messageHeaders(ctx context.Context) map[string]string {
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	if requestID, ok := contextRequestID(ctx); ok {
+		headers[requestIDHeader] = requestID
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// amqpHeaderCarrier adapts AMQP message headers to a propagation carrier.
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startPublishSpan starts the span of a message published by the outbox
+// relay, as a child of the trace stored with the message, and writes its
+// context into the AMQP headers.
+func startPublishSpan(ctx context.Context, headers amqp.Table, exchange, messageID, messageType string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, amqpHeaderCarrier(headers))
+
+	ctx, span := tracer.Start(ctx, "publish "+exchange,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitMQ,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingOperationName("publish"),
+			semconv.MessagingMessageID(messageID),
+			attribute.String("message.type", messageType),
+		),
+	)
+
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaderCarrier(headers))
+
+	return ctx, span
+}
+
+// startProcessSpan starts the span of a worker processing a delivery, as a
+// child of the span that published it.
+func startProcessSpan(ctx context.Context, msg amqp.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, amqpHeaderCarrier(msg.Headers))
+
+	return tracer.Start(ctx, "process "+stripeProcessingQueue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitMQ,
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingDestinationName(stripeProcessingQueue),
+			semconv.MessagingOperationName("process"),
+			semconv.MessagingMessageID(msg.MessageId),
+			attribute.String("message.type", msg.Type),
+		),
+	)
+}
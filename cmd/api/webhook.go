@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// webhookHandler verifies and persists incoming Stripe events. The
+// webhook_events row and the outbox message that hands the event to the
+// workers are written in one transaction, so an event is never stored
+// without being published or published without being stored.
+func (s *service) webhookHandler(c *gin.Context) {
+	webhooksReceivedTotal.Inc()
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			webhooksRejectedTotal.WithLabelValues("too_large").Inc()
+			s.badRequestResponse(c, "body must not be larger than 8MB")
+			return
+		}
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	event, err := s.stripeClient.constructEvent(payload, c.GetHeader("Stripe-Signature"))
+	if err != nil {
+		webhooksRejectedTotal.WithLabelValues("invalid_signature").Inc()
+		s.logger.WarnContext(c.Request.Context(), "rejected stripe webhook", "err", err)
+		s.invalidWebhookSignatureResponse(c)
+		return
+	}
+
+	webhooksVerifiedTotal.WithLabelValues(string(event.Type)).Inc()
+
+	webhookEvent := newWebhookEvent(&event, payload)
+
+	err = s.models.Transact(c.Request.Context(), func(tx data.Models) error {
+		if err := tx.WebhookEvent.Insert(c.Request.Context(), webhookEvent); err != nil {
+			return err
+		}
+
+		return enqueueStripeEvent(c.Request.Context(), tx, event.ID, string(event.Type), payload)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEvent):
+			s.logger.InfoContext(c.Request.Context(), "duplicate stripe webhook ignored", "event_id", event.ID, "type", event.Type)
+			c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		default:
+			s.logger.ErrorContext(c.Request.Context(), "failed to store stripe webhook", "event_id", event.ID, "type", event.Type, "err", err)
+			s.InternalServerErrorResponse(c, err)
+		}
+		return
+	}
+
+	s.outboxRelay.notify()
+
+	s.logger.InfoContext(c.Request.Context(), "stripe webhook received", "event_id", event.ID, "type", event.Type)
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+func newWebhookEvent(event *stripe.Event, payload []byte) *data.WebhookEvent {
+	webhookEvent := &data.WebhookEvent{
+		StripeEventID:   event.ID,
+		EventType:       string(event.Type),
+		Livemode:        event.Livemode,
+		PendingWebhooks: event.PendingWebhooks,
+		EventData:       payload,
+	}
+
+	if event.APIVersion != "" {
+		webhookEvent.APIVersion = &event.APIVersion
+	}
+
+	if event.Data != nil {
+		if id, ok := event.Data.Object["id"].(string); ok && id != "" {
+			webhookEvent.ObjectID = &id
+		}
+	}
+
+	if event.Request != nil && event.Request.ID != "" {
+		webhookEvent.RequestID = &event.Request.ID
+	}
+
+	return webhookEvent
+}
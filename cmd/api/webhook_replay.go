@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pirasl/payment-service/internal/data"
+	"github.com/pirasl/payment-service/internal/validator"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Stored webhook events can be published again on stripe_events, e.g. after
+// deploying a fix for a handler that failed or applied them wrongly. A
+// replay clears the processed flag so the workers run the handler again;
+// handlers are idempotent, so replaying an applied event only catches up
+// what changed. A dry run runs the handlers in a transaction that is rolled
+// back and reports the outcome instead.
+
+const (
+	defaultReplayLimit = 100
+	maxReplayLimit     = 1000
+)
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// webhookReplay reports a stored event selected for replay, as it was before
+// the replay. Handled, HandlerError and Events are only set by dry runs.
+type webhookReplay struct {
+	StripeEventID string     `json:"stripe_event_id"`
+	EventType     string     `json:"event_type"`
+	Processed     bool       `json:"processed"`
+	ProcessedAt   *time.Time `json:"processed_at"`
+	ErrorMessage  *string    `json:"error_message"`
+	ReplayCount   int        `json:"replay_count"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Replayed      bool       `json:"replayed"`
+	Handled       *bool      `json:"handled,omitempty"`
+	HandlerError  *string    `json:"handler_error,omitempty"`
+	Events        []string   `json:"events,omitempty"`
+}
+
+type replayWebhookEventInput struct {
+	DryRun bool `json:"dry_run"`
+}
+
+type replayWebhookEventsInput struct {
+	Failed    bool       `json:"failed"`
+	EventType string     `json:"event_type"`
+	From      *time.Time `json:"from"`
+	To        *time.Time `json:"to"`
+	Limit     int        `json:"limit"`
+	DryRun    bool       `json:"dry_run"`
+}
+
+// replayWebhookEventHandler replays a single event by its provider ID. The
+// body is optional.
+func (s *service) replayWebhookEventHandler(c *gin.Context) {
+	var input replayWebhookEventInput
+
+	if c.Request.ContentLength != 0 {
+		if err := s.readJSON(c, &input); err != nil {
+			s.badRequestResponse(c, err.Error())
+			return
+		}
+	}
+
+	filter := data.WebhookEventFilter{StripeEventID: c.Param("id"), Limit: 1}
+
+	replays, err := s.replayWebhookEvents(c.Request.Context(), filter, input.DryRun)
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	if len(replays) == 0 {
+		s.notFoundResponse(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dry_run": input.DryRun, "event": replays[0]})
+}
+
+// replayWebhookEventsHandler replays all failed events, or all events of a
+// type created in [from, to), oldest first.
+func (s *service) replayWebhookEventsHandler(c *gin.Context) {
+	var input replayWebhookEventsInput
+
+	if err := s.readJSON(c, &input); err != nil {
+		s.badRequestResponse(c, err.Error())
+		return
+	}
+
+	if input.Limit == 0 {
+		input.Limit = defaultReplayLimit
+	}
+
+	filter := data.WebhookEventFilter{
+		EventType:  input.EventType,
+		FailedOnly: input.Failed,
+		From:       input.From,
+		To:         input.To,
+		Limit:      input.Limit,
+	}
+
+	v := validator.New()
+	if validateWebhookReplay(v, filter); !v.Valid() {
+		s.failedValidationResponse(c, v.Errors)
+		return
+	}
+
+	replays, err := s.replayWebhookEvents(c.Request.Context(), filter, input.DryRun)
+	if err != nil {
+		s.InternalServerErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dry_run": input.DryRun, "count": len(replays), "events": replays})
+}
+
+// validateWebhookReplay checks a bulk selection: failed events, optionally
+// within a window, or the events of a type within a window.
+func validateWebhookReplay(v *validator.Validator, filter data.WebhookEventFilter) {
+	v.Check(filter.FailedOnly || filter.EventType != "", "failed", "must be true unless event_type is provided")
+
+	if filter.EventType != "" {
+		v.Check(len(filter.EventType) <= 100, "event_type", "must not be more than 100 bytes long")
+		v.Check(filter.From != nil, "from", "must be provided with event_type")
+		v.Check(filter.To != nil, "to", "must be provided with event_type")
+	}
+
+	if filter.From != nil && filter.To != nil {
+		v.Check(filter.From.Before(*filter.To), "from", "must be before to")
+	}
+
+	v.Check(filter.Limit > 0, "limit", "must be greater than zero")
+	v.Check(filter.Limit <= maxReplayLimit, "limit", fmt.Sprintf("must be a maximum of %d", maxReplayLimit))
+}
+
+// replayWebhookEvents replays the events matching filter, or reports what
+// replaying them would do. Each event is replayed in its own transaction,
+// so the events replayed before an error stay replayed.
+func (s *service) replayWebhookEvents(ctx context.Context, filter data.WebhookEventFilter, dryRun bool) ([]*webhookReplay, error) {
+	events, err := s.models.WebhookEvent.GetAll(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher := newEventDispatcher(s.logger, s.models)
+	replays := make([]*webhookReplay, 0, len(events))
+
+	for _, event := range events {
+		replay := &webhookReplay{
+			StripeEventID: event.StripeEventID,
+			EventType:     event.EventType,
+			Processed:     event.Processed,
+			ProcessedAt:   event.ProcessedAt,
+			ErrorMessage:  event.ErrorMessage,
+			ReplayCount:   event.ReplayCount,
+			CreatedAt:     event.CreatedAt,
+		}
+		replays = append(replays, replay)
+
+		if dryRun {
+			handled, published, handlerErr := dispatcher.preview(ctx, event.EventData)
+			replay.Handled = &handled
+			replay.Events = published
+			if handlerErr != nil {
+				message := handlerErr.Error()
+				replay.HandlerError = &message
+			}
+			continue
+		}
+
+		err := s.models.Transact(ctx, func(tx data.Models) error {
+			if err := tx.WebhookEvent.ResetForReplay(ctx, event.StripeEventID); err != nil {
+				return err
+			}
+
+			return enqueueStripeEvent(ctx, tx, event.StripeEventID, event.EventType, event.EventData)
+		})
+		if err != nil {
+			return replays, fmt.Errorf("replay event %s: %w", event.StripeEventID, err)
+		}
+
+		replay.Replayed = true
+	}
+
+	if !dryRun && len(events) > 0 && s.outboxRelay != nil {
+		s.outboxRelay.notify()
+	}
+
+	s.logger.InfoContext(ctx, "webhook events replayed", "count", len(replays), "dry_run", dryRun,
+		"stripe_event_id", filter.StripeEventID, "event_type", filter.EventType, "failed_only", filter.FailedOnly)
+
+	return replays, nil
+}
+
+// preview runs the handler of a stored event in a transaction that is
+// rolled back. It reports whether a handler is registered for the event's
+// type and the outbound events the handler would publish.
+func (d *eventDispatcher) preview(ctx context.Context, body []byte) (handled bool, published []string, err error) {
+	var event stripe.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return false, nil, fmt.Errorf("failed to decode stripe event: %w", err)
+	}
+
+	handler, ok := d.handlers[event.Type]
+	if !ok {
+		return false, nil, nil
+	}
+
+	err = d.models.Transact(ctx, func(tx data.Models) error {
+		tx.Outbox.OnInsert = func(msg *data.OutboxMessage) {
+			published = append(published, msg.MessageType)
+		}
+
+		if err := handler(ctx, tx, &event); err != nil {
+			return err
+		}
+
+		return errDryRun
+	})
+	if !errors.Is(err, errDryRun) {
+		// A failing handler publishes nothing.
+		return true, nil, err
+	}
+
+	return true, published, nil
+}
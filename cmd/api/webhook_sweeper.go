@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pirasl/payment-service/internal/data"
+)
+
+// Webhook events are normally processed within seconds of being received,
+// or retried through the delay queues. An event still unprocessed long
+// after that was lost on the way; the sweeper queues it again from its
+// stored payload until it has used up its sweeps. Events the workers
+// dead-lettered are left to a replay, so the DLQ holds a single copy.
+
+// sweepBatchSize bounds the events queued again per sweep.
+const sweepBatchSize = 100
+
+// sweepPendingWebhooks sweeps every configured interval until the service
+// shuts down.
+func (s *service) sweepPendingWebhooks() {
+	ctx, cancel := s.backgroundContext()
+	defer cancel()
+
+	ticker := time.NewTicker(s.config.webhookSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.sweepWebhooks(ctx)
+		}
+	}
+}
+
+func (s *service) sweepWebhooks(ctx context.Context) {
+	exhausted, err := s.models.WebhookEvent.FailExhausted(ctx, s.config.webhookSweepMaxAttempts)
+	if err != nil {
+		s.logger.Error("failed to mark exhausted webhook events", "err", err)
+	}
+	for _, id := range exhausted {
+		s.logger.Error("webhook event not processed, giving up", "event_id", id, "attempts", s.config.webhookSweepMaxAttempts)
+	}
+	webhookEventsExhaustedTotal.Add(float64(len(exhausted)))
+
+	stuckBefore := time.Now().Add(-s.config.webhookStuckAfter)
+
+	events, err := s.models.WebhookEvent.GetStuck(ctx, stuckBefore, s.config.webhookSweepBackoff, sweepBatchSize)
+	if err != nil {
+		s.logger.Error("failed to list stuck webhook events", "err", err)
+		return
+	}
+
+	swept := 0
+
+	for _, event := range events {
+		err := s.models.Transact(ctx, func(tx data.Models) error {
+			if err := tx.WebhookEvent.MarkSwept(ctx, event.StripeEventID); err != nil {
+				return err
+			}
+
+			return enqueueStripeEvent(ctx, tx, event.StripeEventID, event.EventType, event.EventData)
+		})
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Processed in the meantime.
+			continue
+		case err != nil:
+			s.logger.Error("failed to queue stuck webhook event", "event_id", event.StripeEventID, "err", err)
+			continue
+		}
+
+		s.logger.Warn("queued stuck webhook event again", "event_id", event.StripeEventID, "type", event.EventType, "sweep", event.SweepCount+1)
+		swept++
+	}
+
+	if swept > 0 {
+		webhookEventsSweptTotal.Add(float64(swept))
+		s.outboxRelay.notify()
+	}
+
+	stuck, failed, err := s.models.WebhookEvent.CountUnprocessed(ctx, stuckBefore)
+	if err != nil {
+		s.logger.Error("failed to count stuck webhook events", "err", err)
+		return
+	}
+	webhookEventsStuck.Set(float64(stuck))
+	webhookEventsFailed.Set(float64(failed))
+}
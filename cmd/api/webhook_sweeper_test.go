@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSweepSelection(t *testing.T) {
+	const (
+		stuckAfter  = 15 * time.Minute
+		backoff     = time.Minute
+		maxAttempts = 3
+	)
+
+	tests := []struct {
+		id           string
+		age          time.Duration
+		sweptAgo     time.Duration // zero when never swept
+		sweepCount   int
+		retryCount   int
+		processed    bool
+		failed       bool
+		deadLettered bool
+
+		wantStuck     bool
+		wantExhausted bool
+	}{
+		{id: "evt_recent", age: time.Minute},
+		{id: "evt_stuck", age: time.Hour, wantStuck: true},
+		{id: "evt_processed", age: time.Hour, processed: true},
+		{id: "evt_failed", age: time.Hour, sweepCount: maxAttempts, failed: true},
+		{id: "evt_dead_lettered", age: time.Hour, retryCount: maxProcessingAttempts, deadLettered: true},
+		{id: "evt_dead_lettered_swept", age: time.Hour, sweptAgo: time.Hour, sweepCount: maxAttempts, deadLettered: true},
+		{id: "evt_retried", age: time.Hour, retryCount: maxAttempts + 1, wantStuck: true},
+		{id: "evt_backing_off", age: time.Hour, sweptAgo: 3 * time.Minute, sweepCount: 2},
+		{id: "evt_due_again", age: time.Hour, sweptAgo: 5 * time.Minute, sweepCount: 2, wantStuck: true},
+		{id: "evt_exhausted", age: time.Hour, sweptAgo: time.Hour, sweepCount: maxAttempts, wantExhausted: true},
+		{id: "evt_processed_late", age: time.Hour, sweepCount: maxAttempts + 1, processed: true},
+	}
+
+	s, _ := newTestService(t)
+
+	now := time.Now()
+	for _, tt := range tests {
+		var sweptAt *time.Time
+		if tt.sweptAgo > 0 {
+			at := now.Add(-tt.sweptAgo)
+			sweptAt = &at
+		}
+		var failedAt, deadLetteredAt *time.Time
+		if tt.failed {
+			failedAt = &now
+		}
+		if tt.deadLettered {
+			deadLetteredAt = &now
+		}
+
+		_, err := s.models.DB.ExecContext(t.Context(), `
+			INSERT INTO webhook_events (stripe_event_id, event_type, event_data, created_at, last_swept_at,
+				sweep_count, retry_count, processed, failed_at, dead_lettered_at)
+			VALUES ($1, 'payment_intent.succeeded', '{}', $2, $3, $4, $5, $6, $7, $8)`,
+			tt.id, now.Add(-tt.age), sweptAt, tt.sweepCount, tt.retryCount, tt.processed, failedAt, deadLetteredAt)
+		if err != nil {
+			t.Fatalf("insert %s: %v", tt.id, err)
+		}
+	}
+
+	exhausted, err := s.models.WebhookEvent.FailExhausted(t.Context(), maxAttempts)
+	if err != nil {
+		t.Fatalf("FailExhausted: %v", err)
+	}
+
+	stuck, err := s.models.WebhookEvent.GetStuck(t.Context(), now.Add(-stuckAfter), backoff, sweepBatchSize)
+	if err != nil {
+		t.Fatalf("GetStuck: %v", err)
+	}
+
+	var stuckIDs []string
+	for _, event := range stuck {
+		stuckIDs = append(stuckIDs, event.StripeEventID)
+	}
+
+	for _, tt := range tests {
+		if got := slices.Contains(stuckIDs, tt.id); got != tt.wantStuck {
+			t.Errorf("%s stuck = %v, want %v", tt.id, got, tt.wantStuck)
+		}
+		if got := slices.Contains(exhausted, tt.id); got != tt.wantExhausted {
+			t.Errorf("%s exhausted = %v, want %v", tt.id, got, tt.wantExhausted)
+		}
+	}
+}
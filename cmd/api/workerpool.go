@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/pirasl/payment-service/internal/data"
 	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -17,20 +20,25 @@ type Task struct {
 }
 
 type workerPool struct {
+	logger      *slog.Logger
 	amqpClient  *rabbitMQClient
+	dispatcher  *eventDispatcher
 	workerCount int
+	running     atomic.Int32
 	wg          *errgroup.Group
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
 
-func newWorkerPool(numWorkers int, rabbitmq *rabbitMQClient) (*workerPool, error) {
+func newWorkerPool(logger *slog.Logger, numWorkers int, rabbitmq *rabbitMQClient, dispatcher *eventDispatcher) (*workerPool, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	pool := &workerPool{
+		logger:      logger,
 		workerCount: numWorkers,
 		amqpClient:  rabbitmq,
+		dispatcher:  dispatcher,
 		ctx:         ctx,
 		cancel:      cancel,
 	}
@@ -45,52 +53,62 @@ func newWorkerPool(numWorkers int, rabbitmq *rabbitMQClient) (*workerPool, error
 	return pool, nil
 }
 
+var errDeliveriesClosed = errors.New("message channel closed")
+
+// worker consumes until the pool is shut down. Losing the broker is never
+// fatal: consumeMessages blocks on the client until it has reconnected, and
+// other failures are retried with a capped backoff.
 func (p *workerPool) worker(workerID int) error {
+	p.running.Add(1)
+	defer p.running.Add(-1)
+
 	retryCount := 0
-	maxRetries := 5
 	baseDelay := time.Second
+	maxDelay := 30 * time.Second
 
 	for {
 		select {
 		case <-p.ctx.Done():
-			log.Printf("Worker %d shutting down due to context cancellation", workerID)
-			return p.ctx.Err()
+			p.logger.Info("worker shutting down", "worker", workerID)
+			return nil
 		default:
 		}
 
 		err := p.consumeMessages(workerID)
-		if err == nil {
+		switch {
+		case err == nil:
 			retryCount = 0
 			continue
-		} else if strings.Contains(err.Error(), "message channel closed") {
+		case errors.Is(err, errRabbitMQClosed), errors.Is(err, context.Canceled):
 			return nil
+		case errors.Is(err, errDeliveriesClosed):
+			// The channel or connection went away; the next attempt waits
+			// for the client to reconnect.
+			p.logger.Warn("worker lost its channel, resubscribing", "worker", workerID)
+			retryCount = 0
+			continue
 		}
 
 		if !p.isRecoverableError(err) {
-			log.Printf("Worker %d encountered non-recoverable error: %v", workerID, err)
+			p.logger.Error("worker encountered non-recoverable error", "worker", workerID, "err", err)
 			return fmt.Errorf("worker %d failed with non-recoverable error: %w", workerID, err)
 		}
 
 		retryCount++
-		if retryCount >= maxRetries {
-			log.Printf("Worker %d exceeded max retries (%d), giving up", workerID, maxRetries)
-			return fmt.Errorf("worker %d exceeded max retries: %w", workerID, err)
-		}
-
-		delay := time.Duration(retryCount) * baseDelay
-		log.Printf("Worker %d retrying in %v (attempt %d/%d)", workerID, delay, retryCount, maxRetries)
+		delay := min(time.Duration(retryCount)*baseDelay, maxDelay)
+		p.logger.Warn("worker retrying", "worker", workerID, "retry_in", delay, "attempt", retryCount, "err", err)
 
 		select {
 		case <-time.After(delay):
 			continue
 		case <-p.ctx.Done():
-			return p.ctx.Err()
+			return nil
 		}
 	}
 }
 
 func (p *workerPool) consumeMessages(workerID int) error {
-	ch, err := p.amqpClient.conn.Channel()
+	ch, err := p.amqpClient.Channel(p.ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create channel for worker %d: %w", workerID, err)
 	}
@@ -101,8 +119,15 @@ func (p *workerPool) consumeMessages(workerID int) error {
 		return fmt.Errorf("failed to set QoS for worker %d: %w", workerID, err)
 	}
 
+	// Retries are published on the same channel and confirmed before the
+	// failed delivery is acked.
+	cc, err := newConfirmChannel(ch)
+	if err != nil {
+		return fmt.Errorf("worker %d: %w", workerID, err)
+	}
+
 	msgs, err := ch.Consume(
-		"stripe_processing",                // queue name
+		stripeProcessingQueue,              // queue name
 		fmt.Sprintf("worker-%d", workerID), // consumer tag unique
 		false,                              // auto-ack
 		false,                              // exclusive
@@ -118,34 +143,96 @@ func (p *workerPool) consumeMessages(workerID int) error {
 		select {
 		case msg, ok := <-msgs:
 			if !ok {
-				return fmt.Errorf("worker %d: message channel closed", workerID)
+				return fmt.Errorf("worker %d: %w", workerID, errDeliveriesClosed)
 			}
 
-			if err := p.processMessage(workerID, msg); err != nil {
-				log.Printf("Worker %d failed to process message: %v", workerID, err)
-				msg.Nack(false, false)
+			// Processing is not tied to the pool's context, so a
+			// shutdown lets the delivery in hand finish.
+			ctx := contextWithMessageRequestID(context.Background(), msg)
+
+			if err := p.processMessage(ctx, workerID, msg); err != nil {
+				p.logger.ErrorContext(ctx, "worker failed to process message", "worker", workerID, "message_id", msg.MessageId, "err", err)
+				p.handleFailure(ctx, workerID, cc, msg, err)
 			} else {
 				msg.Ack(false)
+				eventDeliveriesTotal.WithLabelValues("acked").Inc()
 			}
 
 		case <-p.ctx.Done():
-			log.Printf("Worker %d stopping message consumption", workerID)
+			p.logger.Info("worker stopping message consumption", "worker", workerID)
 			return nil
 		}
 	}
 }
 
-func (p *workerPool) processMessage(workerID int, msg amqp091.Delivery) error {
-	log.Printf("Worker %d processing message: %s", workerID, string(msg.Body))
+func (p *workerPool) processMessage(ctx context.Context, workerID int, msg amqp091.Delivery) (err error) {
+	p.logger.InfoContext(ctx, "worker processing message", "worker", workerID, "message_id", msg.MessageId, "type", msg.Type)
+
+	ctx, span := startProcessSpan(ctx, msg)
+
+	workersBusy.Inc()
+	start := time.Now()
+	defer func() {
+		workersBusy.Dec()
+
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		eventProcessingDuration.WithLabelValues(msg.Type, outcome).Observe(time.Since(start).Seconds())
+		span.End()
+	}()
 
 	if len(msg.Body) == 0 {
 		return fmt.Errorf("empty message body")
 	}
 
-	// Process message here
-	// Switch message.Type
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	return p.dispatcher.dispatch(ctx, msg.Body, deliveryAttempt(msg))
+}
+
+// handleFailure sends a failed delivery to the delay queue for its attempt,
+// or rejects it into the dead-letter queue once attempts are exhausted or the
+// error is permanent. If the retry cannot be published the message is also
+// rejected, so it is parked in the DLQ rather than lost.
+func (p *workerPool) handleFailure(ctx context.Context, workerID int, ch *confirmChannel, msg amqp091.Delivery, procErr error) {
+	attempt := deliveryAttempt(msg)
+
+	if shouldDeadLetter(procErr, attempt) {
+		p.logger.ErrorContext(ctx, "worker dead-lettering message", "worker", workerID, "message_id", msg.MessageId, "attempts", attempt)
+		p.deadLetter(ctx, msg)
+		return
+	}
+
+	retryCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := scheduleRetry(retryCtx, ch, msg, attempt); err != nil {
+		p.logger.ErrorContext(ctx, "worker failed to schedule retry", "worker", workerID, "message_id", msg.MessageId, "err", err)
+		p.deadLetter(ctx, msg)
+		return
+	}
+
+	p.logger.WarnContext(ctx, "worker scheduled retry", "worker", workerID, "message_id", msg.MessageId, "attempt", attempt, "retry_in", retryDelay(attempt))
+	msg.Ack(false)
+	eventDeliveriesTotal.WithLabelValues("retried").Inc()
+}
 
-	return nil
+// deadLetter rejects a delivery into the dead-letter queue. Its event, whose
+// ID the message carries, is marked first so the sweeper does not queue it
+// again next to the parked copy.
+func (p *workerPool) deadLetter(ctx context.Context, msg amqp091.Delivery) {
+	err := p.dispatcher.models.WebhookEvent.MarkDeadLettered(ctx, msg.MessageId)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		p.logger.ErrorContext(ctx, "worker failed to mark event dead-lettered", "message_id", msg.MessageId, "err", err)
+	}
+
+	msg.Nack(false, false)
+	eventDeliveriesTotal.WithLabelValues("dead_lettered").Inc()
 }
 
 func (p *workerPool) isRecoverableError(err error) bool {
@@ -173,6 +260,11 @@ func (p *workerPool) isRecoverableError(err error) bool {
 	return true
 }
 
+// alive returns the number of workers still running.
+func (p *workerPool) alive() int {
+	return int(p.running.Load())
+}
+
 func (p *workerPool) Shutdown() error {
 	p.cancel()
 	return p.wg.Wait()
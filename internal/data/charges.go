@@ -0,0 +1,322 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type ChargeModel struct {
+	DB DBTX
+}
+
+// Charge mirrors a row of the charges table.
+type Charge struct {
+	ID              string  `json:"id"`
+	StripeChargeID  string  `json:"stripe_charge_id"`
+	PaymentIntentID *string `json:"payment_intent_id"`
+
+	// StripePaymentIntentID is used to resolve PaymentIntentID on write.
+	StripePaymentIntentID string `json:"-"`
+
+	Amount         int64  `json:"amount"`
+	AmountCaptured int64  `json:"amount_captured"`
+	AmountRefunded int64  `json:"amount_refunded"`
+	Currency       string `json:"currency"`
+	Status         string `json:"status"`
+
+	Paid     bool `json:"paid"`
+	Refunded bool `json:"refunded"`
+	Captured bool `json:"captured"`
+	Disputed bool `json:"disputed"`
+
+	FailureCode    *string `json:"failure_code"`
+	FailureMessage *string `json:"failure_message"`
+
+	Outcome              json.RawMessage   `json:"outcome"`
+	ReceiptURL           *string           `json:"receipt_url"`
+	BillingDetails       json.RawMessage   `json:"billing_details"`
+	PaymentMethodDetails json.RawMessage   `json:"payment_method_details"`
+	Metadata             map[string]string `json:"metadata"`
+
+	// BalanceTransactionID is set once the charge settles. Fee is the
+	// provider's fee for it, in FeeCurrency, once looked up.
+	BalanceTransactionID *string `json:"balance_transaction_id"`
+	Fee                  *int64  `json:"fee"`
+	FeeCurrency          *string `json:"fee_currency"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Upsert inserts the charge or refreshes the stored copy from the provider's
+// view of it. Events can arrive out of order or be replayed, so amounts and
+// flags only ever move forward and a settled charge never returns to
+// pending; charge is updated with the stored values. It reports false when a
+// stale update was ignored entirely.
+func (m ChargeModel) Upsert(ctx context.Context, charge *Charge) (updated bool, err error) {
+	query := `
+		INSERT INTO charges (
+			stripe_charge_id, payment_intent_id, amount, amount_captured, amount_refunded, currency, status,
+			paid, refunded, captured, disputed, failure_code, failure_message, outcome, receipt_url,
+			billing_details, payment_method_details, metadata, balance_transaction_id, fee, fee_currency
+		)
+		VALUES (
+			$1, (SELECT id FROM payment_intents WHERE stripe_payment_intent_id = $2), $3, $4, $5, $6, $7,
+			$8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21
+		)
+		ON CONFLICT (stripe_charge_id) DO UPDATE SET
+			payment_intent_id = COALESCE(EXCLUDED.payment_intent_id, charges.payment_intent_id),
+			amount = EXCLUDED.amount,
+			amount_captured = GREATEST(charges.amount_captured, EXCLUDED.amount_captured),
+			amount_refunded = GREATEST(charges.amount_refunded, EXCLUDED.amount_refunded),
+			status = EXCLUDED.status,
+			paid = charges.paid OR EXCLUDED.paid,
+			refunded = charges.refunded OR EXCLUDED.refunded,
+			captured = charges.captured OR EXCLUDED.captured,
+			disputed = charges.disputed OR EXCLUDED.disputed,
+			failure_code = EXCLUDED.failure_code,
+			failure_message = EXCLUDED.failure_message,
+			outcome = EXCLUDED.outcome,
+			receipt_url = EXCLUDED.receipt_url,
+			billing_details = EXCLUDED.billing_details,
+			payment_method_details = EXCLUDED.payment_method_details,
+			metadata = EXCLUDED.metadata,
+			balance_transaction_id = COALESCE(EXCLUDED.balance_transaction_id, charges.balance_transaction_id),
+			fee = COALESCE(charges.fee, EXCLUDED.fee),
+			fee_currency = COALESCE(charges.fee_currency, EXCLUDED.fee_currency)
+		WHERE charges.status = 'pending'
+			OR charges.status = EXCLUDED.status
+		RETURNING id, payment_intent_id, amount_captured, amount_refunded, status, paid, refunded, captured,
+			disputed, balance_transaction_id, fee, fee_currency, created_at, updated_at`
+
+	metadata, err := marshalMetadata(charge.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	args := []any{
+		charge.StripeChargeID,
+		charge.StripePaymentIntentID,
+		charge.Amount,
+		charge.AmountCaptured,
+		charge.AmountRefunded,
+		charge.Currency,
+		charge.Status,
+		charge.Paid,
+		charge.Refunded,
+		charge.Captured,
+		charge.Disputed,
+		charge.FailureCode,
+		charge.FailureMessage,
+		nullableJSON(charge.Outcome),
+		charge.ReceiptURL,
+		nullableJSON(charge.BillingDetails),
+		nullableJSON(charge.PaymentMethodDetails),
+		metadata,
+		charge.BalanceTransactionID,
+		charge.Fee,
+		charge.FeeCurrency,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&charge.ID,
+		&charge.PaymentIntentID,
+		&charge.AmountCaptured,
+		&charge.AmountRefunded,
+		&charge.Status,
+		&charge.Paid,
+		&charge.Refunded,
+		&charge.Captured,
+		&charge.Disputed,
+		&charge.BalanceTransactionID,
+		&charge.Fee,
+		&charge.FeeCurrency,
+		&charge.CreatedAt,
+		&charge.UpdatedAt,
+	)
+	if err != nil {
+		// The WHERE clause filtered out a stale update.
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SetDisputed flags a charge as disputed. ErrRecordNotFound is returned when
+// the charge is unknown.
+func (m ChargeModel) SetDisputed(ctx context.Context, stripeChargeID string, disputed bool) error {
+	query := `
+		UPDATE charges
+		SET disputed = $2
+		WHERE stripe_charge_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeChargeID, disputed)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// RefundableAmount returns how much of a payment's captured charge can still
+// be refunded. Refunds that are recorded but not yet reflected in the
+// charge's amount_refunded, such as pending ones, are counted too.
+// ErrRecordNotFound is returned when the payment has no captured charge.
+func (m ChargeModel) RefundableAmount(ctx context.Context, paymentID string) (int64, error) {
+	query := `
+		SELECT c.amount_captured - GREATEST(
+			c.amount_refunded,
+			(SELECT COALESCE(SUM(r.amount), 0) FROM refunds r
+			 WHERE r.payment_intent_id = c.payment_intent_id AND r.status NOT IN ('failed', 'canceled'))
+		)
+		FROM charges c
+		WHERE c.payment_intent_id = $1 AND c.captured
+		ORDER BY c.created_at DESC
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var refundable int64
+
+	err := m.DB.QueryRowContext(ctx, query, paymentID).Scan(&refundable)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+
+	return refundable, nil
+}
+
+// PendingFee is a settled charge whose provider fee is not known yet.
+type PendingFee struct {
+	ChargeID             string
+	StripeChargeID       string
+	BalanceTransactionID string
+}
+
+// GetPendingFees lists settled charges without a fee, oldest first.
+func (m ChargeModel) GetPendingFees(ctx context.Context, limit int) ([]*PendingFee, error) {
+	query := `
+		SELECT id, stripe_charge_id, balance_transaction_id
+		FROM charges
+		WHERE balance_transaction_id IS NOT NULL AND fee IS NULL
+		ORDER BY created_at ASC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []*PendingFee{}
+
+	for rows.Next() {
+		var p PendingFee
+		if err := rows.Scan(&p.ChargeID, &p.StripeChargeID, &p.BalanceTransactionID); err != nil {
+			return nil, err
+		}
+		pending = append(pending, &p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+// SetFee records the provider's fee for a charge. ErrRecordNotFound is
+// returned when the fee was already recorded.
+func (m ChargeModel) SetFee(ctx context.Context, id string, fee int64, currency string) error {
+	query := `
+		UPDATE charges
+		SET fee = $2, fee_currency = $3
+		WHERE id = $1 AND fee IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, fee, currency)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// GetByStripeID looks a charge up by its provider charge ID.
+func (m ChargeModel) GetByStripeID(ctx context.Context, stripeChargeID string) (*Charge, error) {
+	query := `
+		SELECT id, stripe_charge_id, payment_intent_id, amount, amount_captured, amount_refunded, currency,
+			status, paid, refunded, captured, disputed, failure_code, failure_message, outcome, receipt_url,
+			billing_details, payment_method_details, metadata, balance_transaction_id, fee, fee_currency,
+			created_at, updated_at
+		FROM charges
+		WHERE stripe_charge_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var charge Charge
+	var metadata []byte
+
+	err := m.DB.QueryRowContext(ctx, query, stripeChargeID).Scan(
+		&charge.ID,
+		&charge.StripeChargeID,
+		&charge.PaymentIntentID,
+		&charge.Amount,
+		&charge.AmountCaptured,
+		&charge.AmountRefunded,
+		&charge.Currency,
+		&charge.Status,
+		&charge.Paid,
+		&charge.Refunded,
+		&charge.Captured,
+		&charge.Disputed,
+		&charge.FailureCode,
+		&charge.FailureMessage,
+		&charge.Outcome,
+		&charge.ReceiptURL,
+		&charge.BillingDetails,
+		&charge.PaymentMethodDetails,
+		&metadata,
+		&charge.BalanceTransactionID,
+		&charge.Fee,
+		&charge.FeeCurrency,
+		&charge.CreatedAt,
+		&charge.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &charge.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return &charge, nil
+}
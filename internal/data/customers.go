@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrDuplicateCustomer = errors.New("duplicate customer")
+
+type CustomerModel struct {
+	DB DBTX
+}
+
+// Customer mirrors a row of the customers table.
+type Customer struct {
+	ID               string            `json:"id"`
+	StripeCustomerID string            `json:"stripe_customer_id"`
+	UserID           *int64            `json:"user_id"`
+	Email            *string           `json:"email"`
+	Name             *string           `json:"name"`
+	Phone            *string           `json:"phone"`
+	Description      *string           `json:"description"`
+	Metadata         map[string]string `json:"metadata"`
+	DefaultSource    *string           `json:"default_source"`
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
+}
+
+// Upsert inserts the customer or refreshes the stored copy from the
+// provider's view of it. The user it belongs to is left untouched.
+func (m CustomerModel) Upsert(ctx context.Context, customer *Customer) error {
+	query := `
+		INSERT INTO customers (stripe_customer_id, email, name, phone, description, metadata, default_source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (stripe_customer_id) DO UPDATE SET
+			email = EXCLUDED.email,
+			name = EXCLUDED.name,
+			phone = EXCLUDED.phone,
+			description = EXCLUDED.description,
+			metadata = EXCLUDED.metadata,
+			default_source = EXCLUDED.default_source
+		RETURNING id, created_at, updated_at`
+
+	metadata, err := marshalMetadata(customer.Metadata)
+	if err != nil {
+		return err
+	}
+
+	args := []any{
+		customer.StripeCustomerID,
+		customer.Email,
+		customer.Name,
+		customer.Phone,
+		customer.Description,
+		metadata,
+		customer.DefaultSource,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&customer.ID, &customer.CreatedAt, &customer.UpdatedAt)
+}
+
+// Insert stores a customer created for a user. A row already written for the
+// same provider customer by a webhook is claimed for the user instead.
+// ErrDuplicateCustomer is returned when the user already has a customer.
+func (m CustomerModel) Insert(ctx context.Context, customer *Customer) error {
+	query := `
+		INSERT INTO customers (stripe_customer_id, user_id, email, name, phone, description, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (stripe_customer_id) DO UPDATE SET
+			user_id = EXCLUDED.user_id
+		RETURNING id, default_source, created_at, updated_at`
+
+	metadata, err := marshalMetadata(customer.Metadata)
+	if err != nil {
+		return err
+	}
+
+	args := []any{
+		customer.StripeCustomerID,
+		customer.UserID,
+		customer.Email,
+		customer.Name,
+		customer.Phone,
+		customer.Description,
+		metadata,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&customer.ID, &customer.DefaultSource, &customer.CreatedAt, &customer.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicateCustomer
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetForUser returns the customer that belongs to userID.
+func (m CustomerModel) GetForUser(ctx context.Context, userID int64) (*Customer, error) {
+	query := `
+		SELECT id, stripe_customer_id, user_id, email, name, phone, description, metadata, default_source,
+			created_at, updated_at
+		FROM customers
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var customer Customer
+	var metadata []byte
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&customer.ID,
+		&customer.StripeCustomerID,
+		&customer.UserID,
+		&customer.Email,
+		&customer.Name,
+		&customer.Phone,
+		&customer.Description,
+		&metadata,
+		&customer.DefaultSource,
+		&customer.CreatedAt,
+		&customer.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &customer.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return &customer, nil
+}
+
+// Delete removes a customer by its provider ID. Its payment methods go with
+// it and its payments are kept without a customer.
+func (m CustomerModel) Delete(ctx context.Context, stripeCustomerID string) error {
+	query := `
+		DELETE FROM customers
+		WHERE stripe_customer_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeCustomerID)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
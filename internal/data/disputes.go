@@ -0,0 +1,323 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OpenDisputeStatuses are the statuses of disputes that are not decided yet.
+var OpenDisputeStatuses = []string{"warning_needs_response", "warning_under_review", "needs_response", "under_review"}
+
+type DisputeModel struct {
+	DB DBTX
+}
+
+// Dispute mirrors a row of the disputes table.
+type Dispute struct {
+	ID              string  `json:"id"`
+	StripeDisputeID string  `json:"stripe_dispute_id"`
+	ChargeID        *string `json:"charge_id"`
+	PaymentIntentID *string `json:"payment_intent_id"`
+
+	// StripeChargeID and StripePaymentIntentID are used to resolve the
+	// foreign keys on write.
+	StripeChargeID        string `json:"-"`
+	StripePaymentIntentID string `json:"-"`
+
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+
+	EvidenceDueBy      *time.Time        `json:"evidence_due_by"`
+	HasEvidence        bool              `json:"has_evidence"`
+	PastDue            bool              `json:"past_due"`
+	SubmissionCount    int64             `json:"submission_count"`
+	IsChargeRefundable bool              `json:"is_charge_refundable"`
+	Metadata           map[string]string `json:"metadata"`
+
+	FundsWithdrawnAt  *time.Time `json:"funds_withdrawn_at"`
+	FundsReinstatedAt *time.Time `json:"funds_reinstated_at"`
+	ClosedAt          *time.Time `json:"closed_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// Upsert inserts the dispute or refreshes the stored copy from the
+// provider's view of it. A closed dispute is not reopened by an older,
+// out-of-order event. statusChanged reports whether the row was created or
+// moved to a new status.
+func (m DisputeModel) Upsert(ctx context.Context, dispute *Dispute) (statusChanged bool, err error) {
+	query := `
+		WITH previous AS (
+			SELECT status FROM disputes WHERE stripe_dispute_id = $1
+		)
+		INSERT INTO disputes (
+			stripe_dispute_id, charge_id, payment_intent_id, amount, currency, reason, status,
+			evidence_due_by, has_evidence, past_due, submission_count, is_charge_refundable, metadata, closed_at
+		)
+		VALUES (
+			$1,
+			(SELECT id FROM charges WHERE stripe_charge_id = $2),
+			(SELECT id FROM payment_intents WHERE stripe_payment_intent_id = $3),
+			$4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+			CASE WHEN $7 IN ('won', 'lost', 'warning_closed') THEN NOW() END
+		)
+		ON CONFLICT (stripe_dispute_id) DO UPDATE SET
+			charge_id = COALESCE(EXCLUDED.charge_id, disputes.charge_id),
+			payment_intent_id = COALESCE(EXCLUDED.payment_intent_id, disputes.payment_intent_id),
+			amount = EXCLUDED.amount,
+			reason = EXCLUDED.reason,
+			status = EXCLUDED.status,
+			evidence_due_by = EXCLUDED.evidence_due_by,
+			has_evidence = EXCLUDED.has_evidence,
+			past_due = EXCLUDED.past_due,
+			submission_count = EXCLUDED.submission_count,
+			is_charge_refundable = EXCLUDED.is_charge_refundable,
+			metadata = EXCLUDED.metadata,
+			closed_at = COALESCE(disputes.closed_at, EXCLUDED.closed_at)
+		WHERE disputes.status NOT IN ('won', 'lost', 'warning_closed')
+			OR disputes.status = EXCLUDED.status
+		RETURNING id, charge_id, payment_intent_id, funds_withdrawn_at, funds_reinstated_at, closed_at,
+			created_at, updated_at, disputes.status IS DISTINCT FROM (SELECT status FROM previous)`
+
+	metadata, err := marshalMetadata(dispute.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	args := []any{
+		dispute.StripeDisputeID,
+		dispute.StripeChargeID,
+		dispute.StripePaymentIntentID,
+		dispute.Amount,
+		dispute.Currency,
+		dispute.Reason,
+		dispute.Status,
+		dispute.EvidenceDueBy,
+		dispute.HasEvidence,
+		dispute.PastDue,
+		dispute.SubmissionCount,
+		dispute.IsChargeRefundable,
+		metadata,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&dispute.ID,
+		&dispute.ChargeID,
+		&dispute.PaymentIntentID,
+		&dispute.FundsWithdrawnAt,
+		&dispute.FundsReinstatedAt,
+		&dispute.ClosedAt,
+		&dispute.CreatedAt,
+		&dispute.UpdatedAt,
+		&statusChanged,
+	)
+	if err != nil {
+		// The WHERE clause filtered out a stale update.
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return statusChanged, nil
+}
+
+// RecordFundsMovement stamps when the disputed amount was withdrawn from, or
+// reinstated to, the balance. The first time is kept.
+func (m DisputeModel) RecordFundsMovement(ctx context.Context, stripeDisputeID string, withdrawn bool) error {
+	column := "funds_reinstated_at"
+	if withdrawn {
+		column = "funds_withdrawn_at"
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE disputes
+		SET %[1]s = COALESCE(%[1]s, NOW())
+		WHERE stripe_dispute_id = $1`, column)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeDisputeID)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+const disputeColumns = `
+	id, stripe_dispute_id, charge_id, payment_intent_id, amount, currency, reason, status,
+	evidence_due_by, has_evidence, past_due, submission_count, is_charge_refundable, metadata,
+	funds_withdrawn_at, funds_reinstated_at, closed_at, created_at, updated_at`
+
+func scanDispute(row rowScanner) (*Dispute, error) {
+	var dispute Dispute
+	var metadata []byte
+
+	err := row.Scan(
+		&dispute.ID,
+		&dispute.StripeDisputeID,
+		&dispute.ChargeID,
+		&dispute.PaymentIntentID,
+		&dispute.Amount,
+		&dispute.Currency,
+		&dispute.Reason,
+		&dispute.Status,
+		&dispute.EvidenceDueBy,
+		&dispute.HasEvidence,
+		&dispute.PastDue,
+		&dispute.SubmissionCount,
+		&dispute.IsChargeRefundable,
+		&metadata,
+		&dispute.FundsWithdrawnAt,
+		&dispute.FundsReinstatedAt,
+		&dispute.ClosedAt,
+		&dispute.CreatedAt,
+		&dispute.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &dispute.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dispute, nil
+}
+
+// Get looks a dispute up by its ID. IDs that are not valid UUIDs are
+// reported as not found.
+func (m DisputeModel) Get(ctx context.Context, id string) (*Dispute, error) {
+	query := `SELECT` + disputeColumns + `
+		FROM disputes
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	dispute, err := scanDispute(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code == "22P02":
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return dispute, nil
+}
+
+// GetAll lists disputes with any of the given statuses, or all disputes when
+// none are given.
+func (m DisputeModel) GetAll(ctx context.Context, statuses []string, filters Filters) ([]*Dispute, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(),`+disputeColumns+`
+		FROM disputes
+		WHERE (status = ANY($1) OR cardinality($1::text[]) = 0)
+		ORDER BY %s %s NULLS LAST, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(statuses), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	disputes := []*Dispute{}
+
+	for rows.Next() {
+		dispute, err := scanDispute(countingScanner{rows: rows, total: &totalRecords})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return disputes, metadata, nil
+}
+
+// GetDueForReminder lists disputes still waiting for a response whose
+// evidence is due before the given time and that were not reminded about
+// yet, most urgent first.
+func (m DisputeModel) GetDueForReminder(ctx context.Context, dueBefore time.Time, limit int) ([]*Dispute, error) {
+	query := `SELECT` + disputeColumns + `
+		FROM disputes
+		WHERE status IN ('needs_response', 'warning_needs_response')
+		AND evidence_due_by < $1
+		AND deadline_reminder_sent_at IS NULL
+		ORDER BY evidence_due_by ASC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, dueBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disputes := []*Dispute{}
+
+	for rows.Next() {
+		dispute, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return disputes, nil
+}
+
+// MarkDeadlineReminded records that a reminder about the dispute's evidence
+// deadline was sent. ErrRecordNotFound is returned when it already was.
+func (m DisputeModel) MarkDeadlineReminded(ctx context.Context, id string) error {
+	query := `
+		UPDATE disputes
+		SET deadline_reminder_sent_at = NOW()
+		WHERE id = $1 AND deadline_reminder_sent_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
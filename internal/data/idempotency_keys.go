@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrIdempotencyKeyInUse = errors.New("idempotency key in use")
+
+type IdempotencyKeyModel struct {
+	DB DBTX
+}
+
+// IdempotencyKey records a request made with an Idempotency-Key header and,
+// once it has completed, the response that is replayed on retries.
+type IdempotencyKey struct {
+	ID             string    `json:"id"`
+	UserID         int64     `json:"user_id"`
+	Key            string    `json:"idempotency_key"`
+	RequestMethod  string    `json:"request_method"`
+	RequestPath    string    `json:"request_path"`
+	RequestHash    string    `json:"request_hash"`
+	ResponseStatus *int      `json:"response_status"`
+	ResponseBody   []byte    `json:"response_body"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// Insert claims the key for a new request. An expired key is reused, as is
+// one whose original request with the same fingerprint never completed
+// (e.g. the instance crashed) and has been in flight for longer than
+// staleAfter. Otherwise ErrIdempotencyKeyInUse is returned and the caller
+// should load the existing record.
+func (m IdempotencyKeyModel) Insert(ctx context.Context, key *IdempotencyKey, staleAfter time.Duration) error {
+	query := `
+		INSERT INTO idempotency_keys (user_id, idempotency_key, request_method, request_path, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, idempotency_key) DO UPDATE SET
+			request_method = EXCLUDED.request_method,
+			request_path = EXCLUDED.request_path,
+			request_hash = EXCLUDED.request_hash,
+			response_status = NULL,
+			response_body = NULL,
+			created_at = NOW(),
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= NOW()
+			OR (idempotency_keys.response_status IS NULL
+				AND idempotency_keys.request_hash = EXCLUDED.request_hash
+				AND idempotency_keys.created_at < NOW() - make_interval(secs => $7))
+		RETURNING id, created_at`
+
+	args := []any{
+		key.UserID,
+		key.Key,
+		key.RequestMethod,
+		key.RequestPath,
+		key.RequestHash,
+		key.ExpiresAt,
+		staleAfter.Seconds(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrIdempotencyKeyInUse
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m IdempotencyKeyModel) Get(ctx context.Context, userID int64, idempotencyKey string) (*IdempotencyKey, error) {
+	query := `
+		SELECT id, user_id, idempotency_key, request_method, request_path, request_hash,
+			response_status, response_body, created_at, expires_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND idempotency_key = $2`
+
+	var key IdempotencyKey
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, idempotencyKey).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Key,
+		&key.RequestMethod,
+		&key.RequestPath,
+		&key.RequestHash,
+		&key.ResponseStatus,
+		&key.ResponseBody,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// SaveResponse stores the response of the completed request for replay.
+func (m IdempotencyKeyModel) SaveResponse(ctx context.Context, id string, status int, body []byte) error {
+	query := `
+		UPDATE idempotency_keys
+		SET response_status = $2, response_body = $3
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, status, body)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Delete releases a key whose request failed, so the client can retry it.
+func (m IdempotencyKeyModel) Delete(ctx context.Context, id string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// DeleteExpired removes expired keys and returns how many were deleted.
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at <= NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Ledger account codes, seeded by the ledger migration.
+const (
+	LedgerProviderBalance = "provider_balance"
+	LedgerSales           = "sales"
+	LedgerRefunds         = "refunds"
+	LedgerDisputeLosses   = "dispute_losses"
+	LedgerProviderFees    = "provider_fees"
+)
+
+var ErrUnbalancedEntry = errors.New("ledger entry is not balanced")
+
+type LedgerModel struct {
+	DB DBTX
+}
+
+// LedgerEntry is one money movement. Its postings sum to zero per currency;
+// debits are positive and credits negative.
+type LedgerEntry struct {
+	ID              string           `json:"id"`
+	Reference       string           `json:"reference"`
+	Description     string           `json:"description"`
+	ReversesEntryID *string          `json:"reverses_entry_id"`
+	Postings        []*LedgerPosting `json:"postings"`
+	CreatedAt       time.Time        `json:"created_at"`
+}
+
+type LedgerPosting struct {
+	Account  string `json:"account"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// AccountBalance is the sum of an account's postings in one currency. It is
+// positive in the account's normal direction: debits for assets and
+// expenses, credits for the others.
+type AccountBalance struct {
+	Account  string `json:"account"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance"`
+}
+
+// Post appends an entry with its postings. An entry whose reference was
+// already posted is skipped and posted is false. It must run in a
+// transaction, as the balance of the postings is checked at commit.
+func (m LedgerModel) Post(ctx context.Context, entry *LedgerEntry) (posted bool, err error) {
+	totals := make(map[string]int64)
+	for _, posting := range entry.Postings {
+		if posting.Amount == 0 {
+			return false, ErrUnbalancedEntry
+		}
+		totals[posting.Currency] += posting.Amount
+	}
+	for _, total := range totals {
+		if total != 0 {
+			return false, ErrUnbalancedEntry
+		}
+	}
+	if len(entry.Postings) == 0 {
+		return false, ErrUnbalancedEntry
+	}
+
+	query := `
+		INSERT INTO ledger_entries (reference, description)
+		VALUES ($1, $2)
+		ON CONFLICT (reference) DO NOTHING
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, entry.Reference, entry.Description).Scan(&entry.ID, &entry.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	query = `
+		INSERT INTO ledger_postings (entry_id, account_id, amount, currency)
+		SELECT $1, id, $3, $4 FROM ledger_accounts WHERE code = $2`
+
+	for _, posting := range entry.Postings {
+		result, err := m.DB.ExecContext(ctx, query, entry.ID, posting.Account, posting.Amount, posting.Currency)
+		if err != nil {
+			return false, err
+		}
+
+		if err := checkRowsAffected(result); err != nil {
+			return false, fmt.Errorf("unknown ledger account %q", posting.Account)
+		}
+	}
+
+	return true, nil
+}
+
+// Reverse appends an entry that negates every posting of the entry with the
+// given reference. reversed is false when that entry does not exist or was
+// already reversed under reversalReference.
+func (m LedgerModel) Reverse(ctx context.Context, reference, reversalReference, description string) (reversed bool, err error) {
+	query := `
+		WITH reversal AS (
+			INSERT INTO ledger_entries (reference, description, reverses_entry_id)
+			SELECT $2, $3, id FROM ledger_entries WHERE reference = $1
+			ON CONFLICT (reference) DO NOTHING
+			RETURNING id, reverses_entry_id
+		)
+		INSERT INTO ledger_postings (entry_id, account_id, amount, currency)
+		SELECT reversal.id, p.account_id, -p.amount, p.currency
+		FROM reversal
+		JOIN ledger_postings p ON p.entry_id = reversal.reverses_entry_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, reference, reversalReference, description)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// Balances sums the postings of entries created up to and including at, per
+// account and currency. An empty account returns every account.
+func (m LedgerModel) Balances(ctx context.Context, account string, at time.Time) ([]*AccountBalance, error) {
+	query := `
+		SELECT a.code, a.name, a.type, p.currency,
+			CASE WHEN a.type IN ('asset', 'expense') THEN SUM(p.amount) ELSE -SUM(p.amount) END
+		FROM ledger_postings p
+		JOIN ledger_entries e ON e.id = p.entry_id
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE e.created_at <= $1
+		AND (a.code = $2 OR $2 = '')
+		GROUP BY a.code, a.name, a.type, p.currency
+		ORDER BY a.code, p.currency`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, at, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []*AccountBalance{}
+
+	for rows.Next() {
+		var balance AccountBalance
+		err := rows.Scan(&balance.Account, &balance.Name, &balance.Type, &balance.Currency, &balance.Balance)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, &balance)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+// AccountExists reports whether an account with the given code exists.
+func (m LedgerModel) AccountExists(ctx context.Context, code string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM ledger_accounts WHERE code = $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(&exists)
+	return exists, err
+}
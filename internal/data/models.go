@@ -1,13 +1,107 @@
 package data
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrDuplicateEvent = errors.New("duplicate event")
+	ErrEditConflict   = errors.New("edit conflict")
+)
+
+// DBTX is implemented by both *sql.DB and *sql.Tx so that every model can be
+// used either standalone or as part of a larger transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
 type Models struct {
-	Payment PaymentModel
+	DB *sql.DB
+
+	Charge         ChargeModel
+	Customer       CustomerModel
+	Dispute        DisputeModel
+	Ledger         LedgerModel
+	Reconciliation ReconciliationModel
+	IdempotencyKey IdempotencyKeyModel
+	Payment        PaymentModel
+	PaymentMethod  PaymentMethodModel
+	Outbox         OutboxModel
+	Refund         RefundModel
+	WebhookEvent   WebhookEventModel
 }
 
 func NewModels(db *sql.DB) Models {
+	m := newModels(db)
+	m.DB = db
+	return m
+}
+
+func newModels(db DBTX) Models {
 	return Models{
-		Payment: PaymentModel{DB: db},
+		Charge:         ChargeModel{DB: db},
+		Customer:       CustomerModel{DB: db},
+		Dispute:        DisputeModel{DB: db},
+		Ledger:         LedgerModel{DB: db},
+		Reconciliation: ReconciliationModel{DB: db},
+		IdempotencyKey: IdempotencyKeyModel{DB: db},
+		Payment:        PaymentModel{DB: db},
+		PaymentMethod:  PaymentMethodModel{DB: db},
+		Outbox:         OutboxModel{DB: db},
+		Refund:         RefundModel{DB: db},
+		WebhookEvent:   WebhookEventModel{DB: db},
+	}
+}
+
+// Transact runs fn inside a database transaction. The transaction is
+// committed if fn returns nil and rolled back otherwise.
+func (m Models) Transact(ctx context.Context, fn func(tx Models) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	txModels := newModels(tx)
+	txModels.DB = m.DB
+
+	if err := fn(txModels); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
 	}
+
+	return tx.Commit()
+}
+
+// SchemaVersion returns the version of the last migration applied, and
+// whether it failed part way.
+func (m Models) SchemaVersion(ctx context.Context) (version int64, dirty bool, err error) {
+	query := `SELECT version, dirty FROM schema_migrations LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	return version, dirty, err
+}
+
+func checkRowsAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
 }
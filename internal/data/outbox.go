@@ -0,0 +1,191 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type OutboxModel struct {
+	DB DBTX
+
+	// OnInsert, when set, is called with each message inserted, e.g. to
+	// report what a rolled back dry run would have published.
+	OnInsert func(msg *OutboxMessage)
+}
+
+// OutboxMessage is a message waiting to be published to RabbitMQ. It is
+// written in the same transaction as the state change it describes.
+type OutboxMessage struct {
+	ID          string            `json:"id"`
+	Exchange    string            `json:"exchange"`
+	RoutingKey  string            `json:"routing_key"`
+	MessageID   string            `json:"message_id"`
+	MessageType string            `json:"message_type"`
+	Headers     map[string]string `json:"headers"`
+	Payload     []byte            `json:"payload"`
+	Attempts    int               `json:"attempts"`
+	LastError   *string           `json:"last_error"`
+	CreatedAt   time.Time         `json:"created_at"`
+	SentAt      *time.Time        `json:"sent_at"`
+	DeadAt      *time.Time        `json:"dead_at"`
+}
+
+func (m OutboxModel) Insert(ctx context.Context, msg *OutboxMessage) error {
+	query := `
+		INSERT INTO outbox (exchange, routing_key, message_id, message_type, headers, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	headers := msg.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	args := []any{msg.Exchange, msg.RoutingKey, msg.MessageID, msg.MessageType, encodedHeaders, msg.Payload}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&msg.ID, &msg.CreatedAt); err != nil {
+		return err
+	}
+
+	if m.OnInsert != nil {
+		m.OnInsert(msg)
+	}
+
+	return nil
+}
+
+// ClaimUnsent returns up to limit unsent messages in creation order, locking
+// them for the rest of the transaction. Rows locked by another relay are
+// skipped, so several instances can relay concurrently. Parked messages are
+// never claimed again.
+func (m OutboxModel) ClaimUnsent(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	query := `
+		SELECT id, exchange, routing_key, message_id, message_type, headers, payload, attempts, last_error, created_at
+		FROM outbox
+		WHERE sent_at IS NULL AND dead_at IS NULL
+		ORDER BY created_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var msg OutboxMessage
+		var headers []byte
+
+		err := rows.Scan(
+			&msg.ID,
+			&msg.Exchange,
+			&msg.RoutingKey,
+			&msg.MessageID,
+			&msg.MessageType,
+			&headers,
+			&msg.Payload,
+			&msg.Attempts,
+			&msg.LastError,
+			&msg.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+				return nil, err
+			}
+		}
+
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (m OutboxModel) MarkSent(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `
+		UPDATE outbox
+		SET sent_at = NOW(), attempts = attempts + 1, last_error = NULL
+		WHERE id = ANY($1::uuid[])`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids))
+	return err
+}
+
+// DeleteSentBefore deletes up to limit messages sent before the given time
+// and returns how many were deleted.
+func (m OutboxModel) DeleteSentBefore(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM outbox
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at < $1
+			LIMIT $2
+		)`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// MarkFailed records a failed publish. A message failing its maxAttempts'th
+// publish is parked, and dead is true.
+func (m OutboxModel) MarkFailed(ctx context.Context, id string, errorMessage string, maxAttempts int) (dead bool, err error) {
+	query := `
+		UPDATE outbox
+		SET attempts = attempts + 1, last_error = $2,
+			dead_at = CASE WHEN attempts + 1 >= $3 THEN NOW() END
+		WHERE id = $1
+		RETURNING dead_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, id, errorMessage, maxAttempts).Scan(&dead)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrRecordNotFound
+		}
+		return false, err
+	}
+
+	return dead, nil
+}
@@ -1,33 +1,404 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+var ErrDuplicatePaymentIntent = errors.New("duplicate payment intent")
+
 type PaymentModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
+// Payment mirrors a row of the payment_intents table.
 type Payment struct {
-	ID      int64 `json:"id"`
-	OrderID int64 `json:"order_id"`
-	UserID  int64 `json:"user_id"`
+	ID                    string `json:"id"`
+	StripePaymentIntentID string `json:"stripe_payment_intent_id"`
+
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+
+	ClientSecret *string `json:"-"`
+	CustomerID   *string `json:"customer_id"`
+
+	// StripeCustomerID is used to resolve CustomerID on upsert.
+	StripeCustomerID string `json:"-"`
+
+	Metadata        map[string]string `json:"metadata"`
+	Description     *string           `json:"description"`
+	ReceiptEmail    *string           `json:"receipt_email"`
+	ShippingAddress json.RawMessage   `json:"shipping_address"`
+	BillingAddress  json.RawMessage   `json:"billing_address"`
+
+	PaymentMethodID    *string  `json:"payment_method_id"`
+	PaymentMethodTypes []string `json:"payment_method_types"`
+	SetupFutureUsage   *string  `json:"setup_future_usage"`
+	CaptureMethod      string   `json:"capture_method"`
+	ConfirmationMethod string   `json:"confirmation_method"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+	CanceledAt  *time.Time `json:"canceled_at"`
+	SucceededAt *time.Time `json:"succeeded_at"`
+}
+
+func (m PaymentModel) Insert(ctx context.Context, payment *Payment) error {
+	query := `
+		INSERT INTO payment_intents (
+			stripe_payment_intent_id, amount, currency, status, client_secret, customer_id,
+			metadata, description, receipt_email, shipping_address, billing_address,
+			payment_method_id, payment_method_types, setup_future_usage, capture_method, confirmation_method
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING id, created_at, updated_at`
+
+	metadata, err := marshalMetadata(payment.Metadata)
+	if err != nil {
+		return err
+	}
+
+	args := []any{
+		payment.StripePaymentIntentID,
+		payment.Amount,
+		payment.Currency,
+		payment.Status,
+		payment.ClientSecret,
+		payment.CustomerID,
+		metadata,
+		payment.Description,
+		payment.ReceiptEmail,
+		nullableJSON(payment.ShippingAddress),
+		nullableJSON(payment.BillingAddress),
+		payment.PaymentMethodID,
+		pq.Array(payment.PaymentMethodTypes),
+		payment.SetupFutureUsage,
+		payment.CaptureMethod,
+		payment.ConfirmationMethod,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&payment.ID, &payment.CreatedAt, &payment.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicatePaymentIntent
+		}
+		return err
+	}
+
+	return nil
+}
+
+func marshalMetadata(metadata map[string]string) ([]byte, error) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return json.Marshal(metadata)
+}
+
+// nullableJSON maps an empty raw message to SQL NULL instead of an empty
+// (and invalid) JSONB value.
+func nullableJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return []byte(raw)
+}
+
+// Upsert inserts the payment intent or refreshes the stored copy from the
+// provider's view of it. A payment that already reached a terminal state is
+// not moved back by an older, out-of-order event. statusChanged reports
+// whether the row was created or moved to a new status, so a transition seen
+// both in an API response and in a webhook is only announced once.
+func (m PaymentModel) Upsert(ctx context.Context, payment *Payment) (statusChanged bool, err error) {
+	query := `
+		WITH previous AS (
+			SELECT status FROM payment_intents WHERE stripe_payment_intent_id = $1
+		)
+		INSERT INTO payment_intents (
+			stripe_payment_intent_id, amount, currency, status, metadata, description, receipt_email,
+			shipping_address, payment_method_id, payment_method_types, setup_future_usage, capture_method,
+			confirmation_method, canceled_at, customer_id, confirmed_at, succeeded_at
+		)
+		VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			(SELECT id FROM customers WHERE stripe_customer_id = $15),
+			CASE WHEN $4 IN ('processing', 'requires_capture', 'succeeded') THEN NOW() END,
+			CASE WHEN $4 = 'succeeded' THEN NOW() END
+		)
+		ON CONFLICT (stripe_payment_intent_id) DO UPDATE SET
+			amount = EXCLUDED.amount,
+			status = EXCLUDED.status,
+			metadata = EXCLUDED.metadata,
+			description = EXCLUDED.description,
+			receipt_email = EXCLUDED.receipt_email,
+			shipping_address = EXCLUDED.shipping_address,
+			payment_method_id = COALESCE(EXCLUDED.payment_method_id, payment_intents.payment_method_id),
+			setup_future_usage = EXCLUDED.setup_future_usage,
+			capture_method = EXCLUDED.capture_method,
+			customer_id = COALESCE(EXCLUDED.customer_id, payment_intents.customer_id),
+			canceled_at = COALESCE(payment_intents.canceled_at, EXCLUDED.canceled_at),
+			confirmed_at = COALESCE(payment_intents.confirmed_at, EXCLUDED.confirmed_at),
+			succeeded_at = COALESCE(payment_intents.succeeded_at, EXCLUDED.succeeded_at)
+		WHERE payment_intents.status NOT IN ('succeeded', 'canceled')
+			OR EXCLUDED.status IN ('succeeded', 'canceled')
+		RETURNING id, customer_id, created_at, updated_at,
+			payment_intents.status IS DISTINCT FROM (SELECT status FROM previous)`
+
+	metadata, err := marshalMetadata(payment.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	args := []any{
+		payment.StripePaymentIntentID,
+		payment.Amount,
+		payment.Currency,
+		payment.Status,
+		metadata,
+		payment.Description,
+		payment.ReceiptEmail,
+		nullableJSON(payment.ShippingAddress),
+		payment.PaymentMethodID,
+		pq.Array(payment.PaymentMethodTypes),
+		payment.SetupFutureUsage,
+		payment.CaptureMethod,
+		payment.ConfirmationMethod,
+		payment.CanceledAt,
+		payment.StripeCustomerID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&payment.ID, &payment.CustomerID, &payment.CreatedAt, &payment.UpdatedAt, &statusChanged)
+	if err != nil {
+		// The WHERE clause filtered out a stale update.
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return statusChanged, nil
+}
+
+const paymentColumns = `
+	id, stripe_payment_intent_id, amount, currency, status, client_secret, customer_id,
+	metadata, description, receipt_email, shipping_address, billing_address,
+	payment_method_id, payment_method_types, setup_future_usage, capture_method, confirmation_method,
+	created_at, updated_at, confirmed_at, canceled_at, succeeded_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPayment(row rowScanner) (*Payment, error) {
+	var payment Payment
+	var metadata, shippingAddress, billingAddress []byte
+
+	err := row.Scan(
+		&payment.ID,
+		&payment.StripePaymentIntentID,
+		&payment.Amount,
+		&payment.Currency,
+		&payment.Status,
+		&payment.ClientSecret,
+		&payment.CustomerID,
+		&metadata,
+		&payment.Description,
+		&payment.ReceiptEmail,
+		&shippingAddress,
+		&billingAddress,
+		&payment.PaymentMethodID,
+		pq.Array(&payment.PaymentMethodTypes),
+		&payment.SetupFutureUsage,
+		&payment.CaptureMethod,
+		&payment.ConfirmationMethod,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+		&payment.ConfirmedAt,
+		&payment.CanceledAt,
+		&payment.SucceededAt,
+	)
+	if err != nil {
+		return nil, err
+	}
 
-	StripePaymentOrderID string `json:"stripe_payment_intent_id"`
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &payment.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	payment.ShippingAddress = shippingAddress
+	payment.BillingAddress = billingAddress
 
-	AmountCents int    `json:"amount_cents"`
-	Currency    string `json:"currency"`
+	return &payment, nil
+}
+
+// Get looks a payment up by its ID. IDs that are not valid UUIDs are
+// reported as not found.
+func (m PaymentModel) Get(ctx context.Context, id string) (*Payment, error) {
+	query := `SELECT` + paymentColumns + `
+		FROM payment_intents
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	payment, err := scanPayment(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code == "22P02":
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return payment, nil
+}
+
+// GetAll lists payments, optionally only those created for userID (as
+// recorded in metadata.user_id) and with the given status. Empty filters
+// match everything.
+func (m PaymentModel) GetAll(ctx context.Context, userID string, status string, filters Filters) ([]*Payment, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(),`+paymentColumns+`
+		FROM payment_intents
+		WHERE (metadata->>'user_id' = $1 OR $1 = '')
+		AND (status = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	payments := []*Payment{}
+
+	for rows.Next() {
+		payment, err := scanPayment(countingScanner{rows: rows, total: &totalRecords})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		payments = append(payments, payment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return payments, metadata, nil
+}
+
+// countingScanner prepends the count(*) OVER() column to a row scan.
+type countingScanner struct {
+	rows  *sql.Rows
+	total *int
+}
+
+func (s countingScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append([]any{s.total}, dest...)...)
+}
+
+// GetByStripeID looks a payment up by its provider payment intent ID.
+func (m PaymentModel) GetByStripeID(ctx context.Context, stripePaymentIntentID string) (*Payment, error) {
+	query := `SELECT` + paymentColumns + `
+		FROM payment_intents
+		WHERE stripe_payment_intent_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	payment, err := scanPayment(m.DB.QueryRowContext(ctx, query, stripePaymentIntentID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// GetUncapturedAuthorizations lists manually captured payments still awaiting
+// capture that were authorized before authorizedBefore, oldest first. With
+// unwarnedOnly, payments whose expiry warning was already sent are skipped.
+func (m PaymentModel) GetUncapturedAuthorizations(ctx context.Context, authorizedBefore time.Time, unwarnedOnly bool, limit int) ([]*Payment, error) {
+	query := `SELECT` + paymentColumns + `
+		FROM payment_intents
+		WHERE status = 'requires_capture'
+		AND COALESCE(confirmed_at, created_at) < $1
+		AND (authorization_expiry_warned_at IS NULL OR NOT $2)
+		ORDER BY COALESCE(confirmed_at, created_at) ASC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, authorizedBefore, unwarnedOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []*Payment{}
+
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
 
-	Status    string     `json:"status"`
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt *time.Time `json:"updated_at"`
+// MarkAuthorizationExpiryWarned records that the expiry warning for a
+// payment was sent. ErrRecordNotFound is returned when it already was, so
+// concurrent instances warn only once.
+func (m PaymentModel) MarkAuthorizationExpiryWarned(ctx context.Context, id string) error {
+	query := `
+		UPDATE payment_intents
+		SET authorization_expiry_warned_at = NOW()
+		WHERE id = $1 AND authorization_expiry_warned_at IS NULL`
 
-	PaymentMethod string `json:"payment_method"`
-	Captured      bool   `json:"captured"`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
 
-	FailureReason *string `json:"failure_reason"`
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
 
-	Metadata string `json:"metadata"`
-	Version  int    `json:"-"`
+	return checkRowsAffected(result)
 }
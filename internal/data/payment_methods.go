@@ -0,0 +1,335 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type PaymentMethodModel struct {
+	DB DBTX
+}
+
+// PaymentMethod mirrors a row of the payment_methods table.
+type PaymentMethod struct {
+	ID                    string  `json:"id"`
+	StripePaymentMethodID string  `json:"stripe_payment_method_id"`
+	CustomerID            *string `json:"customer_id"`
+
+	// StripeCustomerID is used to resolve CustomerID on write.
+	StripeCustomerID string `json:"-"`
+
+	Type            string  `json:"type"`
+	CardBrand       *string `json:"card_brand"`
+	CardLast4       *string `json:"card_last4"`
+	CardExpMonth    *int64  `json:"card_exp_month"`
+	CardExpYear     *int64  `json:"card_exp_year"`
+	CardFingerprint *string `json:"-"`
+	CardCountry     *string `json:"card_country"`
+
+	BillingDetails json.RawMessage   `json:"billing_details"`
+	Metadata       map[string]string `json:"metadata"`
+	IsDefault      bool              `json:"is_default"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Upsert inserts the payment method or refreshes the stored copy from the
+// provider's view of it. The default flag is owned by the service; it is
+// only cleared here when the method is detached or moves to another
+// customer.
+func (m PaymentMethodModel) Upsert(ctx context.Context, paymentMethod *PaymentMethod) error {
+	query := `
+		INSERT INTO payment_methods (
+			stripe_payment_method_id, customer_id, type, card_brand, card_last4, card_exp_month,
+			card_exp_year, card_fingerprint, card_country, billing_details, metadata
+		)
+		VALUES (
+			$1, (SELECT id FROM customers WHERE stripe_customer_id = $2), $3, $4, $5, $6, $7, $8, $9, $10, $11
+		)
+		ON CONFLICT (stripe_payment_method_id) DO UPDATE SET
+			customer_id = EXCLUDED.customer_id,
+			is_default = payment_methods.is_default
+				AND EXCLUDED.customer_id IS NOT DISTINCT FROM payment_methods.customer_id,
+			type = EXCLUDED.type,
+			card_brand = EXCLUDED.card_brand,
+			card_last4 = EXCLUDED.card_last4,
+			card_exp_month = EXCLUDED.card_exp_month,
+			card_exp_year = EXCLUDED.card_exp_year,
+			card_fingerprint = EXCLUDED.card_fingerprint,
+			card_country = EXCLUDED.card_country,
+			billing_details = EXCLUDED.billing_details,
+			metadata = EXCLUDED.metadata
+		RETURNING id, customer_id, is_default, created_at, updated_at`
+
+	metadata, err := marshalMetadata(paymentMethod.Metadata)
+	if err != nil {
+		return err
+	}
+
+	args := []any{
+		paymentMethod.StripePaymentMethodID,
+		paymentMethod.StripeCustomerID,
+		paymentMethod.Type,
+		paymentMethod.CardBrand,
+		paymentMethod.CardLast4,
+		paymentMethod.CardExpMonth,
+		paymentMethod.CardExpYear,
+		paymentMethod.CardFingerprint,
+		paymentMethod.CardCountry,
+		nullableJSON(paymentMethod.BillingDetails),
+		metadata,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&paymentMethod.ID,
+		&paymentMethod.CustomerID,
+		&paymentMethod.IsDefault,
+		&paymentMethod.CreatedAt,
+		&paymentMethod.UpdatedAt,
+	)
+}
+
+const paymentMethodColumns = `
+	id, stripe_payment_method_id, customer_id, type, card_brand, card_last4, card_exp_month,
+	card_exp_year, card_fingerprint, card_country, billing_details, metadata, is_default,
+	created_at, updated_at`
+
+func scanPaymentMethod(row rowScanner) (*PaymentMethod, error) {
+	var paymentMethod PaymentMethod
+	var billingDetails, metadata []byte
+
+	err := row.Scan(
+		&paymentMethod.ID,
+		&paymentMethod.StripePaymentMethodID,
+		&paymentMethod.CustomerID,
+		&paymentMethod.Type,
+		&paymentMethod.CardBrand,
+		&paymentMethod.CardLast4,
+		&paymentMethod.CardExpMonth,
+		&paymentMethod.CardExpYear,
+		&paymentMethod.CardFingerprint,
+		&paymentMethod.CardCountry,
+		&billingDetails,
+		&metadata,
+		&paymentMethod.IsDefault,
+		&paymentMethod.CreatedAt,
+		&paymentMethod.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &paymentMethod.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	paymentMethod.BillingDetails = billingDetails
+
+	return &paymentMethod, nil
+}
+
+// GetAllForCustomer lists the payment methods attached to a customer, the
+// default first and then newest first.
+func (m PaymentMethodModel) GetAllForCustomer(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	query := `SELECT` + paymentMethodColumns + `
+		FROM payment_methods
+		WHERE customer_id = $1
+		ORDER BY is_default DESC, created_at DESC, id ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paymentMethods := []*PaymentMethod{}
+
+	for rows.Next() {
+		paymentMethod, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		paymentMethods = append(paymentMethods, paymentMethod)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return paymentMethods, nil
+}
+
+// GetForCustomer looks up a payment method attached to a customer by its ID.
+// IDs that are not valid UUIDs are reported as not found.
+func (m PaymentMethodModel) GetForCustomer(ctx context.Context, customerID, id string) (*PaymentMethod, error) {
+	query := `SELECT` + paymentMethodColumns + `
+		FROM payment_methods
+		WHERE id = $1 AND customer_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	paymentMethod, err := scanPaymentMethod(m.DB.QueryRowContext(ctx, query, id, customerID))
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code == "22P02":
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return paymentMethod, nil
+}
+
+// SetDefault makes a payment method the customer's default. The previous
+// default is cleared first, so idx_unique_default_payment_method holds; it
+// must run in a transaction to be atomic. ErrEditConflict is returned when a
+// concurrent change picked another default first.
+func (m PaymentMethodModel) SetDefault(ctx context.Context, customerID, id string) error {
+	clearQuery := `
+		UPDATE payment_methods
+		SET is_default = FALSE
+		WHERE customer_id = $1 AND is_default AND id <> $2`
+
+	setQuery := `
+		UPDATE payment_methods
+		SET is_default = TRUE
+		WHERE customer_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, clearQuery, customerID, id); err != nil {
+		return err
+	}
+
+	result, err := m.DB.ExecContext(ctx, setQuery, customerID, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrEditConflict
+		}
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// ExpiringCard is a saved card nearing or past its expiry, together with the
+// user to notify.
+type ExpiringCard struct {
+	PaymentMethod *PaymentMethod
+	UserID        *int64
+	Email         *string
+	// ExpiresAt is the first instant the card is no longer valid: cards are
+	// valid through the end of their expiry month (taken as UTC).
+	ExpiresAt time.Time
+}
+
+// GetExpiringCards lists attached cards that expire after after and no later
+// than before, optionally only default ones, for which no notification was
+// recorded for thresholdDays and the card's current expiry date.
+func (m PaymentMethodModel) GetExpiringCards(ctx context.Context, after, before time.Time, defaultOnly bool, thresholdDays, limit int) ([]*ExpiringCard, error) {
+	query := `
+		WITH cards AS (
+			SELECT payment_methods.*, customers.user_id AS customer_user_id, customers.email AS customer_email,
+				(make_date(card_exp_year, card_exp_month, 1) + INTERVAL '1 month') AT TIME ZONE 'UTC' AS expires_at
+			FROM payment_methods
+			JOIN customers ON customers.id = payment_methods.customer_id
+			WHERE payment_methods.type = 'card'
+			AND card_exp_year IS NOT NULL
+			AND card_exp_month BETWEEN 1 AND 12
+		)
+		SELECT` + paymentMethodColumns + `, customer_user_id, customer_email, expires_at
+		FROM cards
+		WHERE expires_at > $1 AND expires_at <= $2
+		AND (is_default OR NOT $3)
+		AND NOT EXISTS (
+			SELECT 1 FROM card_expiry_notifications n
+			WHERE n.payment_method_id = cards.id
+			AND n.threshold_days = $4
+			AND n.card_exp_year = cards.card_exp_year
+			AND n.card_exp_month = cards.card_exp_month
+		)
+		ORDER BY expires_at ASC, id ASC
+		LIMIT $5`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, before, defaultOnly, thresholdDays, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []*ExpiringCard{}
+
+	for rows.Next() {
+		var card ExpiringCard
+
+		card.PaymentMethod, err = scanPaymentMethod(trailingScanner{rows: rows, dest: []any{&card.UserID, &card.Email, &card.ExpiresAt}})
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, &card)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cards, nil
+}
+
+// MarkExpiryNotified records that the owner of a card was notified at
+// thresholdDays for the given expiry date. It reports false when that
+// notification was already recorded, e.g. by another instance.
+func (m PaymentMethodModel) MarkExpiryNotified(ctx context.Context, paymentMethodID string, thresholdDays int, expMonth, expYear int64) (bool, error) {
+	query := `
+		INSERT INTO card_expiry_notifications (payment_method_id, threshold_days, card_exp_month, card_exp_year)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, paymentMethodID, thresholdDays, expMonth, expYear)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// trailingScanner appends extra columns selected after the scanned ones.
+type trailingScanner struct {
+	rows *sql.Rows
+	dest []any
+}
+
+func (s trailingScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append(dest, s.dest...)...)
+}
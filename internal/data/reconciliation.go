@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type ReconciliationModel struct {
+	DB DBTX
+}
+
+// ReconciliationRun is one comparison of the provider's objects created in
+// [RangeFrom, RangeTo) with the stored copies.
+type ReconciliationRun struct {
+	ID             string     `json:"id"`
+	RangeFrom      time.Time  `json:"range_from"`
+	RangeTo        time.Time  `json:"range_to"`
+	AutoHeal       bool       `json:"auto_heal"`
+	Status         string     `json:"status"`
+	ObjectsChecked int        `json:"objects_checked"`
+	FindingsCount  int        `json:"findings_count"`
+	Error          *string    `json:"error"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at"`
+}
+
+// ReconciliationFinding is a discrepancy found by a run. Kind is
+// missing_locally, missing_at_provider or mismatch; a mismatch names the
+// field that differs.
+type ReconciliationFinding struct {
+	ID             string     `json:"id"`
+	RunID          string     `json:"run_id"`
+	ObjectType     string     `json:"object_type"`
+	StripeObjectID string     `json:"stripe_object_id"`
+	Kind           string     `json:"kind"`
+	Field          *string    `json:"field"`
+	ProviderValue  *string    `json:"provider_value"`
+	LocalValue     *string    `json:"local_value"`
+	HealedAt       *time.Time `json:"healed_at"`
+	HealError      *string    `json:"heal_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (m ReconciliationModel) InsertRun(ctx context.Context, run *ReconciliationRun) error {
+	query := `
+		INSERT INTO reconciliation_runs (range_from, range_to, auto_heal)
+		VALUES ($1, $2, $3)
+		RETURNING id, status, started_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, run.RangeFrom, run.RangeTo, run.AutoHeal).Scan(&run.ID, &run.Status, &run.StartedAt)
+}
+
+// FinishRun records the outcome of a run.
+func (m ReconciliationModel) FinishRun(ctx context.Context, run *ReconciliationRun) error {
+	query := `
+		UPDATE reconciliation_runs
+		SET status = $2, objects_checked = $3, findings_count = $4, error = $5, finished_at = NOW()
+		WHERE id = $1
+		RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, run.ID, run.Status, run.ObjectsChecked, run.FindingsCount, run.Error).Scan(&run.FinishedAt)
+}
+
+func (m ReconciliationModel) InsertFinding(ctx context.Context, finding *ReconciliationFinding) error {
+	query := `
+		INSERT INTO reconciliation_findings (
+			run_id, object_type, stripe_object_id, kind, field, provider_value, local_value, healed_at, heal_error
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at`
+
+	args := []any{
+		finding.RunID,
+		finding.ObjectType,
+		finding.StripeObjectID,
+		finding.Kind,
+		finding.Field,
+		finding.ProviderValue,
+		finding.LocalValue,
+		finding.HealedAt,
+		finding.HealError,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&finding.ID, &finding.CreatedAt)
+}
+
+// reconciledTables maps the reconciled object types to their table and
+// provider ID column.
+var reconciledTables = map[string][2]string{
+	"payment_intent": {"payment_intents", "stripe_payment_intent_id"},
+	"charge":         {"charges", "stripe_charge_id"},
+	"refund":         {"refunds", "stripe_refund_id"},
+}
+
+// GetStripeIDsCreatedBetween lists the provider IDs of the stored objects of
+// the given type created in [from, to).
+func (m ReconciliationModel) GetStripeIDsCreatedBetween(ctx context.Context, objectType string, from, to time.Time) ([]string, error) {
+	table, ok := reconciledTables[objectType]
+	if !ok {
+		return nil, fmt.Errorf("unknown reconciliation object type %q", objectType)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE created_at >= $1 AND created_at < $2`, table[1], table[0])
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type RefundModel struct {
+	DB DBTX
+}
+
+// Refund mirrors a row of the refunds table.
+type Refund struct {
+	ID              string  `json:"id"`
+	StripeRefundID  string  `json:"stripe_refund_id"`
+	ChargeID        *string `json:"charge_id"`
+	PaymentIntentID *string `json:"payment_intent_id"`
+
+	// StripeChargeID and StripePaymentIntentID are used to resolve the
+	// foreign keys on write.
+	StripeChargeID        string `json:"-"`
+	StripePaymentIntentID string `json:"-"`
+
+	Amount        int64             `json:"amount"`
+	Currency      string            `json:"currency"`
+	Reason        *string           `json:"reason"`
+	Status        string            `json:"status"`
+	FailureReason *string           `json:"failure_reason"`
+	ReceiptNumber *string           `json:"receipt_number"`
+	Metadata      map[string]string `json:"metadata"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Upsert inserts the refund or refreshes the stored copy from the provider's
+// view of it. Final states are not moved back by older, out-of-order events,
+// except that a succeeded refund may still fail. statusChanged reports
+// whether the row was created or moved to a new status.
+func (m RefundModel) Upsert(ctx context.Context, refund *Refund) (statusChanged bool, err error) {
+	query := `
+		WITH previous AS (
+			SELECT status FROM refunds WHERE stripe_refund_id = $1
+		)
+		INSERT INTO refunds (
+			stripe_refund_id, charge_id, payment_intent_id, amount, currency, reason, status,
+			failure_reason, receipt_number, metadata
+		)
+		VALUES (
+			$1,
+			(SELECT id FROM charges WHERE stripe_charge_id = $2),
+			(SELECT id FROM payment_intents WHERE stripe_payment_intent_id = $3),
+			$4, $5, $6, $7, $8, $9, $10
+		)
+		ON CONFLICT (stripe_refund_id) DO UPDATE SET
+			charge_id = COALESCE(EXCLUDED.charge_id, refunds.charge_id),
+			payment_intent_id = COALESCE(EXCLUDED.payment_intent_id, refunds.payment_intent_id),
+			amount = EXCLUDED.amount,
+			reason = EXCLUDED.reason,
+			status = EXCLUDED.status,
+			failure_reason = EXCLUDED.failure_reason,
+			receipt_number = COALESCE(EXCLUDED.receipt_number, refunds.receipt_number),
+			metadata = EXCLUDED.metadata
+		WHERE refunds.status NOT IN ('succeeded', 'failed', 'canceled')
+			OR refunds.status = EXCLUDED.status
+			OR (refunds.status = 'succeeded' AND EXCLUDED.status = 'failed')
+		RETURNING id, charge_id, payment_intent_id, created_at, updated_at,
+			refunds.status IS DISTINCT FROM (SELECT status FROM previous)`
+
+	metadata, err := marshalMetadata(refund.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	args := []any{
+		refund.StripeRefundID,
+		refund.StripeChargeID,
+		refund.StripePaymentIntentID,
+		refund.Amount,
+		refund.Currency,
+		refund.Reason,
+		refund.Status,
+		refund.FailureReason,
+		refund.ReceiptNumber,
+		metadata,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&refund.ID, &refund.ChargeID, &refund.PaymentIntentID, &refund.CreatedAt, &refund.UpdatedAt, &statusChanged)
+	if err != nil {
+		// The WHERE clause filtered out a stale update.
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return statusChanged, nil
+}
+
+// GetByStripeID looks a refund up by its provider refund ID.
+func (m RefundModel) GetByStripeID(ctx context.Context, stripeRefundID string) (*Refund, error) {
+	query := `
+		SELECT id, stripe_refund_id, charge_id, payment_intent_id, amount, currency, reason, status,
+			failure_reason, receipt_number, metadata, created_at, updated_at
+		FROM refunds
+		WHERE stripe_refund_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var refund Refund
+	var metadata []byte
+
+	err := m.DB.QueryRowContext(ctx, query, stripeRefundID).Scan(
+		&refund.ID,
+		&refund.StripeRefundID,
+		&refund.ChargeID,
+		&refund.PaymentIntentID,
+		&refund.Amount,
+		&refund.Currency,
+		&refund.Reason,
+		&refund.Status,
+		&refund.FailureReason,
+		&refund.ReceiptNumber,
+		&metadata,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &refund.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return &refund, nil
+}
@@ -0,0 +1,382 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type WebhookEventModel struct {
+	DB DBTX
+}
+
+type WebhookEvent struct {
+	ID              string     `json:"id"`
+	StripeEventID   string     `json:"stripe_event_id"`
+	EventType       string     `json:"event_type"`
+	APIVersion      *string    `json:"api_version"`
+	ObjectID        *string    `json:"object_id"`
+	Livemode        bool       `json:"livemode"`
+	PendingWebhooks int64      `json:"pending_webhooks"`
+	RequestID       *string    `json:"request_id"`
+	EventData       []byte     `json:"event_data"`
+	Processed       bool       `json:"processed"`
+	ProcessedAt     *time.Time `json:"processed_at"`
+	ErrorMessage    *string    `json:"error_message"`
+	RetryCount      int        `json:"retry_count"`
+	ReplayCount     int        `json:"replay_count"`
+	LastReplayedAt  *time.Time `json:"last_replayed_at"`
+	SweepCount      int        `json:"sweep_count"`
+	LastSweptAt     *time.Time `json:"last_swept_at"`
+	FailedAt        *time.Time `json:"failed_at"`
+	DeadLetteredAt  *time.Time `json:"dead_lettered_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// Insert stores a newly received event. If an event with the same
+// stripe_event_id already exists ErrDuplicateEvent is returned and the
+// existing row is left untouched.
+func (m WebhookEventModel) Insert(ctx context.Context, event *WebhookEvent) error {
+	query := `
+		INSERT INTO webhook_events (stripe_event_id, event_type, api_version, object_id, livemode, pending_webhooks, request_id, event_data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (stripe_event_id) DO NOTHING
+		RETURNING id, processed, retry_count, created_at`
+
+	args := []any{
+		event.StripeEventID,
+		event.EventType,
+		event.APIVersion,
+		event.ObjectID,
+		event.Livemode,
+		event.PendingWebhooks,
+		event.RequestID,
+		event.EventData,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.Processed, &event.RetryCount, &event.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDuplicateEvent
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m WebhookEventModel) GetByStripeEventID(ctx context.Context, stripeEventID string) (*WebhookEvent, error) {
+	return m.get(ctx, stripeEventID, false)
+}
+
+// GetForUpdate loads the event and locks its row until the surrounding
+// transaction ends, so concurrent deliveries of the same event are
+// processed one at a time.
+func (m WebhookEventModel) GetForUpdate(ctx context.Context, stripeEventID string) (*WebhookEvent, error) {
+	return m.get(ctx, stripeEventID, true)
+}
+
+const webhookEventColumns = `
+	id, stripe_event_id, event_type, api_version, object_id, livemode, pending_webhooks,
+	request_id, event_data, processed, processed_at, error_message, retry_count,
+	replay_count, last_replayed_at, sweep_count, last_swept_at, failed_at,
+	dead_lettered_at, created_at`
+
+func scanWebhookEvent(row rowScanner) (*WebhookEvent, error) {
+	var event WebhookEvent
+
+	err := row.Scan(
+		&event.ID,
+		&event.StripeEventID,
+		&event.EventType,
+		&event.APIVersion,
+		&event.ObjectID,
+		&event.Livemode,
+		&event.PendingWebhooks,
+		&event.RequestID,
+		&event.EventData,
+		&event.Processed,
+		&event.ProcessedAt,
+		&event.ErrorMessage,
+		&event.RetryCount,
+		&event.ReplayCount,
+		&event.LastReplayedAt,
+		&event.SweepCount,
+		&event.LastSweptAt,
+		&event.FailedAt,
+		&event.DeadLetteredAt,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+func (m WebhookEventModel) get(ctx context.Context, stripeEventID string, forUpdate bool) (*WebhookEvent, error) {
+	query := `SELECT` + webhookEventColumns + `
+		FROM webhook_events
+		WHERE stripe_event_id = $1`
+
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	event, err := scanWebhookEvent(m.DB.QueryRowContext(ctx, query, stripeEventID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// MarkProcessed flags the event as handled. note is stored in error_message
+// for events that were acknowledged without being acted upon.
+func (m WebhookEventModel) MarkProcessed(ctx context.Context, stripeEventID string, note *string) error {
+	query := `
+		UPDATE webhook_events
+		SET processed = TRUE, processed_at = NOW(), error_message = $2, failed_at = NULL, dead_lettered_at = NULL
+		WHERE stripe_event_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeEventID, note)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// MarkFailed records the processing error. retryCount mirrors the attempt
+// number carried by the queued message.
+func (m WebhookEventModel) MarkFailed(ctx context.Context, stripeEventID string, errorMessage string, retryCount int) error {
+	query := `
+		UPDATE webhook_events
+		SET error_message = $2, retry_count = $3
+		WHERE stripe_event_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeEventID, errorMessage, retryCount)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// MarkDeadLettered records that the workers gave up on an unprocessed event
+// and parked its message in the dead-letter queue. Such events are not
+// swept; replaying one clears the mark.
+func (m WebhookEventModel) MarkDeadLettered(ctx context.Context, stripeEventID string) error {
+	query := `
+		UPDATE webhook_events
+		SET dead_lettered_at = NOW()
+		WHERE stripe_event_id = $1 AND processed = FALSE`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeEventID)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// WebhookEventFilter selects stored events. Empty fields match everything;
+// From and To bound created_at to [From, To).
+type WebhookEventFilter struct {
+	StripeEventID string
+	EventType     string
+	FailedOnly    bool
+	From          *time.Time
+	To            *time.Time
+	Limit         int
+}
+
+// GetAll lists the events matching the filter, oldest first, so replays
+// apply them in the order they were received.
+func (m WebhookEventModel) GetAll(ctx context.Context, filter WebhookEventFilter) ([]*WebhookEvent, error) {
+	query := `SELECT` + webhookEventColumns + `
+		FROM webhook_events
+		WHERE (stripe_event_id = $1 OR $1 = '')
+		AND (event_type = $2 OR $2 = '')
+		AND (NOT $3 OR (processed = FALSE AND error_message IS NOT NULL))
+		AND (created_at >= $4 OR $4 IS NULL)
+		AND (created_at < $5 OR $5 IS NULL)
+		ORDER BY created_at ASC, id ASC
+		LIMIT $6`
+
+	args := []any{filter.StripeEventID, filter.EventType, filter.FailedOnly, filter.From, filter.To, filter.Limit}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*WebhookEvent{}
+
+	for rows.Next() {
+		event, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// ResetForReplay clears the processing state of an event so the workers
+// handle it again, and counts the replay.
+func (m WebhookEventModel) ResetForReplay(ctx context.Context, stripeEventID string) error {
+	query := `
+		UPDATE webhook_events
+		SET processed = FALSE, processed_at = NULL, error_message = NULL, retry_count = 0,
+			sweep_count = 0, last_swept_at = NULL, failed_at = NULL, dead_lettered_at = NULL, replay_count = replay_count + 1, last_replayed_at = NOW()
+		WHERE stripe_event_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeEventID)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// GetStuck lists the events still unprocessed that were received before
+// stuckBefore and are due for a sweep. An event is due once backoff, doubled
+// for each sweep so far, has passed since it was last swept. Events marked
+// failed or dead-lettered are left out.
+func (m WebhookEventModel) GetStuck(ctx context.Context, stuckBefore time.Time, backoff time.Duration, limit int) ([]*WebhookEvent, error) {
+	query := `SELECT` + webhookEventColumns + `
+		FROM webhook_events
+		WHERE processed = FALSE AND failed_at IS NULL AND dead_lettered_at IS NULL AND created_at < $1
+		AND COALESCE(last_swept_at, created_at) + $2 * POWER(2, LEAST(sweep_count, 10)) * INTERVAL '1 second' <= NOW()
+		ORDER BY created_at ASC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, stuckBefore, backoff.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*WebhookEvent{}
+
+	for rows.Next() {
+		event, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// MarkSwept counts a sweep of an unprocessed event.
+func (m WebhookEventModel) MarkSwept(ctx context.Context, stripeEventID string) error {
+	query := `
+		UPDATE webhook_events
+		SET sweep_count = sweep_count + 1, last_swept_at = NOW()
+		WHERE stripe_event_id = $1 AND processed = FALSE`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, stripeEventID)
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// FailExhausted marks the unprocessed events swept maxAttempts times as
+// permanently failed, so they are no longer swept, and returns their IDs.
+// Replaying an event clears the mark.
+func (m WebhookEventModel) FailExhausted(ctx context.Context, maxAttempts int) ([]string, error) {
+	query := `
+		UPDATE webhook_events
+		SET failed_at = NOW(),
+			error_message = COALESCE(error_message, 'not processed after ' || sweep_count || ' sweeps')
+		WHERE processed = FALSE AND failed_at IS NULL AND dead_lettered_at IS NULL AND sweep_count >= $1
+		RETURNING stripe_event_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// CountUnprocessed returns the number of events received before stuckBefore
+// that are still unprocessed, and the number marked permanently failed or
+// dead-lettered.
+func (m WebhookEventModel) CountUnprocessed(ctx context.Context, stuckBefore time.Time) (stuck int, failed int, err error) {
+	query := `
+		SELECT COUNT(*) FILTER (WHERE failed_at IS NULL AND dead_lettered_at IS NULL AND created_at < $1),
+			COUNT(*) FILTER (WHERE failed_at IS NOT NULL OR dead_lettered_at IS NOT NULL)
+		FROM webhook_events
+		WHERE processed = FALSE`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, stuckBefore).Scan(&stuck, &failed)
+	return stuck, failed, err
+}
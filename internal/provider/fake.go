@@ -0,0 +1,1031 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment method IDs the fake treats as test cards. They mirror Stripe's test
+// payment methods, so client fixtures work against either provider.
+const (
+	FakeCardVisa                   = "pm_card_visa"
+	FakeCardDeclined               = "pm_card_chargeDeclined"
+	FakeCardInsufficientFunds      = "pm_card_chargeDeclinedInsufficientFunds"
+	FakeCardAuthenticationRequired = "pm_card_authenticationRequired"
+)
+
+var fakeCards = map[string]*Card{
+	FakeCardVisa:                   {Brand: "visa", Last4: "4242", Country: "US"},
+	FakeCardDeclined:               {Brand: "visa", Last4: "0002", Country: "US"},
+	FakeCardInsufficientFunds:      {Brand: "visa", Last4: "9995", Country: "US"},
+	FakeCardAuthenticationRequired: {Brand: "visa", Last4: "3155", Country: "US"},
+}
+
+var _ PaymentProvider = (*Fake)(nil)
+
+// ErrSimulatedNetwork is wrapped by the errors FailNext injects by default.
+var ErrSimulatedNetwork = errors.New("simulated network error")
+
+// Fake is a deterministic in-memory PaymentProvider. IDs are sequential and
+// the outcome of a confirmation depends only on the payment method used:
+//
+//	pm_card_visa                            succeeds (or requires_capture for manual capture)
+//	pm_card_chargeDeclined                  is declined with card_declined
+//	pm_card_chargeDeclinedInsufficientFunds is declined with insufficient_funds
+//	pm_card_authenticationRequired          moves to requires_action until CompleteAction
+//
+// Network failures are simulated with FailNext. The fake never sends
+// webhooks; callers that need them must drive the state themselves.
+type Fake struct {
+	mu  sync.Mutex
+	now func() time.Time
+	seq int
+
+	failures       []error
+	intents        map[string]*PaymentIntent
+	refunded       map[string]int64
+	refunds        map[string]*Refund
+	customers      map[string]*Customer
+	paymentMethods map[string]*PaymentMethod
+	disputes       map[string]*Dispute
+	files          map[string]*File
+	// balanceTransactions are created when funds settle, keyed by ID.
+	// chargeSettlements maps charge IDs to theirs.
+	balanceTransactions map[string]*BalanceTransaction
+	chargeSettlements   map[string]string
+	// cards maps every payment method to the test card that decides how it
+	// behaves on confirmation.
+	cards map[string]string
+	// responses holds the result of each create call made with an
+	// idempotency key, returned as-is when the key is reused.
+	responses map[string]any
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		now:                 time.Now,
+		intents:             make(map[string]*PaymentIntent),
+		refunded:            make(map[string]int64),
+		refunds:             make(map[string]*Refund),
+		customers:           make(map[string]*Customer),
+		paymentMethods:      make(map[string]*PaymentMethod),
+		disputes:            make(map[string]*Dispute),
+		files:               make(map[string]*File),
+		balanceTransactions: make(map[string]*BalanceTransaction),
+		chargeSettlements:   make(map[string]string),
+		cards:               make(map[string]string),
+		responses:           make(map[string]any),
+	}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// SetClock replaces the clock used for timestamps.
+func (f *Fake) SetClock(now func() time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+// FailNext makes the next call fail with err without changing any state. A
+// nil err simulates a network error. Calls queue up, one failure per call.
+func (f *Fake) FailNext(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		err = &Error{Kind: ErrUnavailable, Message: "the payment provider could not be reached", Err: ErrSimulatedNetwork}
+	}
+	f.failures = append(f.failures, err)
+}
+
+// CompleteAction simulates the customer finishing (or failing) 3D Secure for
+// a payment intent in requires_action.
+func (f *Fake) CompleteAction(id string, succeed bool) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, err := f.intent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi.Status != "requires_action" {
+		return nil, unexpectedState(pi)
+	}
+
+	pi.NextActionType = ""
+	if succeed {
+		f.authorize(pi)
+	} else {
+		pi.Status = "requires_payment_method"
+		pi.PaymentMethodID = ""
+		pi.LastPaymentError = "We are unable to authenticate your payment method."
+	}
+
+	return clonePaymentIntent(pi), nil
+}
+
+// OpenDispute simulates the cardholder disputing a succeeded payment intent.
+// The dispute needs a response within 7 days.
+func (f *Fake) OpenDispute(paymentIntentID, reason string) (*Dispute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, err := f.intent(paymentIntentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi.Status != "succeeded" {
+		return nil, unexpectedState(pi)
+	}
+
+	dueBy := f.now().Add(7 * 24 * time.Hour)
+	dispute := &Dispute{
+		ID:              f.newID("dp"),
+		ChargeID:        pi.LatestChargeID,
+		PaymentIntentID: pi.ID,
+		Amount:          pi.AmountReceived,
+		Currency:        pi.Currency,
+		Reason:          reason,
+		Status:          "needs_response",
+		EvidenceDueBy:   &dueBy,
+		Created:         f.now(),
+	}
+	f.disputes[dispute.ID] = dispute
+
+	return cloneDispute(dispute), nil
+}
+
+func (f *Fake) CreatePaymentIntent(ctx context.Context, params *CreatePaymentIntentParams) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if pi, ok := f.responses[params.IdempotencyKey].(*PaymentIntent); ok {
+		return clonePaymentIntent(pi), nil
+	}
+
+	if params.Amount <= 0 {
+		return nil, invalidRequest("parameter_invalid_integer", "amount must be greater than zero")
+	}
+	if params.Currency == "" {
+		return nil, invalidRequest("parameter_missing", "currency is required")
+	}
+	if params.CustomerID != nil {
+		if _, ok := f.customers[*params.CustomerID]; !ok {
+			return nil, invalidRequest("resource_missing", fmt.Sprintf("No such customer: '%s'", *params.CustomerID))
+		}
+	}
+
+	id := f.newID("pi")
+	pi := &PaymentIntent{
+		ID:                 id,
+		Amount:             params.Amount,
+		Currency:           params.Currency,
+		Status:             "requires_payment_method",
+		CaptureMethod:      params.CaptureMethod,
+		ConfirmationMethod: "automatic",
+		ClientSecret:       id + "_secret_fake",
+		PaymentMethodTypes: slices.Clone(params.PaymentMethodTypes),
+		Metadata:           maps.Clone(params.Metadata),
+		Created:            f.now(),
+	}
+	if pi.CaptureMethod == "" {
+		pi.CaptureMethod = "automatic"
+	}
+	if len(pi.PaymentMethodTypes) == 0 {
+		pi.PaymentMethodTypes = []string{"card"}
+	}
+	if params.Description != nil {
+		pi.Description = *params.Description
+	}
+	if params.ReceiptEmail != nil {
+		pi.ReceiptEmail = *params.ReceiptEmail
+	}
+	if params.CustomerID != nil {
+		pi.CustomerID = *params.CustomerID
+	}
+	if params.SetupFutureUsage != nil {
+		pi.SetupFutureUsage = *params.SetupFutureUsage
+	}
+	if params.PaymentMethodID != nil {
+		if _, err := f.paymentMethod(*params.PaymentMethodID); err != nil {
+			return nil, err
+		}
+		pi.PaymentMethodID = *params.PaymentMethodID
+		pi.Status = "requires_confirmation"
+	}
+
+	f.intents[pi.ID] = pi
+
+	if params.Confirm {
+		if err := f.confirm(pi, params.OffSession); err != nil {
+			return nil, err
+		}
+	}
+
+	f.remember(params.IdempotencyKey, clonePaymentIntent(pi))
+
+	return clonePaymentIntent(pi), nil
+}
+
+func (f *Fake) GetPaymentIntent(ctx context.Context, id string) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	pi, err := f.intent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return clonePaymentIntent(pi), nil
+}
+
+func (f *Fake) ConfirmPaymentIntent(ctx context.Context, id string, params *ConfirmPaymentIntentParams) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	pi, err := f.intent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi.Status != "requires_payment_method" && pi.Status != "requires_confirmation" {
+		return nil, unexpectedState(pi)
+	}
+
+	if params.PaymentMethodID != nil {
+		if _, err := f.paymentMethod(*params.PaymentMethodID); err != nil {
+			return nil, err
+		}
+		pi.PaymentMethodID = *params.PaymentMethodID
+	}
+
+	if err := f.confirm(pi, false); err != nil {
+		return nil, err
+	}
+
+	return clonePaymentIntent(pi), nil
+}
+
+func (f *Fake) CapturePaymentIntent(ctx context.Context, id string, params *CapturePaymentIntentParams) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	pi, err := f.intent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi.Status != "requires_capture" {
+		return nil, unexpectedState(pi)
+	}
+
+	amount := pi.AmountCapturable
+	if params.AmountToCapture != nil {
+		amount = *params.AmountToCapture
+	}
+	if amount <= 0 || amount > pi.AmountCapturable {
+		return nil, invalidRequest("amount_too_large", fmt.Sprintf("amount_to_capture must be between 1 and %d", pi.AmountCapturable))
+	}
+
+	pi.Status = "succeeded"
+	pi.AmountReceived = amount
+	pi.AmountCapturable = 0
+	f.settle(pi)
+
+	return clonePaymentIntent(pi), nil
+}
+
+func (f *Fake) CancelPaymentIntent(ctx context.Context, id string, params *CancelPaymentIntentParams) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	pi, err := f.intent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi.Status == "succeeded" || pi.Status == "canceled" {
+		return nil, unexpectedState(pi)
+	}
+
+	canceledAt := f.now()
+	pi.Status = "canceled"
+	pi.AmountCapturable = 0
+	pi.NextActionType = ""
+	pi.CanceledAt = &canceledAt
+	if params.CancellationReason != nil {
+		pi.CancellationReason = *params.CancellationReason
+	}
+
+	return clonePaymentIntent(pi), nil
+}
+
+func (f *Fake) CreateRefund(ctx context.Context, params *CreateRefundParams) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if refund, ok := f.responses[params.IdempotencyKey].(*Refund); ok {
+		return cloneRefund(refund), nil
+	}
+
+	pi, ok := f.intents[params.PaymentIntentID]
+	if !ok {
+		return nil, invalidRequest("resource_missing", fmt.Sprintf("No such payment_intent: '%s'", params.PaymentIntentID))
+	}
+
+	if pi.Status != "succeeded" {
+		return nil, invalidRequest("charge_not_refundable", "This PaymentIntent does not have a successful charge to refund.")
+	}
+
+	remaining := pi.AmountReceived - f.refunded[pi.ID]
+	amount := remaining
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, invalidRequest("amount_too_large", fmt.Sprintf("Refund amount must be between 1 and the unrefunded amount (%d)", remaining))
+	}
+
+	f.refunded[pi.ID] += amount
+
+	refund := &Refund{
+		ID:              f.newID("re"),
+		PaymentIntentID: pi.ID,
+		ChargeID:        pi.LatestChargeID,
+		Amount:          amount,
+		Currency:        pi.Currency,
+		Status:          "succeeded",
+		Metadata:        maps.Clone(params.Metadata),
+		Created:         f.now(),
+	}
+	if params.Reason != nil {
+		refund.Reason = *params.Reason
+	}
+
+	f.refunds[refund.ID] = cloneRefund(refund)
+	f.remember(params.IdempotencyKey, cloneRefund(refund))
+
+	return refund, nil
+}
+
+func (f *Fake) CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if customer, ok := f.responses[params.IdempotencyKey].(*Customer); ok {
+		return cloneCustomer(customer), nil
+	}
+
+	customer := &Customer{
+		ID:      f.newID("cus"),
+		Created: f.now(),
+	}
+	applyCustomerParams(customer, params)
+
+	f.customers[customer.ID] = customer
+	f.remember(params.IdempotencyKey, cloneCustomer(customer))
+
+	return cloneCustomer(customer), nil
+}
+
+func (f *Fake) UpdateCustomer(ctx context.Context, id string, params *CustomerParams) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	customer, ok := f.customers[id]
+	if !ok {
+		return nil, notFound("customer", id)
+	}
+	applyCustomerParams(customer, params)
+
+	return cloneCustomer(customer), nil
+}
+
+func (f *Fake) DeleteCustomer(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return err
+	}
+
+	if _, ok := f.customers[id]; !ok {
+		return notFound("customer", id)
+	}
+	delete(f.customers, id)
+
+	for _, pm := range f.paymentMethods {
+		if pm.CustomerID == id {
+			pm.CustomerID = ""
+		}
+	}
+
+	return nil
+}
+
+// CreateSetupIntent records a setup intent awaiting a payment method. The
+// fake has no client side, so saving a card is simulated with
+// AttachPaymentMethod.
+func (f *Fake) CreateSetupIntent(ctx context.Context, params *CreateSetupIntentParams) (*SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if intent, ok := f.responses[params.IdempotencyKey].(*SetupIntent); ok {
+		return cloneSetupIntent(intent), nil
+	}
+
+	if _, ok := f.customers[params.CustomerID]; !ok {
+		return nil, invalidRequest("resource_missing", fmt.Sprintf("No such customer: '%s'", params.CustomerID))
+	}
+
+	id := f.newID("seti")
+	intent := &SetupIntent{
+		ID:                 id,
+		ClientSecret:       id + "_secret_fake",
+		Status:             "requires_payment_method",
+		CustomerID:         params.CustomerID,
+		PaymentMethodTypes: slices.Clone(params.PaymentMethodTypes),
+		Usage:              params.Usage,
+		Metadata:           maps.Clone(params.Metadata),
+		Created:            f.now(),
+	}
+	if len(intent.PaymentMethodTypes) == 0 {
+		intent.PaymentMethodTypes = []string{"card"}
+	}
+	if intent.Usage == "" {
+		intent.Usage = "off_session"
+	}
+
+	f.remember(params.IdempotencyKey, cloneSetupIntent(intent))
+
+	return intent, nil
+}
+
+func (f *Fake) AttachPaymentMethod(ctx context.Context, paymentMethodID, customerID string) (*PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, invalidRequest("resource_missing", fmt.Sprintf("No such customer: '%s'", customerID))
+	}
+
+	pm, err := f.paymentMethod(paymentMethodID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like Stripe, attaching a test card creates a new payment method rather
+	// than attaching the shared one.
+	if _, ok := fakeCards[pm.ID]; ok {
+		card := *pm.Card
+		attached := &PaymentMethod{
+			ID:      f.newID("pm"),
+			Type:    pm.Type,
+			Card:    &card,
+			Created: f.now(),
+		}
+		f.paymentMethods[attached.ID] = attached
+		f.cards[attached.ID] = pm.ID
+		pm = attached
+	}
+
+	if pm.CustomerID != "" {
+		return nil, invalidRequest("payment_method_unexpected_state", "The payment method you provided has already been attached to a customer.")
+	}
+	pm.CustomerID = customerID
+
+	return clonePaymentMethod(pm), nil
+}
+
+func (f *Fake) DetachPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	pm, ok := f.paymentMethods[paymentMethodID]
+	if !ok {
+		return nil, notFound("payment_method", paymentMethodID)
+	}
+
+	if pm.CustomerID == "" {
+		return nil, invalidRequest("payment_method_unexpected_state", "The payment method you provided is not attached to a customer so detachment is impossible.")
+	}
+	pm.CustomerID = ""
+
+	return clonePaymentMethod(pm), nil
+}
+
+func (f *Fake) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	var paymentMethods []*PaymentMethod
+	for _, pm := range f.paymentMethods {
+		if pm.CustomerID == customerID {
+			paymentMethods = append(paymentMethods, clonePaymentMethod(pm))
+		}
+	}
+
+	// IDs are sequential, so this is creation order.
+	slices.SortFunc(paymentMethods, func(a, b *PaymentMethod) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return paymentMethods, nil
+}
+
+// confirm decides the outcome of a confirmation from the test card behind the
+// payment method. Declines update the intent and return a card error, as
+// Stripe does.
+func (f *Fake) confirm(pi *PaymentIntent, offSession bool) error {
+	if pi.PaymentMethodID == "" {
+		return invalidRequest("payment_intent_unexpected_state", "You cannot confirm this PaymentIntent because it's missing a payment method.")
+	}
+
+	pi.LastPaymentError = ""
+
+	switch f.cards[pi.PaymentMethodID] {
+	case FakeCardDeclined:
+		return f.decline(pi, "generic_decline", "Your card was declined.")
+	case FakeCardInsufficientFunds:
+		return f.decline(pi, "insufficient_funds", "Your card has insufficient funds.")
+	case FakeCardAuthenticationRequired:
+		if offSession {
+			return f.decline(pi, "authentication_required", "Your card was declined. This transaction requires authentication.")
+		}
+		pi.Status = "requires_action"
+		pi.NextActionType = "use_stripe_sdk"
+		return nil
+	default:
+		f.authorize(pi)
+		return nil
+	}
+}
+
+func (f *Fake) authorize(pi *PaymentIntent) {
+	pi.LatestChargeID = f.newID("ch")
+
+	if pi.CaptureMethod == "manual" {
+		pi.Status = "requires_capture"
+		pi.AmountCapturable = pi.Amount
+		return
+	}
+
+	pi.Status = "succeeded"
+	pi.AmountReceived = pi.Amount
+	f.settle(pi)
+}
+
+// settle records the balance transaction of a succeeded charge with a fee
+// of 2.9% + 30.
+func (f *Fake) settle(pi *PaymentIntent) {
+	fee := pi.AmountReceived*29/1000 + 30
+
+	txn := &BalanceTransaction{
+		ID:       f.newID("txn"),
+		Amount:   pi.AmountReceived,
+		Fee:      fee,
+		Net:      pi.AmountReceived - fee,
+		Currency: pi.Currency,
+		Type:     "charge",
+		SourceID: pi.LatestChargeID,
+		Created:  f.now(),
+	}
+	f.balanceTransactions[txn.ID] = txn
+	f.chargeSettlements[pi.LatestChargeID] = txn.ID
+}
+
+func (f *Fake) decline(pi *PaymentIntent, declineCode, message string) error {
+	pi.Status = "requires_payment_method"
+	pi.PaymentMethodID = ""
+	pi.LatestChargeID = f.newID("ch")
+	pi.LastPaymentError = message
+
+	return &Error{
+		Kind:          ErrCardDeclined,
+		Code:          "card_declined",
+		DeclineCode:   declineCode,
+		Message:       message,
+		PaymentIntent: clonePaymentIntent(pi),
+	}
+}
+
+func (f *Fake) takeFailure() error {
+	if len(f.failures) == 0 {
+		return nil
+	}
+
+	err := f.failures[0]
+	f.failures = f.failures[1:]
+	return err
+}
+
+func (f *Fake) remember(idempotencyKey string, response any) {
+	if idempotencyKey != "" {
+		f.responses[idempotencyKey] = response
+	}
+}
+
+func (f *Fake) newID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%06d", prefix, f.seq)
+}
+
+func (f *Fake) intent(id string) (*PaymentIntent, error) {
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, notFound("payment_intent", id)
+	}
+	return pi, nil
+}
+
+// paymentMethod looks up a payment method, creating the shared test card on
+// first use.
+func (f *Fake) paymentMethod(id string) (*PaymentMethod, error) {
+	if pm, ok := f.paymentMethods[id]; ok {
+		return pm, nil
+	}
+
+	card, ok := fakeCards[id]
+	if !ok {
+		return nil, invalidRequest("resource_missing", fmt.Sprintf("No such PaymentMethod: '%s'", id))
+	}
+
+	c := *card
+	c.ExpMonth = 12
+	c.ExpYear = int64(f.now().Year() + 2)
+	c.Fingerprint = "fp_fake_" + c.Last4
+
+	pm := &PaymentMethod{
+		ID:      id,
+		Type:    "card",
+		Card:    &c,
+		Created: f.now(),
+	}
+	f.paymentMethods[id] = pm
+	f.cards[id] = id
+
+	return pm, nil
+}
+
+func applyCustomerParams(customer *Customer, params *CustomerParams) {
+	if params.Email != nil {
+		customer.Email = *params.Email
+	}
+	if params.Name != nil {
+		customer.Name = *params.Name
+	}
+	if params.Phone != nil {
+		customer.Phone = *params.Phone
+	}
+	if params.Description != nil {
+		customer.Description = *params.Description
+	}
+
+	// Metadata is merged and an empty value removes the key, as on Stripe.
+	for key, value := range params.Metadata {
+		if customer.Metadata == nil {
+			customer.Metadata = make(map[string]string)
+		}
+		if value == "" {
+			delete(customer.Metadata, key)
+			continue
+		}
+		customer.Metadata[key] = value
+	}
+}
+
+func invalidRequest(code, message string) error {
+	return &Error{Kind: ErrInvalidRequest, Code: code, Message: message}
+}
+
+func notFound(object, id string) error {
+	return &Error{Kind: ErrNotFound, Code: "resource_missing", Message: fmt.Sprintf("No such %s: '%s'", object, id)}
+}
+
+func unexpectedState(pi *PaymentIntent) error {
+	return &Error{
+		Kind:          ErrInvalidRequest,
+		Code:          "payment_intent_unexpected_state",
+		Message:       fmt.Sprintf("This PaymentIntent's status is %s, which does not allow this operation.", pi.Status),
+		PaymentIntent: clonePaymentIntent(pi),
+	}
+}
+
+func clonePaymentIntent(pi *PaymentIntent) *PaymentIntent {
+	c := *pi
+	c.PaymentMethodTypes = slices.Clone(pi.PaymentMethodTypes)
+	c.Metadata = maps.Clone(pi.Metadata)
+	if pi.CanceledAt != nil {
+		canceledAt := *pi.CanceledAt
+		c.CanceledAt = &canceledAt
+	}
+	return &c
+}
+
+func cloneRefund(refund *Refund) *Refund {
+	c := *refund
+	c.Metadata = maps.Clone(refund.Metadata)
+	return &c
+}
+
+func cloneCustomer(customer *Customer) *Customer {
+	c := *customer
+	c.Metadata = maps.Clone(customer.Metadata)
+	return &c
+}
+
+func (f *Fake) UpdateDispute(ctx context.Context, id string, params *UpdateDisputeParams) (*Dispute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	dispute, ok := f.disputes[id]
+	if !ok {
+		return nil, notFound("dispute", id)
+	}
+
+	if dispute.Status != "needs_response" && dispute.Status != "warning_needs_response" {
+		return nil, invalidRequest("dispute_already_submitted", "This dispute is already closed or its evidence was already submitted.")
+	}
+
+	if len(params.Evidence) > 0 {
+		dispute.HasEvidence = true
+	}
+	if params.Submit {
+		dispute.SubmissionCount++
+		if dispute.Status == "warning_needs_response" {
+			dispute.Status = "warning_under_review"
+		} else {
+			dispute.Status = "under_review"
+		}
+	}
+
+	return cloneDispute(dispute), nil
+}
+
+func (f *Fake) UploadFile(ctx context.Context, params *UploadFileParams) (*File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	if file, ok := f.responses[params.IdempotencyKey].(*File); ok {
+		c := *file
+		return &c, nil
+	}
+
+	size, err := io.Copy(io.Discard, params.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		ID:       f.newID("file"),
+		Filename: params.Filename,
+		Purpose:  params.Purpose,
+		Size:     size,
+		Created:  f.now(),
+	}
+	f.files[file.ID] = file
+
+	c := *file
+	f.remember(params.IdempotencyKey, &c)
+
+	return file, nil
+}
+
+func (f *Fake) GetBalanceTransaction(ctx context.Context, id string) (*BalanceTransaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeFailure(); err != nil {
+		return nil, err
+	}
+
+	txn, ok := f.balanceTransactions[id]
+	if !ok {
+		return nil, notFound("balance_transaction", id)
+	}
+
+	c := *txn
+	return &c, nil
+}
+
+func (f *Fake) ListPaymentIntents(ctx context.Context, params *ListParams, fn func(*PaymentIntent) error) error {
+	f.mu.Lock()
+
+	if err := f.takeFailure(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+
+	var intents []*PaymentIntent
+	for _, pi := range f.intents {
+		if inRange(pi.Created, params) {
+			intents = append(intents, clonePaymentIntent(pi))
+		}
+	}
+	f.mu.Unlock()
+
+	slices.SortFunc(intents, func(a, b *PaymentIntent) int { return newestFirst(a.Created, b.Created, a.ID, b.ID) })
+
+	for _, pi := range intents {
+		if err := fn(pi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListCharges derives the charges from the payment intents, as the fake only
+// keeps track of their latest charge.
+func (f *Fake) ListCharges(ctx context.Context, params *ListParams, fn func(*Charge) error) error {
+	f.mu.Lock()
+
+	if err := f.takeFailure(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+
+	var charges []*Charge
+	for _, pi := range f.intents {
+		if pi.LatestChargeID == "" || !inRange(pi.Created, params) {
+			continue
+		}
+
+		charge := &Charge{
+			ID:                   pi.LatestChargeID,
+			PaymentIntentID:      pi.ID,
+			Amount:               pi.Amount,
+			AmountCaptured:       pi.AmountReceived,
+			AmountRefunded:       f.refunded[pi.ID],
+			Currency:             pi.Currency,
+			Status:               "succeeded",
+			BalanceTransactionID: f.chargeSettlements[pi.LatestChargeID],
+			Metadata:             maps.Clone(pi.Metadata),
+			Created:              pi.Created,
+		}
+
+		switch pi.Status {
+		case "succeeded":
+			charge.Paid = true
+			charge.Captured = true
+			charge.Refunded = charge.AmountRefunded == charge.AmountCaptured
+		case "requires_capture":
+			charge.Paid = true
+		case "canceled":
+			// A canceled authorization is refunded in full.
+			charge.Paid = true
+			charge.Refunded = true
+			charge.AmountRefunded = charge.Amount
+		default:
+			charge.Status = "failed"
+		}
+
+		charges = append(charges, charge)
+	}
+	f.mu.Unlock()
+
+	slices.SortFunc(charges, func(a, b *Charge) int { return newestFirst(a.Created, b.Created, a.ID, b.ID) })
+
+	for _, charge := range charges {
+		if err := fn(charge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *Fake) ListRefunds(ctx context.Context, params *ListParams, fn func(*Refund) error) error {
+	f.mu.Lock()
+
+	if err := f.takeFailure(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+
+	var refunds []*Refund
+	for _, refund := range f.refunds {
+		if inRange(refund.Created, params) {
+			refunds = append(refunds, cloneRefund(refund))
+		}
+	}
+	f.mu.Unlock()
+
+	slices.SortFunc(refunds, func(a, b *Refund) int { return newestFirst(a.Created, b.Created, a.ID, b.ID) })
+
+	for _, refund := range refunds {
+		if err := fn(refund); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func inRange(created time.Time, params *ListParams) bool {
+	return !created.Before(params.CreatedFrom) && created.Before(params.CreatedTo)
+}
+
+// newestFirst orders like the Stripe list endpoints. IDs break ties, as
+// the fake's clock may return the same time twice.
+func newestFirst(a, b time.Time, aID, bID string) int {
+	if c := b.Compare(a); c != 0 {
+		return c
+	}
+	return strings.Compare(bID, aID)
+}
+
+func cloneDispute(dispute *Dispute) *Dispute {
+	c := *dispute
+	c.Metadata = maps.Clone(dispute.Metadata)
+	if dispute.EvidenceDueBy != nil {
+		dueBy := *dispute.EvidenceDueBy
+		c.EvidenceDueBy = &dueBy
+	}
+	return &c
+}
+
+func cloneSetupIntent(intent *SetupIntent) *SetupIntent {
+	c := *intent
+	c.PaymentMethodTypes = slices.Clone(intent.PaymentMethodTypes)
+	c.Metadata = maps.Clone(intent.Metadata)
+	return &c
+}
+
+func clonePaymentMethod(pm *PaymentMethod) *PaymentMethod {
+	c := *pm
+	c.Metadata = maps.Clone(pm.Metadata)
+	if pm.Card != nil {
+		card := *pm.Card
+		c.Card = &card
+	}
+	return &c
+}
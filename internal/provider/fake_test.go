@@ -0,0 +1,184 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFakeConfirmOutcomes(t *testing.T) {
+	tests := []struct {
+		name          string
+		card          string
+		captureMethod string
+		offSession    bool
+
+		wantStatus      string
+		wantNextAction  string
+		wantDeclineCode string
+	}{
+		{name: "succeeds", card: FakeCardVisa, wantStatus: "succeeded"},
+		{name: "manual capture", card: FakeCardVisa, captureMethod: "manual", wantStatus: "requires_capture"},
+		{name: "declined", card: FakeCardDeclined, wantStatus: "requires_payment_method", wantDeclineCode: "generic_decline"},
+		{name: "insufficient funds", card: FakeCardInsufficientFunds, wantStatus: "requires_payment_method", wantDeclineCode: "insufficient_funds"},
+		{name: "requires action", card: FakeCardAuthenticationRequired, wantStatus: "requires_action", wantNextAction: "use_stripe_sdk"},
+		{name: "requires action off session", card: FakeCardAuthenticationRequired, offSession: true, wantStatus: "requires_payment_method", wantDeclineCode: "authentication_required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake()
+
+			pi, err := f.CreatePaymentIntent(t.Context(), &CreatePaymentIntentParams{
+				Amount:          1000,
+				Currency:        "eur",
+				CaptureMethod:   tt.captureMethod,
+				PaymentMethodID: &tt.card,
+				Confirm:         true,
+				OffSession:      tt.offSession,
+			})
+
+			if tt.wantDeclineCode != "" {
+				var perr *Error
+				if !errors.As(err, &perr) {
+					t.Fatalf("err = %v, want a provider error", err)
+				}
+				if !errors.Is(err, ErrCardDeclined) {
+					t.Errorf("kind = %v, want %v", perr.Kind, ErrCardDeclined)
+				}
+				if perr.DeclineCode != tt.wantDeclineCode {
+					t.Errorf("decline code = %q, want %q", perr.DeclineCode, tt.wantDeclineCode)
+				}
+				if perr.PaymentIntent == nil {
+					t.Fatal("declined error carries no payment intent")
+				}
+				pi = perr.PaymentIntent
+			} else if err != nil {
+				t.Fatalf("CreatePaymentIntent: %v", err)
+			}
+
+			if pi.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", pi.Status, tt.wantStatus)
+			}
+			if pi.NextActionType != tt.wantNextAction {
+				t.Errorf("next action = %q, want %q", pi.NextActionType, tt.wantNextAction)
+			}
+		})
+	}
+}
+
+func TestFakeCompleteAction(t *testing.T) {
+	tests := []struct {
+		name       string
+		succeed    bool
+		wantStatus string
+	}{
+		{name: "authenticated", succeed: true, wantStatus: "succeeded"},
+		{name: "authentication failed", succeed: false, wantStatus: "requires_payment_method"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake()
+
+			card := FakeCardAuthenticationRequired
+			pi, err := f.CreatePaymentIntent(t.Context(), &CreatePaymentIntentParams{
+				Amount:          1000,
+				Currency:        "eur",
+				PaymentMethodID: &card,
+				Confirm:         true,
+			})
+			if err != nil {
+				t.Fatalf("CreatePaymentIntent: %v", err)
+			}
+
+			pi, err = f.CompleteAction(pi.ID, tt.succeed)
+			if err != nil {
+				t.Fatalf("CompleteAction: %v", err)
+			}
+
+			if pi.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", pi.Status, tt.wantStatus)
+			}
+			if pi.NextActionType != "" {
+				t.Errorf("next action = %q, want none", pi.NextActionType)
+			}
+		})
+	}
+}
+
+func TestFakeCaptureAndRefund(t *testing.T) {
+	f := NewFake()
+
+	card := FakeCardVisa
+	pi, err := f.CreatePaymentIntent(t.Context(), &CreatePaymentIntentParams{
+		Amount:          1000,
+		Currency:        "eur",
+		CaptureMethod:   "manual",
+		PaymentMethodID: &card,
+		Confirm:         true,
+	})
+	if err != nil {
+		t.Fatalf("CreatePaymentIntent: %v", err)
+	}
+
+	amount := int64(600)
+	pi, err = f.CapturePaymentIntent(t.Context(), pi.ID, &CapturePaymentIntentParams{AmountToCapture: &amount})
+	if err != nil {
+		t.Fatalf("CapturePaymentIntent: %v", err)
+	}
+	if pi.Status != "succeeded" || pi.AmountReceived != amount {
+		t.Errorf("captured intent is %q with %d received, want succeeded with %d", pi.Status, pi.AmountReceived, amount)
+	}
+
+	refund, err := f.CreateRefund(t.Context(), &CreateRefundParams{PaymentIntentID: pi.ID})
+	if err != nil {
+		t.Fatalf("CreateRefund: %v", err)
+	}
+	if refund.Amount != amount {
+		t.Errorf("refund amount = %d, want the captured %d", refund.Amount, amount)
+	}
+
+	_, err = f.CreateRefund(t.Context(), &CreateRefundParams{PaymentIntentID: pi.ID})
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("refunding a fully refunded intent: err = %v, want %v", err, ErrInvalidRequest)
+	}
+}
+
+func TestFakeFailNext(t *testing.T) {
+	f := NewFake()
+	f.FailNext(nil)
+
+	params := &CreatePaymentIntentParams{Amount: 1000, Currency: "eur"}
+
+	_, err := f.CreatePaymentIntent(t.Context(), params)
+	if !errors.Is(err, ErrSimulatedNetwork) {
+		t.Errorf("err = %v, want %v", err, ErrSimulatedNetwork)
+	}
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("err = %v, want kind %v", err, ErrUnavailable)
+	}
+
+	if _, err := f.CreatePaymentIntent(t.Context(), params); err != nil {
+		t.Errorf("call after the failure: %v", err)
+	}
+}
+
+func TestFakeIdempotencyKey(t *testing.T) {
+	f := NewFake()
+
+	params := &CreatePaymentIntentParams{Amount: 1000, Currency: "eur", IdempotencyKey: "key"}
+
+	first, err := f.CreatePaymentIntent(t.Context(), params)
+	if err != nil {
+		t.Fatalf("CreatePaymentIntent: %v", err)
+	}
+
+	second, err := f.CreatePaymentIntent(t.Context(), params)
+	if err != nil {
+		t.Fatalf("CreatePaymentIntent with the same key: %v", err)
+	}
+
+	if second.ID != first.ID {
+		t.Errorf("reused key created %s, want %s again", second.ID, first.ID)
+	}
+}
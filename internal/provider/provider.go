@@ -0,0 +1,321 @@
+// Package provider abstracts the payment processor behind the service. Handlers
+// only talk to a PaymentProvider, so the processor can be swapped (or faked)
+// without touching them.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// PaymentProvider is the set of processor operations the service relies on.
+// Amounts are always in the smallest currency unit. Params with an
+// IdempotencyKey are safe to retry: the provider returns the original result
+// instead of performing the operation twice.
+type PaymentProvider interface {
+	// Name identifies the provider in logs and configuration, e.g. "stripe".
+	Name() string
+
+	CreatePaymentIntent(ctx context.Context, params *CreatePaymentIntentParams) (*PaymentIntent, error)
+	GetPaymentIntent(ctx context.Context, id string) (*PaymentIntent, error)
+	ConfirmPaymentIntent(ctx context.Context, id string, params *ConfirmPaymentIntentParams) (*PaymentIntent, error)
+	CapturePaymentIntent(ctx context.Context, id string, params *CapturePaymentIntentParams) (*PaymentIntent, error)
+	CancelPaymentIntent(ctx context.Context, id string, params *CancelPaymentIntentParams) (*PaymentIntent, error)
+
+	CreateRefund(ctx context.Context, params *CreateRefundParams) (*Refund, error)
+
+	CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error)
+	UpdateCustomer(ctx context.Context, id string, params *CustomerParams) (*Customer, error)
+	// DeleteCustomer deletes the customer and detaches its payment methods.
+	DeleteCustomer(ctx context.Context, id string) error
+
+	// CreateSetupIntent starts saving a payment method for later use without
+	// charging it. The client confirms it with the returned client secret.
+	CreateSetupIntent(ctx context.Context, params *CreateSetupIntentParams) (*SetupIntent, error)
+	AttachPaymentMethod(ctx context.Context, paymentMethodID, customerID string) (*PaymentMethod, error)
+	DetachPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error)
+	ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error)
+
+	// UpdateDispute stages evidence on a dispute and, with Submit, sends it
+	// to the card network. Submitted evidence cannot be changed.
+	UpdateDispute(ctx context.Context, id string, params *UpdateDisputeParams) (*Dispute, error)
+	// UploadFile stores a file at the provider, e.g. dispute evidence, so it
+	// can be referenced by ID.
+	UploadFile(ctx context.Context, params *UploadFileParams) (*File, error)
+
+	// GetBalanceTransaction returns the movement of funds behind a charge,
+	// refund or dispute, including the provider's fee.
+	GetBalanceTransaction(ctx context.Context, id string) (*BalanceTransaction, error)
+
+	// ListPaymentIntents, ListCharges and ListRefunds call fn for every
+	// object created in the range, newest first, fetching further pages as
+	// needed. They stop at the first error fn returns.
+	ListPaymentIntents(ctx context.Context, params *ListParams, fn func(*PaymentIntent) error) error
+	ListCharges(ctx context.Context, params *ListParams, fn func(*Charge) error) error
+	ListRefunds(ctx context.Context, params *ListParams, fn func(*Refund) error) error
+}
+
+// Error kinds returned by providers. Match them with errors.Is; the concrete
+// error is an *Error carrying the provider's code and message.
+var (
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrCardDeclined   = errors.New("card declined")
+	ErrNotFound       = errors.New("resource not found")
+	ErrUnavailable    = errors.New("provider unavailable")
+)
+
+// Error is a failed provider call. Message is safe to show to API clients.
+type Error struct {
+	Kind        error
+	Code        string
+	DeclineCode string
+	Message     string
+
+	// PaymentIntent is set when the failure left a payment intent behind,
+	// as with a declined confirmation.
+	PaymentIntent *PaymentIntent
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return e.Kind.Error() + " (" + e.Code + "): " + e.Message
+	}
+	return e.Kind.Error() + ": " + e.Message
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+type PaymentIntent struct {
+	ID                 string
+	Amount             int64
+	AmountCapturable   int64
+	AmountReceived     int64
+	Currency           string
+	Status             string
+	CaptureMethod      string
+	ConfirmationMethod string
+	ClientSecret       string
+	Description        string
+	ReceiptEmail       string
+	CustomerID         string
+	PaymentMethodID    string
+	PaymentMethodTypes []string
+	SetupFutureUsage   string
+	LatestChargeID     string
+	NextActionType     string
+	LastPaymentError   string
+	CancellationReason string
+	Metadata           map[string]string
+	Shipping           json.RawMessage
+	CanceledAt         *time.Time
+	Created            time.Time
+}
+
+type CreatePaymentIntentParams struct {
+	Amount             int64
+	Currency           string
+	CaptureMethod      string
+	Description        *string
+	ReceiptEmail       *string
+	CustomerID         *string
+	PaymentMethodID    *string
+	PaymentMethodTypes []string
+	SetupFutureUsage   *string
+	Confirm            bool
+	OffSession         bool
+	Metadata           map[string]string
+	IdempotencyKey     string
+}
+
+type ConfirmPaymentIntentParams struct {
+	PaymentMethodID *string
+	ReturnURL       *string
+	IdempotencyKey  string
+}
+
+type CapturePaymentIntentParams struct {
+	// AmountToCapture defaults to the full capturable amount.
+	AmountToCapture *int64
+	IdempotencyKey  string
+}
+
+type CancelPaymentIntentParams struct {
+	CancellationReason *string
+	IdempotencyKey     string
+}
+
+// ListParams selects objects created in [CreatedFrom, CreatedTo).
+type ListParams struct {
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+}
+
+type Charge struct {
+	ID                   string
+	PaymentIntentID      string
+	Amount               int64
+	AmountCaptured       int64
+	AmountRefunded       int64
+	Currency             string
+	Status               string
+	Paid                 bool
+	Captured             bool
+	Refunded             bool
+	Disputed             bool
+	BalanceTransactionID string
+	Metadata             map[string]string
+	Created              time.Time
+}
+
+type Refund struct {
+	ID              string
+	PaymentIntentID string
+	ChargeID        string
+	Amount          int64
+	Currency        string
+	Status          string
+	Reason          string
+	FailureReason   string
+	Metadata        map[string]string
+	Created         time.Time
+}
+
+type CreateRefundParams struct {
+	PaymentIntentID string
+	// Amount defaults to the remaining refundable amount.
+	Amount         *int64
+	Reason         *string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+type Customer struct {
+	ID          string
+	Email       string
+	Name        string
+	Phone       string
+	Description string
+	// DefaultSource is the customer's legacy default payment source.
+	DefaultSource string
+	Metadata      map[string]string
+	Created       time.Time
+}
+
+// CustomerParams is used for both create and update; nil fields are left
+// unchanged on update.
+type CustomerParams struct {
+	Email          *string
+	Name           *string
+	Phone          *string
+	Description    *string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+type SetupIntent struct {
+	ID                 string
+	ClientSecret       string
+	Status             string
+	CustomerID         string
+	PaymentMethodID    string
+	PaymentMethodTypes []string
+	Usage              string
+	Metadata           map[string]string
+	Created            time.Time
+}
+
+type CreateSetupIntentParams struct {
+	CustomerID         string
+	PaymentMethodTypes []string
+	// Usage is off_session (the default) or on_session.
+	Usage          string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+type PaymentMethod struct {
+	ID             string
+	Type           string
+	CustomerID     string
+	Card           *Card
+	BillingDetails json.RawMessage
+	Metadata       map[string]string
+	Created        time.Time
+}
+
+type Card struct {
+	Brand       string
+	Last4       string
+	ExpMonth    int64
+	ExpYear     int64
+	Fingerprint string
+	Country     string
+}
+
+type Dispute struct {
+	ID                 string
+	ChargeID           string
+	PaymentIntentID    string
+	Amount             int64
+	Currency           string
+	Reason             string
+	Status             string
+	EvidenceDueBy      *time.Time
+	HasEvidence        bool
+	PastDue            bool
+	SubmissionCount    int64
+	IsChargeRefundable bool
+	Metadata           map[string]string
+	// BalanceTransactions are the withdrawal and, if the dispute was won,
+	// the reinstatement of the disputed funds.
+	BalanceTransactions []*BalanceTransaction
+	Created             time.Time
+}
+
+type UpdateDisputeParams struct {
+	// Evidence is keyed by the provider's evidence field names, e.g.
+	// uncategorized_text or receipt. File fields take file IDs.
+	Evidence       map[string]string
+	Submit         bool
+	IdempotencyKey string
+}
+
+type File struct {
+	ID       string
+	Filename string
+	Purpose  string
+	Size     int64
+	Type     string
+	Created  time.Time
+}
+
+type UploadFileParams struct {
+	// Purpose is e.g. dispute_evidence.
+	Purpose        string
+	Filename       string
+	Content        io.Reader
+	IdempotencyKey string
+}
+
+// BalanceTransaction amounts are in the currency the funds settled in, which
+// may differ from the currency of the charge.
+type BalanceTransaction struct {
+	ID       string
+	Amount   int64
+	Fee      int64
+	Net      int64
+	Currency string
+	Type     string
+	SourceID string
+	Created  time.Time
+}
@@ -0,0 +1,613 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+var _ PaymentProvider = (*Stripe)(nil)
+
+// Stripe implements PaymentProvider on top of the Stripe API.
+type Stripe struct {
+	client *stripe.Client
+}
+
+// NewStripe creates a Stripe provider. httpClient carries the API requests;
+// nil uses the library's default client.
+func NewStripe(apiKey string, httpClient *http.Client) *Stripe {
+	if httpClient == nil {
+		return &Stripe{client: stripe.NewClient(apiKey)}
+	}
+
+	backends := stripe.NewBackendsWithConfig(&stripe.BackendConfig{HTTPClient: httpClient})
+	return &Stripe{client: stripe.NewClient(apiKey, stripe.WithBackends(backends))}
+}
+
+func (s *Stripe) Name() string {
+	return "stripe"
+}
+
+func (s *Stripe) CreatePaymentIntent(ctx context.Context, params *CreatePaymentIntentParams) (*PaymentIntent, error) {
+	stripeParams := &stripe.PaymentIntentCreateParams{
+		Amount:           stripe.Int64(params.Amount),
+		Currency:         stripe.String(params.Currency),
+		Description:      params.Description,
+		ReceiptEmail:     params.ReceiptEmail,
+		Customer:         params.CustomerID,
+		PaymentMethod:    params.PaymentMethodID,
+		SetupFutureUsage: params.SetupFutureUsage,
+	}
+	if params.CaptureMethod != "" {
+		stripeParams.CaptureMethod = stripe.String(params.CaptureMethod)
+	}
+	if len(params.PaymentMethodTypes) > 0 {
+		stripeParams.PaymentMethodTypes = stripe.StringSlice(params.PaymentMethodTypes)
+	}
+	if params.Confirm {
+		stripeParams.Confirm = stripe.Bool(true)
+	}
+	if params.OffSession {
+		stripeParams.OffSession = stripe.Bool(true)
+	}
+	stripeParams.Metadata = params.Metadata
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	intent, err := s.client.V1PaymentIntents.Create(ctx, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) GetPaymentIntent(ctx context.Context, id string) (*PaymentIntent, error) {
+	intent, err := s.client.V1PaymentIntents.Retrieve(ctx, id, nil)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) ConfirmPaymentIntent(ctx context.Context, id string, params *ConfirmPaymentIntentParams) (*PaymentIntent, error) {
+	stripeParams := &stripe.PaymentIntentConfirmParams{
+		PaymentMethod: params.PaymentMethodID,
+		ReturnURL:     params.ReturnURL,
+	}
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	intent, err := s.client.V1PaymentIntents.Confirm(ctx, id, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) CapturePaymentIntent(ctx context.Context, id string, params *CapturePaymentIntentParams) (*PaymentIntent, error) {
+	stripeParams := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: params.AmountToCapture,
+	}
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	intent, err := s.client.V1PaymentIntents.Capture(ctx, id, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) CancelPaymentIntent(ctx context.Context, id string, params *CancelPaymentIntentParams) (*PaymentIntent, error) {
+	stripeParams := &stripe.PaymentIntentCancelParams{
+		CancellationReason: params.CancellationReason,
+	}
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	intent, err := s.client.V1PaymentIntents.Cancel(ctx, id, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) CreateRefund(ctx context.Context, params *CreateRefundParams) (*Refund, error) {
+	stripeParams := &stripe.RefundCreateParams{
+		PaymentIntent: stripe.String(params.PaymentIntentID),
+		Amount:        params.Amount,
+		Reason:        params.Reason,
+	}
+	stripeParams.Metadata = params.Metadata
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	refund, err := s.client.V1Refunds.Create(ctx, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return refundFromStripe(refund), nil
+}
+
+func (s *Stripe) CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error) {
+	stripeParams := &stripe.CustomerCreateParams{
+		Email:       params.Email,
+		Name:        params.Name,
+		Phone:       params.Phone,
+		Description: params.Description,
+	}
+	stripeParams.Metadata = params.Metadata
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	customer, err := s.client.V1Customers.Create(ctx, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return CustomerFromStripe(customer), nil
+}
+
+func (s *Stripe) UpdateCustomer(ctx context.Context, id string, params *CustomerParams) (*Customer, error) {
+	stripeParams := &stripe.CustomerUpdateParams{
+		Email:       params.Email,
+		Name:        params.Name,
+		Phone:       params.Phone,
+		Description: params.Description,
+	}
+	stripeParams.Metadata = params.Metadata
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	customer, err := s.client.V1Customers.Update(ctx, id, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return CustomerFromStripe(customer), nil
+}
+
+func (s *Stripe) DeleteCustomer(ctx context.Context, id string) error {
+	_, err := s.client.V1Customers.Delete(ctx, id, nil)
+	if err != nil {
+		return wrapStripeError(err)
+	}
+
+	return nil
+}
+
+func (s *Stripe) CreateSetupIntent(ctx context.Context, params *CreateSetupIntentParams) (*SetupIntent, error) {
+	stripeParams := &stripe.SetupIntentCreateParams{
+		Customer: stripe.String(params.CustomerID),
+	}
+	if len(params.PaymentMethodTypes) > 0 {
+		stripeParams.PaymentMethodTypes = stripe.StringSlice(params.PaymentMethodTypes)
+	}
+	if params.Usage != "" {
+		stripeParams.Usage = stripe.String(params.Usage)
+	}
+	stripeParams.Metadata = params.Metadata
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	intent, err := s.client.V1SetupIntents.Create(ctx, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return setupIntentFromStripe(intent), nil
+}
+
+func (s *Stripe) AttachPaymentMethod(ctx context.Context, paymentMethodID, customerID string) (*PaymentMethod, error) {
+	paymentMethod, err := s.client.V1PaymentMethods.Attach(ctx, paymentMethodID, &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	})
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentMethodFromStripe(paymentMethod), nil
+}
+
+func (s *Stripe) DetachPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	paymentMethod, err := s.client.V1PaymentMethods.Detach(ctx, paymentMethodID, nil)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return PaymentMethodFromStripe(paymentMethod), nil
+}
+
+func (s *Stripe) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+	}
+
+	var paymentMethods []*PaymentMethod
+	for paymentMethod, err := range s.client.V1PaymentMethods.List(ctx, params) {
+		if err != nil {
+			return nil, wrapStripeError(err)
+		}
+		paymentMethods = append(paymentMethods, PaymentMethodFromStripe(paymentMethod))
+	}
+
+	return paymentMethods, nil
+}
+
+func setIdempotencyKey(params *stripe.Params, key string) {
+	if key != "" {
+		params.SetIdempotencyKey(key)
+	}
+}
+
+// wrapStripeError maps a stripe-go error onto the provider error kinds. Errors
+// that are not API errors are treated as the provider being unreachable.
+func wrapStripeError(err error) error {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		return &Error{Kind: ErrUnavailable, Message: "the payment provider could not be reached", Err: err}
+	}
+
+	providerErr := &Error{
+		Code:        string(stripeErr.Code),
+		DeclineCode: string(stripeErr.DeclineCode),
+		Message:     stripeErr.Msg,
+		Err:         err,
+	}
+
+	if stripeErr.PaymentIntent != nil {
+		providerErr.PaymentIntent = PaymentIntentFromStripe(stripeErr.PaymentIntent)
+	}
+
+	switch {
+	case stripeErr.Type == stripe.ErrorTypeCard:
+		providerErr.Kind = ErrCardDeclined
+	case stripeErr.HTTPStatusCode == http.StatusNotFound:
+		providerErr.Kind = ErrNotFound
+	case stripeErr.HTTPStatusCode == http.StatusBadRequest, stripeErr.Type == stripe.ErrorTypeIdempotency:
+		providerErr.Kind = ErrInvalidRequest
+	default:
+		providerErr.Kind = ErrUnavailable
+	}
+
+	return providerErr
+}
+
+// PaymentIntentFromStripe converts a Stripe payment intent, e.g. one decoded
+// from a webhook event.
+func PaymentIntentFromStripe(intent *stripe.PaymentIntent) *PaymentIntent {
+	pi := &PaymentIntent{
+		ID:                 intent.ID,
+		Amount:             intent.Amount,
+		AmountCapturable:   intent.AmountCapturable,
+		AmountReceived:     intent.AmountReceived,
+		Currency:           string(intent.Currency),
+		Status:             string(intent.Status),
+		CaptureMethod:      string(intent.CaptureMethod),
+		ConfirmationMethod: string(intent.ConfirmationMethod),
+		ClientSecret:       intent.ClientSecret,
+		Description:        intent.Description,
+		ReceiptEmail:       intent.ReceiptEmail,
+		PaymentMethodTypes: intent.PaymentMethodTypes,
+		SetupFutureUsage:   string(intent.SetupFutureUsage),
+		CancellationReason: string(intent.CancellationReason),
+		Metadata:           intent.Metadata,
+		Created:            time.Unix(intent.Created, 0),
+	}
+
+	if intent.Customer != nil {
+		pi.CustomerID = intent.Customer.ID
+	}
+	if intent.PaymentMethod != nil {
+		pi.PaymentMethodID = intent.PaymentMethod.ID
+	}
+	if intent.LatestCharge != nil {
+		pi.LatestChargeID = intent.LatestCharge.ID
+	}
+	if intent.NextAction != nil {
+		pi.NextActionType = string(intent.NextAction.Type)
+	}
+	if intent.LastPaymentError != nil {
+		pi.LastPaymentError = intent.LastPaymentError.Msg
+	}
+	if intent.Shipping != nil {
+		if shipping, err := json.Marshal(intent.Shipping); err == nil {
+			pi.Shipping = shipping
+		}
+	}
+	if intent.CanceledAt != 0 {
+		canceledAt := time.Unix(intent.CanceledAt, 0)
+		pi.CanceledAt = &canceledAt
+	}
+
+	return pi
+}
+
+// PaymentMethodFromStripe converts a Stripe payment method.
+func PaymentMethodFromStripe(paymentMethod *stripe.PaymentMethod) *PaymentMethod {
+	pm := &PaymentMethod{
+		ID:       paymentMethod.ID,
+		Type:     string(paymentMethod.Type),
+		Metadata: paymentMethod.Metadata,
+		Created:  time.Unix(paymentMethod.Created, 0),
+	}
+
+	if paymentMethod.Customer != nil {
+		pm.CustomerID = paymentMethod.Customer.ID
+	}
+	if paymentMethod.BillingDetails != nil {
+		if billingDetails, err := json.Marshal(paymentMethod.BillingDetails); err == nil {
+			pm.BillingDetails = billingDetails
+		}
+	}
+	if card := paymentMethod.Card; card != nil {
+		pm.Card = &Card{
+			Brand:       string(card.Brand),
+			Last4:       card.Last4,
+			ExpMonth:    card.ExpMonth,
+			ExpYear:     card.ExpYear,
+			Fingerprint: card.Fingerprint,
+			Country:     card.Country,
+		}
+	}
+
+	return pm
+}
+
+func refundFromStripe(refund *stripe.Refund) *Refund {
+	r := &Refund{
+		ID:            refund.ID,
+		Amount:        refund.Amount,
+		Currency:      string(refund.Currency),
+		Status:        string(refund.Status),
+		Reason:        string(refund.Reason),
+		FailureReason: string(refund.FailureReason),
+		Metadata:      refund.Metadata,
+		Created:       time.Unix(refund.Created, 0),
+	}
+
+	if refund.PaymentIntent != nil {
+		r.PaymentIntentID = refund.PaymentIntent.ID
+	}
+	if refund.Charge != nil {
+		r.ChargeID = refund.Charge.ID
+	}
+
+	return r
+}
+
+func (s *Stripe) UpdateDispute(ctx context.Context, id string, params *UpdateDisputeParams) (*Dispute, error) {
+	stripeParams := &stripe.DisputeUpdateParams{}
+	for field, value := range params.Evidence {
+		stripeParams.AddExtra("evidence["+field+"]", value)
+	}
+	if params.Submit {
+		stripeParams.Submit = stripe.Bool(true)
+	}
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	dispute, err := s.client.V1Disputes.Update(ctx, id, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return DisputeFromStripe(dispute), nil
+}
+
+func (s *Stripe) UploadFile(ctx context.Context, params *UploadFileParams) (*File, error) {
+	stripeParams := &stripe.FileCreateParams{
+		Purpose:    stripe.String(params.Purpose),
+		Filename:   stripe.String(params.Filename),
+		FileReader: params.Content,
+	}
+
+	setIdempotencyKey(&stripeParams.Params, params.IdempotencyKey)
+
+	file, err := s.client.V1Files.Create(ctx, stripeParams)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return &File{
+		ID:       file.ID,
+		Filename: file.Filename,
+		Purpose:  string(file.Purpose),
+		Size:     file.Size,
+		Type:     file.Type,
+		Created:  time.Unix(file.Created, 0),
+	}, nil
+}
+
+// DisputeFromStripe converts a Stripe dispute.
+func (s *Stripe) GetBalanceTransaction(ctx context.Context, id string) (*BalanceTransaction, error) {
+	txn, err := s.client.V1BalanceTransactions.Retrieve(ctx, id, nil)
+	if err != nil {
+		return nil, wrapStripeError(err)
+	}
+
+	return balanceTransactionFromStripe(txn), nil
+}
+
+func (s *Stripe) ListPaymentIntents(ctx context.Context, params *ListParams, fn func(*PaymentIntent) error) error {
+	stripeParams := &stripe.PaymentIntentListParams{CreatedRange: createdRange(params)}
+	stripeParams.Limit = stripe.Int64(100)
+
+	for intent, err := range s.client.V1PaymentIntents.List(ctx, stripeParams) {
+		if err != nil {
+			return wrapStripeError(err)
+		}
+		if err := fn(PaymentIntentFromStripe(intent)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Stripe) ListCharges(ctx context.Context, params *ListParams, fn func(*Charge) error) error {
+	stripeParams := &stripe.ChargeListParams{CreatedRange: createdRange(params)}
+	stripeParams.Limit = stripe.Int64(100)
+
+	for charge, err := range s.client.V1Charges.List(ctx, stripeParams) {
+		if err != nil {
+			return wrapStripeError(err)
+		}
+		if err := fn(ChargeFromStripe(charge)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Stripe) ListRefunds(ctx context.Context, params *ListParams, fn func(*Refund) error) error {
+	stripeParams := &stripe.RefundListParams{CreatedRange: createdRange(params)}
+	stripeParams.Limit = stripe.Int64(100)
+
+	for refund, err := range s.client.V1Refunds.List(ctx, stripeParams) {
+		if err != nil {
+			return wrapStripeError(err)
+		}
+		if err := fn(refundFromStripe(refund)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createdRange(params *ListParams) *stripe.RangeQueryParams {
+	return &stripe.RangeQueryParams{
+		GreaterThanOrEqual: params.CreatedFrom.Unix(),
+		LesserThan:         params.CreatedTo.Unix(),
+	}
+}
+
+func ChargeFromStripe(charge *stripe.Charge) *Charge {
+	c := &Charge{
+		ID:             charge.ID,
+		Amount:         charge.Amount,
+		AmountCaptured: charge.AmountCaptured,
+		AmountRefunded: charge.AmountRefunded,
+		Currency:       string(charge.Currency),
+		Status:         string(charge.Status),
+		Paid:           charge.Paid,
+		Captured:       charge.Captured,
+		Refunded:       charge.Refunded,
+		Disputed:       charge.Disputed,
+		Metadata:       charge.Metadata,
+		Created:        time.Unix(charge.Created, 0),
+	}
+
+	if charge.PaymentIntent != nil {
+		c.PaymentIntentID = charge.PaymentIntent.ID
+	}
+	if charge.BalanceTransaction != nil {
+		c.BalanceTransactionID = charge.BalanceTransaction.ID
+	}
+
+	return c
+}
+
+func balanceTransactionFromStripe(txn *stripe.BalanceTransaction) *BalanceTransaction {
+	bt := &BalanceTransaction{
+		ID:       txn.ID,
+		Amount:   txn.Amount,
+		Fee:      txn.Fee,
+		Net:      txn.Net,
+		Currency: string(txn.Currency),
+		Type:     string(txn.Type),
+		Created:  time.Unix(txn.Created, 0),
+	}
+
+	if txn.Source != nil {
+		bt.SourceID = txn.Source.ID
+	}
+
+	return bt
+}
+
+func DisputeFromStripe(dispute *stripe.Dispute) *Dispute {
+	d := &Dispute{
+		ID:                 dispute.ID,
+		Amount:             dispute.Amount,
+		Currency:           string(dispute.Currency),
+		Reason:             string(dispute.Reason),
+		Status:             string(dispute.Status),
+		IsChargeRefundable: dispute.IsChargeRefundable,
+		Metadata:           dispute.Metadata,
+		Created:            time.Unix(dispute.Created, 0),
+	}
+
+	if dispute.Charge != nil {
+		d.ChargeID = dispute.Charge.ID
+	}
+	if dispute.PaymentIntent != nil {
+		d.PaymentIntentID = dispute.PaymentIntent.ID
+	}
+	if details := dispute.EvidenceDetails; details != nil {
+		if details.DueBy != 0 {
+			dueBy := time.Unix(details.DueBy, 0)
+			d.EvidenceDueBy = &dueBy
+		}
+		d.HasEvidence = details.HasEvidence
+		d.PastDue = details.PastDue
+		d.SubmissionCount = details.SubmissionCount
+	}
+	for _, txn := range dispute.BalanceTransactions {
+		d.BalanceTransactions = append(d.BalanceTransactions, balanceTransactionFromStripe(txn))
+	}
+
+	return d
+}
+
+func setupIntentFromStripe(intent *stripe.SetupIntent) *SetupIntent {
+	si := &SetupIntent{
+		ID:                 intent.ID,
+		ClientSecret:       intent.ClientSecret,
+		Status:             string(intent.Status),
+		PaymentMethodTypes: intent.PaymentMethodTypes,
+		Usage:              string(intent.Usage),
+		Metadata:           intent.Metadata,
+		Created:            time.Unix(intent.Created, 0),
+	}
+
+	if intent.Customer != nil {
+		si.CustomerID = intent.Customer.ID
+	}
+	if intent.PaymentMethod != nil {
+		si.PaymentMethodID = intent.PaymentMethod.ID
+	}
+
+	return si
+}
+
+// CustomerFromStripe converts a Stripe customer.
+func CustomerFromStripe(customer *stripe.Customer) *Customer {
+	c := &Customer{
+		ID:          customer.ID,
+		Email:       customer.Email,
+		Name:        customer.Name,
+		Phone:       customer.Phone,
+		Description: customer.Description,
+		Metadata:    customer.Metadata,
+		Created:     time.Unix(customer.Created, 0),
+	}
+
+	if customer.DefaultSource != nil {
+		c.DefaultSource = customer.DefaultSource.ID
+	}
+
+	return c
+}
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_outbox_sent_at;
+DROP INDEX IF EXISTS idx_outbox_unsent;
+
+-- Drop the outbox table
+DROP TABLE IF EXISTS outbox;
@@ -0,0 +1,17 @@
+CREATE TABLE outbox (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    exchange VARCHAR(255) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL DEFAULT '',
+    message_id VARCHAR(255) NOT NULL,
+    message_type VARCHAR(100) NOT NULL,
+    headers JSONB DEFAULT '{}',
+    payload BYTEA NOT NULL, -- Raw message body, published byte for byte
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Indexes for outbox
+CREATE INDEX idx_outbox_unsent ON outbox(created_at) WHERE sent_at IS NULL;
+CREATE INDEX idx_outbox_sent_at ON outbox(sent_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_idempotency_keys_expires_at;
+
+-- Drop the idempotency_keys table
+DROP TABLE IF EXISTS idempotency_keys;
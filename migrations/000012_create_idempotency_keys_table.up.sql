@@ -0,0 +1,17 @@
+CREATE TABLE idempotency_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_method VARCHAR(10) NOT NULL,
+    request_path TEXT NOT NULL,
+    request_hash VARCHAR(64) NOT NULL, -- SHA-256 of method, path and body
+    response_status INTEGER, -- NULL while the original request is in flight
+    response_body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+
+    CONSTRAINT uq_idempotency_keys_user_key UNIQUE (user_id, idempotency_key)
+);
+
+-- Indexes for idempotency_keys
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_payment_intents_requires_capture;
+
+ALTER TABLE payment_intents DROP COLUMN IF EXISTS authorization_expiry_warned_at;
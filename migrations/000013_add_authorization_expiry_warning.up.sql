@@ -0,0 +1,4 @@
+ALTER TABLE payment_intents ADD COLUMN authorization_expiry_warned_at TIMESTAMP WITH TIME ZONE;
+
+-- Uncaptured authorizations are scanned periodically for expiry
+CREATE INDEX idx_payment_intents_requires_capture ON payment_intents(confirmed_at) WHERE status = 'requires_capture';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS uq_customers_user_id;
+
+ALTER TABLE customers DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,4 @@
+ALTER TABLE customers ADD COLUMN user_id BIGINT;
+
+-- Each user maps to at most one provider customer
+CREATE UNIQUE INDEX uq_customers_user_id ON customers(user_id) WHERE user_id IS NOT NULL;
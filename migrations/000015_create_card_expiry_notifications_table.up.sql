@@ -0,0 +1,10 @@
+CREATE TABLE card_expiry_notifications (
+    payment_method_id UUID NOT NULL REFERENCES payment_methods(id) ON DELETE CASCADE,
+    threshold_days INTEGER NOT NULL, -- 0 for an already expired default card
+    card_exp_month INTEGER NOT NULL,
+    card_exp_year INTEGER NOT NULL,
+    notified_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    -- A card updated with a new expiry date is notified again
+    PRIMARY KEY (payment_method_id, threshold_days, card_exp_year, card_exp_month)
+);
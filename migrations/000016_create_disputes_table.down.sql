@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS update_disputes_updated_at ON disputes;
+
+DROP TABLE IF EXISTS disputes;
@@ -0,0 +1,35 @@
+CREATE TABLE disputes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    stripe_dispute_id VARCHAR(255) UNIQUE NOT NULL,
+    charge_id UUID REFERENCES charges(id) ON DELETE CASCADE,
+    payment_intent_id UUID REFERENCES payment_intents(id) ON DELETE CASCADE,
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    reason VARCHAR(50) NOT NULL, -- fraudulent, product_not_received, etc.
+    status VARCHAR(50) NOT NULL, -- needs_response, under_review, won, lost, etc.
+    evidence_due_by TIMESTAMP WITH TIME ZONE,
+    has_evidence BOOLEAN DEFAULT FALSE,
+    past_due BOOLEAN DEFAULT FALSE,
+    submission_count INTEGER DEFAULT 0,
+    is_charge_refundable BOOLEAN DEFAULT FALSE,
+    metadata JSONB DEFAULT '{}',
+    funds_withdrawn_at TIMESTAMP WITH TIME ZONE,
+    funds_reinstated_at TIMESTAMP WITH TIME ZONE,
+    deadline_reminder_sent_at TIMESTAMP WITH TIME ZONE,
+    closed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Indexes for disputes
+CREATE INDEX idx_disputes_charge_id ON disputes(charge_id);
+CREATE INDEX idx_disputes_payment_intent_id ON disputes(payment_intent_id);
+CREATE INDEX idx_disputes_status ON disputes(status);
+
+-- Open disputes are listed and reminded about by deadline
+CREATE INDEX idx_disputes_open_evidence_due_by ON disputes(evidence_due_by)
+WHERE status IN ('warning_needs_response', 'warning_under_review', 'needs_response', 'under_review');
+
+CREATE TRIGGER update_disputes_updated_at
+    BEFORE UPDATE ON disputes
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
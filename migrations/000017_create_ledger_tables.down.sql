@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS prevent_ledger_postings_changes ON ledger_postings;
+DROP TRIGGER IF EXISTS prevent_ledger_entries_changes ON ledger_entries;
+DROP TRIGGER IF EXISTS check_ledger_postings_balanced ON ledger_postings;
+
+DROP FUNCTION IF EXISTS prevent_ledger_changes();
+DROP FUNCTION IF EXISTS check_ledger_entry_balanced();
+
+DROP TABLE IF EXISTS ledger_postings;
+DROP TABLE IF EXISTS ledger_entries;
+DROP TABLE IF EXISTS ledger_accounts;
@@ -0,0 +1,78 @@
+-- Append-only double-entry ledger. Each entry has postings that sum to zero
+-- per currency; debits are positive, credits negative.
+CREATE TABLE ledger_accounts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code VARCHAR(100) UNIQUE NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CONSTRAINT chk_ledger_accounts_type_valid CHECK (type IN ('asset', 'liability', 'equity', 'revenue', 'expense'))
+);
+
+INSERT INTO ledger_accounts (code, name, type) VALUES
+    ('provider_balance', 'Funds held at the payment provider', 'asset'),
+    ('sales', 'Captured card payments', 'revenue'),
+    ('refunds', 'Refunds paid back to customers', 'revenue'),
+    ('dispute_losses', 'Funds withdrawn for disputes', 'expense'),
+    ('provider_fees', 'Payment provider fees', 'expense');
+
+CREATE TABLE ledger_entries (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    -- reference identifies the money movement, e.g. charge:ch_123:captured,
+    -- so an event processed twice is only posted once.
+    reference VARCHAR(255) UNIQUE NOT NULL,
+    description TEXT NOT NULL,
+    reverses_entry_id UUID REFERENCES ledger_entries(id),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE ledger_postings (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    entry_id UUID NOT NULL REFERENCES ledger_entries(id),
+    account_id UUID NOT NULL REFERENCES ledger_accounts(id),
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    CONSTRAINT chk_ledger_postings_amount_nonzero CHECK (amount <> 0)
+);
+
+-- Indexes for ledger
+CREATE INDEX idx_ledger_entries_created_at ON ledger_entries(created_at);
+CREATE INDEX idx_ledger_postings_entry_id ON ledger_postings(entry_id);
+CREATE INDEX idx_ledger_postings_account_id ON ledger_postings(account_id, currency);
+
+-- Entries are checked at commit, once all their postings are written
+CREATE OR REPLACE FUNCTION check_ledger_entry_balanced()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM ledger_postings
+        WHERE entry_id = NEW.entry_id
+        GROUP BY currency
+        HAVING SUM(amount) <> 0
+    ) THEN
+        RAISE EXCEPTION 'ledger entry % is not balanced', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE CONSTRAINT TRIGGER check_ledger_postings_balanced
+    AFTER INSERT ON ledger_postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_ledger_entry_balanced();
+
+-- The ledger is corrected with reversing entries, never edited
+CREATE OR REPLACE FUNCTION prevent_ledger_changes()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'the ledger is append-only';
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER prevent_ledger_entries_changes
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION prevent_ledger_changes();
+
+CREATE TRIGGER prevent_ledger_postings_changes
+    BEFORE UPDATE OR DELETE ON ledger_postings
+    FOR EACH ROW EXECUTE FUNCTION prevent_ledger_changes();
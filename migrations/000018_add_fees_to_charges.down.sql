@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_charges_fee_pending;
+
+ALTER TABLE charges DROP COLUMN IF EXISTS fee_currency;
+ALTER TABLE charges DROP COLUMN IF EXISTS fee;
+ALTER TABLE charges DROP COLUMN IF EXISTS balance_transaction_id;
@@ -0,0 +1,7 @@
+ALTER TABLE charges ADD COLUMN balance_transaction_id VARCHAR(255);
+ALTER TABLE charges ADD COLUMN fee BIGINT;
+ALTER TABLE charges ADD COLUMN fee_currency VARCHAR(3);
+
+-- Captured charges whose fee is not known yet are looked up periodically
+CREATE INDEX idx_charges_fee_pending ON charges(created_at)
+WHERE balance_transaction_id IS NOT NULL AND fee IS NULL;
@@ -0,0 +1,33 @@
+CREATE TABLE reconciliation_runs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    range_from TIMESTAMP WITH TIME ZONE NOT NULL,
+    range_to TIMESTAMP WITH TIME ZONE NOT NULL,
+    auto_heal BOOLEAN NOT NULL DEFAULT FALSE,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    objects_checked INTEGER NOT NULL DEFAULT 0,
+    findings_count INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMP WITH TIME ZONE,
+    CONSTRAINT chk_reconciliation_runs_status_valid CHECK (status IN ('running', 'completed', 'failed'))
+);
+
+CREATE TABLE reconciliation_findings (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    run_id UUID NOT NULL REFERENCES reconciliation_runs(id) ON DELETE CASCADE,
+    object_type VARCHAR(50) NOT NULL, -- payment_intent, charge, refund
+    stripe_object_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    field VARCHAR(100),
+    provider_value TEXT,
+    local_value TEXT,
+    healed_at TIMESTAMP WITH TIME ZONE,
+    heal_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CONSTRAINT chk_reconciliation_findings_kind_valid CHECK (kind IN ('missing_locally', 'missing_at_provider', 'mismatch'))
+);
+
+-- Indexes for reconciliation
+CREATE INDEX idx_reconciliation_runs_started_at ON reconciliation_runs(started_at);
+CREATE INDEX idx_reconciliation_findings_run_id ON reconciliation_findings(run_id);
+CREATE INDEX idx_reconciliation_findings_stripe_object_id ON reconciliation_findings(stripe_object_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_webhook_events_failed;
+
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS last_replayed_at;
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS replay_count;
@@ -0,0 +1,6 @@
+ALTER TABLE webhook_events ADD COLUMN replay_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE webhook_events ADD COLUMN last_replayed_at TIMESTAMP WITH TIME ZONE;
+
+-- Failed events are selected for replay
+CREATE INDEX idx_webhook_events_failed ON webhook_events(created_at)
+WHERE processed = FALSE AND error_message IS NOT NULL;
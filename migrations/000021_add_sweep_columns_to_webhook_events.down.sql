@@ -0,0 +1,2 @@
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS last_swept_at;
@@ -0,0 +1,2 @@
+ALTER TABLE webhook_events ADD COLUMN last_swept_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE webhook_events ADD COLUMN failed_at TIMESTAMP WITH TIME ZONE;
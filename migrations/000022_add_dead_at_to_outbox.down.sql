@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_outbox_unsent;
+CREATE INDEX idx_outbox_unsent ON outbox(created_at) WHERE sent_at IS NULL;
+
+ALTER TABLE outbox DROP COLUMN IF EXISTS dead_at;
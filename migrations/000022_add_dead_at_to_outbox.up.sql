@@ -0,0 +1,6 @@
+-- Messages that used up their attempts are parked, so they stop blocking the
+-- messages queued after them
+ALTER TABLE outbox ADD COLUMN dead_at TIMESTAMP WITH TIME ZONE;
+
+DROP INDEX IF EXISTS idx_outbox_unsent;
+CREATE INDEX idx_outbox_unsent ON outbox(created_at) WHERE sent_at IS NULL AND dead_at IS NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS dead_lettered_at;
+ALTER TABLE webhook_events DROP COLUMN IF EXISTS sweep_count;
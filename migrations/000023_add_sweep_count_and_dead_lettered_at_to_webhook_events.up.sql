@@ -0,0 +1,7 @@
+-- Sweeps are counted apart from the delivery attempts in retry_count. Until
+-- now both shared retry_count, so events already swept keep their count.
+ALTER TABLE webhook_events ADD COLUMN sweep_count INTEGER NOT NULL DEFAULT 0;
+UPDATE webhook_events SET sweep_count = retry_count WHERE last_swept_at IS NOT NULL;
+
+-- Events the workers dead-lettered are left to a replay instead of being swept
+ALTER TABLE webhook_events ADD COLUMN dead_lettered_at TIMESTAMP WITH TIME ZONE;